@@ -0,0 +1,31 @@
+package connection
+
+import "time"
+
+// Backoff returns the time to wait before the next attempt. Attempts are
+// counted from 1.
+type Backoff func(attempt int) time.Duration
+
+// ConstantBackoff returns Backoff that waits d before each attempt
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff returns Backoff that doubles the wait time after each
+// attempt starting from initial and up to max
+func ExponentialBackoff(initial, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		wait := initial
+		for i := 1; i < attempt && wait < max; i++ {
+			wait *= 2
+		}
+
+		if wait > max {
+			return max
+		}
+
+		return wait
+	}
+}
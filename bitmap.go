@@ -0,0 +1,41 @@
+package connection
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// checkBitmap checks that the bitmap of the unpacked message is consistent
+// with its fields: message packed again must have the same bitmap and
+// size as the received one. It catches e.g. data that follows the fields
+// indicated by the bitmap or bitmap indicating secondary bitmap without
+// secondary fields, that are tolerated by Unpack.
+func checkBitmap(message *iso8583.Message, rawMessage []byte) error {
+	received, err := message.Bitmap().Bytes()
+	if err != nil {
+		return fmt.Errorf("%w: reading bitmap: %v", ErrInconsistentBitmap, err)
+	}
+
+	// packing regenerates the bitmap from the unpacked fields
+	packed, err := message.Pack()
+	if err != nil {
+		return fmt.Errorf("%w: packing message: %v", ErrInconsistentBitmap, err)
+	}
+
+	expected, err := message.Bitmap().Bytes()
+	if err != nil {
+		return fmt.Errorf("%w: reading bitmap: %v", ErrInconsistentBitmap, err)
+	}
+
+	if !bytes.Equal(received, expected) {
+		return fmt.Errorf("%w: bitmap %X, unpacked fields indicate %X", ErrInconsistentBitmap, received, expected)
+	}
+
+	if len(packed) != len(rawMessage) {
+		return fmt.Errorf("%w: message size %d, unpacked fields size %d", ErrInconsistentBitmap, len(rawMessage), len(packed))
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package connection_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_StrictResponseBitmap(t *testing.T) {
+	// packed returns packed message with MTI, bitmap and STAN
+	packed := func(t *testing.T) []byte {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0810")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		raw, err := message.Pack()
+		require.NoError(t, err)
+
+		return raw
+	}
+
+	// connect returns server side of the network connection and
+	// channels with messages and errors handled by the client
+	connect := func(t *testing.T, options ...connection.Option) (net.Conn, chan *iso8583.Message, chan error) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { serverConn.Close() })
+
+		messages := make(chan *iso8583.Message, 1)
+		errs := make(chan error, 1)
+
+		options = append(options,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				messages <- message
+			}),
+			connection.ErrorHandler(func(err error) {
+				errs <- err
+			}),
+		)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		return serverConn, messages, errs
+	}
+
+	write := func(t *testing.T, conn net.Conn, raw []byte) {
+		_, err := writeMessageLength(conn, len(raw))
+		require.NoError(t, err)
+		_, err = conn.Write(raw)
+		require.NoError(t, err)
+	}
+
+	requireInconsistent := func(t *testing.T, errs chan error) {
+		select {
+		case err := <-errs:
+			var unpackErr *connection.ErrUnpack
+			require.True(t, errors.As(err, &unpackErr))
+			require.ErrorIs(t, err, connection.ErrInconsistentBitmap)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("error was not handled")
+		}
+	}
+
+	t.Run("consistent message is handled", func(t *testing.T) {
+		conn, messages, _ := connect(t, connection.StrictResponseBitmap())
+
+		write(t, conn, packed(t))
+
+		select {
+		case <-messages:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("message was not handled")
+		}
+	})
+
+	t.Run("data after the fields indicated by the bitmap", func(t *testing.T) {
+		conn, _, errs := connect(t, connection.StrictResponseBitmap())
+
+		write(t, conn, append(packed(t), "123456"...))
+
+		requireInconsistent(t, errs)
+	})
+
+	t.Run("secondary bitmap without secondary fields", func(t *testing.T) {
+		conn, _, errs := connect(t, connection.StrictResponseBitmap())
+
+		// MTI (4 bytes) is followed by the primary bitmap (8 bytes)
+		raw := packed(t)
+		inconsistent := append([]byte{}, raw[:12]...)
+		inconsistent[4] |= 0x80
+		inconsistent = append(inconsistent, make([]byte, 8)...)
+		inconsistent = append(inconsistent, raw[12:]...)
+
+		write(t, conn, inconsistent)
+
+		requireInconsistent(t, errs)
+	})
+
+	t.Run("inconsistency is tolerated without the option", func(t *testing.T) {
+		conn, messages, _ := connect(t)
+
+		write(t, conn, append(packed(t), "123456"...))
+
+		select {
+		case <-messages:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("message was not handled")
+		}
+	})
+}
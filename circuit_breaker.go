@@ -0,0 +1,163 @@
+package connection
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by Send when circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the Send circuit breaker
+type CircuitState string
+
+const (
+	// CircuitClosed means requests are sent as usual
+	CircuitClosed CircuitState = "closed"
+
+	// CircuitOpen means requests are rejected with ErrCircuitOpen
+	CircuitOpen CircuitState = "open"
+
+	// CircuitHalfOpen means cooldown has passed and a single trial
+	// request is allowed to check if the server has recovered
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// isTransportError returns true if err is caused by a network failure or
+// timeout rather than by the message itself or by the server's decision
+func isTransportError(err error) bool {
+	return errors.Is(err, ErrSendTimeout) ||
+		errors.Is(err, ErrConnectionClosed) ||
+		errors.Is(err, ErrConnectionUnavailable) ||
+		errors.Is(err, ErrWriteQueueTimeout)
+}
+
+// localError wraps the error returned by send before the request was
+// queued for writing (e.g. packing or request ID error), so it's not
+// counted by the circuit breaker
+type localError struct {
+	err error
+}
+
+func (e *localError) Error() string {
+	return e.err.Error()
+}
+
+func (e *localError) Unwrap() error {
+	return e.err
+}
+
+// localErr wraps err into the localError
+func localErr(err error) error {
+	return &localError{err: err}
+}
+
+// unwrapLocal returns the error wrapped into the localError, so callers of
+// Send get the original error
+func unwrapLocal(err error) error {
+	var local *localError
+	if errors.As(err, &local) {
+		return local.err
+	}
+
+	return err
+}
+
+// notSent returns true if err means request was rejected by the connection
+// before it was queued for writing (e.g. ErrQueueFull, ErrNotSignedOn or
+// packing error), so it says nothing about the transport
+func notSent(err error) bool {
+	var local *localError
+
+	return errors.As(err, &local)
+}
+
+// circuitBreaker tracks consecutive transport failures of Send
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+
+	// trial request is being sent in the half-open state
+	trial bool
+}
+
+func (cb *circuitBreaker) state(cooldown time.Duration, now time.Time) CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.stateLocked(cooldown, now)
+}
+
+func (cb *circuitBreaker) stateLocked(cooldown time.Duration, now time.Time) CircuitState {
+	switch {
+	case !cb.open:
+		return CircuitClosed
+	case now.Sub(cb.openedAt) >= cooldown:
+		return CircuitHalfOpen
+	default:
+		return CircuitOpen
+	}
+}
+
+// allow returns true if request can be sent. In the half-open state only a
+// single trial request is allowed, and trial is true for it.
+func (cb *circuitBreaker) allow(cooldown time.Duration, now time.Time) (allowed, trial bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.stateLocked(cooldown, now) {
+	case CircuitOpen:
+		return false, false
+	case CircuitHalfOpen:
+		if cb.trial {
+			return false, false
+		}
+		cb.trial = true
+		return true, true
+	}
+
+	return true, false
+}
+
+// done records the result of the request allowed by allow. trial is the one
+// returned by allow for the request, so requests that were sent before the
+// circuit opened don't take the place of the trial request.
+func (cb *circuitBreaker) done(trial bool, err error, threshold int, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if trial {
+		cb.trial = false
+	}
+
+	if notSent(err) {
+		return
+	}
+
+	if !isTransportError(err) {
+		cb.failures = 0
+		cb.open = false
+		return
+	}
+
+	cb.failures++
+
+	// failed trial request opens the circuit again
+	if trial || cb.failures >= threshold {
+		cb.open = true
+		cb.openedAt = now
+	}
+}
+
+// CircuitState returns the state of the Send circuit breaker. It's always
+// CircuitClosed when CircuitBreaker option is not set.
+func (c *Connection) CircuitState() CircuitState {
+	if c.Opts.CircuitBreakerThreshold <= 0 {
+		return CircuitClosed
+	}
+
+	return c.circuit.state(c.Opts.CircuitBreakerCooldown, c.Opts.Clock.Now())
+}
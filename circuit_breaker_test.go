@@ -0,0 +1,238 @@
+package connection_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_CircuitBreaker(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	newMessage := func(t *testing.T, responseCode string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, TestCaseReply))
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(39, responseCode))
+		return message
+	}
+
+	t.Run("opens after transport failures, half-opens after cooldown and closes on success", func(t *testing.T) {
+		clock := &testClock{}
+		clock.Set(time.Now())
+
+		// connection is not established yet, so all sends fail with
+		// ErrConnectionUnavailable
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(50*time.Millisecond),
+			connection.SetClock(clock),
+			connection.CircuitBreaker(2, time.Minute),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.Equal(t, connection.CircuitClosed, c.CircuitState())
+
+		for i := 0; i < 2; i++ {
+			_, err = c.Send(newMessage(t, "00"))
+			require.ErrorIs(t, err, connection.ErrConnectionUnavailable)
+		}
+
+		require.Equal(t, connection.CircuitOpen, c.CircuitState())
+
+		start := time.Now()
+		_, err = c.Send(newMessage(t, "00"))
+		require.ErrorIs(t, err, connection.ErrCircuitOpen)
+		require.Less(t, time.Since(start), 50*time.Millisecond)
+
+		// failed trial request opens the circuit again
+		clock.Set(clock.Now().Add(time.Minute))
+		require.Equal(t, connection.CircuitHalfOpen, c.CircuitState())
+
+		_, err = c.Send(newMessage(t, "00"))
+		require.ErrorIs(t, err, connection.ErrConnectionUnavailable)
+		require.Equal(t, connection.CircuitOpen, c.CircuitState())
+
+		// successful trial request closes the circuit
+		clock.Set(clock.Now().Add(time.Minute))
+		require.Equal(t, connection.CircuitHalfOpen, c.CircuitState())
+		require.NoError(t, c.Connect())
+
+		_, err = c.Send(newMessage(t, "00"))
+		require.NoError(t, err)
+		require.Equal(t, connection.CircuitClosed, c.CircuitState())
+	})
+
+	t.Run("requests rejected before they are sent do not close the circuit", func(t *testing.T) {
+		// connection is not established yet, so sent requests fail
+		// with ErrConnectionUnavailable
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(100*time.Millisecond),
+			connection.CircuitBreaker(2, time.Minute),
+			connection.MaxPendingRequests(1),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Send(newMessage(t, "00"))
+		require.ErrorIs(t, err, connection.ErrConnectionUnavailable)
+
+		sendErr := make(chan error, 1)
+		go func() {
+			_, err := c.Send(newMessage(t, "00"))
+			sendErr <- err
+		}()
+
+		// request is rejected while the other one takes the only slot
+		require.Eventually(t, func() bool {
+			_, err := c.Send(newMessage(t, "00"))
+			return errors.Is(err, connection.ErrTooManyPendingRequests)
+		}, time.Second, time.Millisecond)
+
+		require.ErrorIs(t, <-sendErr, connection.ErrConnectionUnavailable)
+		require.Equal(t, connection.CircuitOpen, c.CircuitState())
+	})
+
+	t.Run("requests rejected before sign-on do not close the circuit", func(t *testing.T) {
+		// connection is not established yet, so sign-on fails with
+		// ErrConnectionUnavailable
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(50*time.Millisecond),
+			connection.CircuitBreaker(2, time.Minute),
+			connection.RequireSignOn(),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.ErrorIs(t, c.SignOn(context.Background()), connection.ErrConnectionUnavailable)
+
+		transaction := newMessage(t, "00")
+		transaction.MTI("0200")
+
+		_, err = c.Send(transaction)
+		require.ErrorIs(t, err, connection.ErrNotSignedOn)
+
+		require.ErrorIs(t, c.SignOn(context.Background()), connection.ErrConnectionUnavailable)
+		require.Equal(t, connection.CircuitOpen, c.CircuitState())
+	})
+
+	t.Run("request sent before the circuit opened does not free the trial slot", func(t *testing.T) {
+		clock := &testClock{}
+		clock.Set(time.Now())
+
+		// connection is not established yet, so sent requests fail
+		// with ErrConnectionUnavailable after SendTimeout
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(400*time.Millisecond),
+			connection.SetClock(clock),
+			connection.CircuitBreaker(1, time.Minute),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		send := func() <-chan error {
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := c.Send(newMessage(t, "00"))
+				errCh <- err
+			}()
+			return errCh
+		}
+
+		openingErr := send()
+
+		// request is sent while the circuit is closed and fails after
+		// the trial request is sent
+		time.Sleep(150 * time.Millisecond)
+		earlyErr := send()
+
+		require.ErrorIs(t, <-openingErr, connection.ErrConnectionUnavailable)
+		require.Equal(t, connection.CircuitOpen, c.CircuitState())
+
+		clock.Advance(time.Minute)
+		trialErr := send()
+
+		require.ErrorIs(t, <-earlyErr, connection.ErrConnectionUnavailable)
+
+		// trial request is still in flight, so no other request is
+		// allowed
+		clock.Advance(time.Minute)
+		_, err = c.Send(newMessage(t, "00"))
+		require.ErrorIs(t, err, connection.ErrCircuitOpen)
+
+		require.ErrorIs(t, <-trialErr, connection.ErrConnectionUnavailable)
+		require.Equal(t, connection.CircuitOpen, c.CircuitState())
+	})
+
+	t.Run("trial request that fails to pack does not close the circuit", func(t *testing.T) {
+		clock := &testClock{}
+		clock.Set(time.Now())
+
+		// connection is not established yet, so sent requests fail
+		// with ErrConnectionUnavailable
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(50*time.Millisecond),
+			connection.SetClock(clock),
+			connection.CircuitBreaker(1, time.Minute),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Send(newMessage(t, "00"))
+		require.ErrorIs(t, err, connection.ErrConnectionUnavailable)
+		require.Equal(t, connection.CircuitOpen, c.CircuitState())
+
+		clock.Advance(time.Minute)
+
+		// field 2 is fixed length 3, so message can't be packed
+		message := newMessage(t, "00")
+		require.NoError(t, message.Field(2, "12345"))
+
+		_, err = c.Send(message)
+		require.ErrorContains(t, err, "packing message")
+		require.Equal(t, connection.CircuitHalfOpen, c.CircuitState())
+
+		// the next request is the trial one
+		_, err = c.Send(newMessage(t, "00"))
+		require.ErrorIs(t, err, connection.ErrConnectionUnavailable)
+		require.Equal(t, connection.CircuitOpen, c.CircuitState())
+	})
+
+	t.Run("threshold and cooldown should be positive", func(t *testing.T) {
+		_, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.CircuitBreaker(0, time.Minute),
+		)
+		require.ErrorContains(t, err, "circuit breaker threshold should be positive")
+
+		_, err = connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.CircuitBreaker(2, 0),
+		)
+		require.ErrorContains(t, err, "circuit breaker cooldown should be positive")
+	})
+
+	t.Run("declines do not open the circuit", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.ApprovedResponseCodes("00"),
+			connection.CircuitBreaker(2, time.Minute),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		for i := 0; i < 3; i++ {
+			_, err = c.Send(newMessage(t, "05"))
+			var declineErr *connection.DeclineError
+			require.True(t, errors.As(err, &declineErr))
+		}
+
+		require.Equal(t, connection.CircuitClosed, c.CircuitState())
+	})
+}
@@ -3,12 +3,14 @@ package connection
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/moov-io/iso8583"
@@ -18,9 +20,94 @@ import (
 var (
 	ErrConnectionClosed = errors.New("connection closed")
 	ErrSendTimeout      = errors.New("message send timeout")
+
+	// ErrConnectionReset is returned to the pending requests when network
+	// connection was lost (closed by the server or because of the network
+	// error) rather than closed with Close. Server may not have received
+	// the request, so it's usually safe to retry it. It wraps
+	// ErrConnectionClosed.
+	ErrConnectionReset = fmt.Errorf("connection reset: %w", ErrConnectionClosed)
+
+	// ErrConnectionUnavailable is returned when request was not picked up
+	// for writing within SendTimeout because there is no established
+	// connection (e.g. Connect was not called yet or connection is being
+	// re-established). It's safe to retry the request.
+	ErrConnectionUnavailable = errors.New("connection is not available")
+
+	// ErrSTANFieldUnavailable is returned when STAN (field 11) can't be
+	// read or set, e.g. when field 11 is not defined in the spec
+	ErrSTANFieldUnavailable = errors.New("STAN (field 11) is not available")
+
+	// ErrSTANExhausted is returned when connection has to set STAN (field
+	// 11) but all STANs are used by pending requests
+	ErrSTANExhausted = errors.New("all STANs are used by pending requests")
+
+	// ErrWriteQueueTimeout is returned when request was not written into
+	// the connection within WriteQueueTimeout after it was queued
+	ErrWriteQueueTimeout = errors.New("request was not written within write queue timeout")
+
+	// ErrMessageTooLarge is returned when packed message exceeds
+	// MaxSendSize
+	ErrMessageTooLarge = errors.New("message is too large")
+
+	// ErrRequestIDPending is returned when request with the same ID is
+	// already waiting for the response
+	ErrRequestIDPending = errors.New("request with the same ID is pending")
+
+	// ErrPaused is returned by Send when sending is paused with Pause and
+	// it can't wait for Resume
+	ErrPaused = errors.New("sending is paused")
+
+	// ErrReconnecting is returned by Send when network connection is
+	// being re-established and FailFastDuringReconnect is set
+	ErrReconnecting = errors.New("connection is reconnecting")
+
+	// ErrInflightBytesExceeded is returned by Send when request would
+	// exceed MaxInflightBytes and other requests didn't complete within
+	// SendTimeout (or right away by TrySend)
+	ErrInflightBytesExceeded = errors.New("max in-flight bytes exceeded")
+
+	// ErrTooManyPendingRequests is returned by Send when MaxPendingRequests
+	// requests are already being sent
+	ErrTooManyPendingRequests = errors.New("too many pending requests")
+
+	// ErrQueueFull is returned by TrySend when the write queue can't
+	// accept the request without waiting
+	ErrQueueFull = errors.New("write queue is full")
+
+	// ErrReadTimeoutsExceeded is used to close the connection when no
+	// messages were received during MaxReadTimeouts consecutive read
+	// timeouts
+	ErrReadTimeoutsExceeded = errors.New("no messages received during max read timeouts")
+
+	// ErrMissingMTI is returned by Send with ValidateMTI option when MTI of
+	// the message is not set
+	ErrMissingMTI = errors.New("message MTI is not set")
+
+	// ErrInvalidMTI is returned by Send with ValidateMTI option when MTI of
+	// the message is not valid for the spec
+	ErrInvalidMTI = errors.New("invalid message MTI")
+
+	// ErrInconsistentBitmap is wrapped by the *ErrUnpack passed to the
+	// ErrorHandler with StrictResponseBitmap option when bitmap of the
+	// received message doesn't match its fields
+	ErrInconsistentBitmap = errors.New("bitmap is inconsistent with message fields")
+
+	// ErrNotReady is returned by Connect when network connection was
+	// established, but echo of the ReadinessProbe was not approved
+	ErrNotReady = errors.New("connection is not ready")
+
+	// ErrConnectionFailed is returned by Send when connection was closed
+	// because network connection was not re-established within
+	// MaxReconnectAttempts. It wraps ErrConnectionClosed.
+	ErrConnectionFailed = fmt.Errorf("reconnect attempts exhausted: %w", ErrConnectionClosed)
+
+	// ErrNotSignedOn is returned by Send when RequireSignOn is set and
+	// sign-on was not approved on the current network connection yet
+	ErrNotSignedOn = errors.New("connection is not signed on")
 )
 
-const DefaultTransmissionDateTimeFormat string = "0102150405" // YYMMDDhhmmss
+const DefaultTransmissionDateTimeFormat string = "0102150405" // MMDDhhmmss
 
 // MessageLengthReader reads message header from the r and returns message length
 type MessageLengthReader func(r io.Reader) (int, error)
@@ -47,6 +134,10 @@ const (
 type ErrUnpack struct {
 	Err        error
 	RawMessage []byte
+
+	// Message is the partially unpacked message (fields unpacked before
+	// the error). It's set only when DeliverPartialUnpack option is set.
+	Message *iso8583.Message
 }
 
 func (e *ErrUnpack) Error() string {
@@ -57,6 +148,22 @@ func (e *ErrUnpack) Unwrap() error {
 	return e.Err
 }
 
+// ErrInvalidTrailer is passed to the ErrorHandler when received message was
+// dropped because its trailer is not valid
+type ErrInvalidTrailer struct {
+	Err        error
+	RawMessage []byte
+	Trailer    []byte
+}
+
+func (e *ErrInvalidTrailer) Error() string {
+	return fmt.Sprintf("invalid message trailer: %s", e.Err.Error())
+}
+
+func (e *ErrInvalidTrailer) Unwrap() error {
+	return e.Err
+}
+
 // Connection represents an ISO 8583 Connection. Connection may be used
 // by multiple goroutines simultaneously.
 type Connection struct {
@@ -67,6 +174,13 @@ type Connection struct {
 	readResponseCh chan []byte
 	done           chan struct{}
 
+	// closed when shutdown is complete (see WaitClosed)
+	closed chan struct{}
+
+	// readConn is the connection responses are read from in dual-socket
+	// mode (when ReadAddr option is set)
+	readConn io.ReadWriteCloser
+
 	// spec that will be used to unpack received messages
 	spec *iso8583.MessageSpec
 
@@ -81,10 +195,47 @@ type Connection struct {
 	pendingRequestsMu sync.Mutex
 	respMap           map[string]response
 
+	// requests that got responses, to drop duplicate responses. It's
+	// protected by the pendingRequestsMu.
+	answered answeredRequests
+
+	// requests that timed out within the lateResponseWindow, to report
+	// late responses. It's protected by the pendingRequestsMu.
+	timedOut answeredRequests
+
+	// requests that timed out within the InDoubtWindow. It's protected
+	// by the pendingRequestsMu.
+	inDoubt inDoubtRequests
+
+	// serializes writes into the MessageLog
+	messageLogMu sync.Mutex
+
+	// counters returned by Stats
+	stats stats
+
+	// size of the requests being sent (see MaxInflightBytes)
+	inflight inflightBytes
+
+	// number of the requests being sent (see MaxPendingRequests)
+	pending pendingSlots
+
+	// latest round trip times (see LatencyWindow)
+	latencies latencyRing
+
+	// requests sent with SendOrdered
+	ordered orderedSends
+
 	// WaitGroup to wait for all Send calls to finish
 	wg sync.WaitGroup
 
-	// to protect following: closing, status
+	// WaitGroup to wait for the read and write loops to exit
+	loopsWg sync.WaitGroup
+
+	// to protect following: addr, conn, readConn, closing, status, spec,
+	// stan, sessionDone, sessionDrain, writeLoopDone, reconnecting, lastError, signingOn,
+	// signedOnSession, rotatingFrom, resumeCh, attached, failed,
+	// reconnectAttempts,
+	// Opts.InboundMessageHandler
 	mutex sync.Mutex
 
 	// user has called Close
@@ -92,6 +243,68 @@ type Connection struct {
 
 	// connection status
 	status Status
+
+	// last STAN (field 11) used for messages built by the connection
+	stan int
+
+	// circuit breaker of the Send
+	circuit circuitBreaker
+
+	// done channel of the current network connection. It's closed when
+	// network connection is dropped to stop its loops.
+	sessionDone chan struct{}
+
+	// closed to stop the write loop of the current network connection
+	// when it's rotated (see RotateConnection), while its read loops keep
+	// receiving responses
+	sessionDrain chan struct{}
+
+	// closed when the write loop of the current network connection exits
+	writeLoopDone chan struct{}
+
+	// network connection was lost and is being re-established
+	reconnecting bool
+
+	// error that terminated the last network connection
+	lastError error
+
+	// AutoSignOn is in progress, so pings are not sent yet
+	signingOn bool
+
+	// done channel of the network connection sign-on was approved on
+	// (see RequireSignOn). Connection is signed on only while it's the
+	// current (or rotated, see rotatingFrom) network connection.
+	signedOnSession chan struct{}
+
+	// done channel of the network connection that is being rotated (see
+	// RotateConnection). Its sign-on state holds until the new network
+	// connection is promoted.
+	rotatingFrom chan struct{}
+
+	// sending is paused until the channel is closed by Resume
+	resumeCh chan struct{}
+
+	// network connection was attached with Attach, so it can't be
+	// re-established
+	attached bool
+
+	// connection was closed because network connection was not
+	// re-established within MaxReconnectAttempts
+	failed bool
+
+	// number of consecutive failed attempts to re-establish network
+	// connection (see MaxReconnectAttempts)
+	reconnectAttempts int
+
+	// sequence number of the RRNs generated by the default generator
+	rrnSequence atomic.Uint64
+
+	// channels receiving copies of the received messages
+	taps taps
+
+	// slots of the UnmatchedWorkers. It's nil when number of workers is
+	// not limited.
+	unmatchedWorkers chan struct{}
 }
 
 // New creates and configures Connection. To establish network connection, call `Connect()`.
@@ -103,17 +316,30 @@ func New(addr string, spec *iso8583.MessageSpec, mlReader MessageLengthReader, m
 		}
 	}
 
-	return &Connection{
+	c := &Connection{
 		addr:               addr,
 		Opts:               opts,
-		requestsCh:         make(chan request),
+		requestsCh:         make(chan request, opts.QueueSize),
 		readResponseCh:     make(chan []byte),
 		done:               make(chan struct{}),
-		respMap:            make(map[string]response),
+		closed:             make(chan struct{}),
+		respMap:            make(map[string]response, opts.InitialPendingCapacity),
 		spec:               spec,
 		readMessageLength:  mlReader,
 		writeMessageLength: mlWriter,
-	}, nil
+	}
+
+	if opts.UnmatchedWorkers > 0 {
+		c.unmatchedWorkers = make(chan struct{}, opts.UnmatchedWorkers)
+	}
+
+	// STANPrefix reduces the range of STAN numbers, so STANRange may not
+	// fit into it
+	if min, max := c.stanRange(); min > max {
+		return nil, fmt.Errorf("STAN range %d-%d doesn't fit STAN prefix %q: max STAN is %d", opts.MinSTAN, opts.MaxSTAN, opts.STANPrefix, max)
+	}
+
+	return c, nil
 }
 
 // NewFrom accepts conn (net.Conn, or any io.ReadWriteCloser) which will be
@@ -140,31 +366,134 @@ func (c *Connection) SetOptions(options ...Option) error {
 	return nil
 }
 
+// SetSpec replaces the spec that is used to unpack received messages. It's
+// safe to call it while connection is in use. Messages that are being
+// received during the switch may still be unpacked with the previous spec.
+func (c *Connection) SetSpec(spec *iso8583.MessageSpec) error {
+	if spec == nil {
+		return errors.New("spec is required")
+	}
+
+	c.mutex.Lock()
+	c.spec = spec
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// messageSpec returns the spec the raw message should be unpacked with
+func (c *Connection) messageSpec(rawMessage []byte) *iso8583.MessageSpec {
+	if c.Opts.SpecSelector != nil {
+		var selected *iso8583.MessageSpec
+		c.callback(func() { selected = c.Opts.SpecSelector(rawMessage) })
+
+		if selected != nil {
+			return selected
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.spec
+}
+
 // Connect establishes the connection to the server using configured Addr
 func (c *Connection) Connect() error {
-	var conn net.Conn
-	var err error
+	return c.ConnectContext(context.Background())
+}
 
+// ConnectContext establishes the connection to the server like Connect,
+// but the dial is aborted when ctx is done. In this case error wrapping
+// ctx.Err() is returned. ConnectTimeout still limits the dial.
+func (c *Connection) ConnectContext(ctx context.Context) error {
 	if c.conn != nil {
 		c.run()
 		return nil
 	}
 
-	d := &net.Dialer{Timeout: c.Opts.ConnectTimeout}
+	conn, readConn, err := c.dialConns(ctx)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return c.withName(fmt.Errorf("connecting: %w", ctxErr))
+		}
+		return c.withName(err)
+	}
 
-	if c.Opts.TLSConfig != nil {
-		conn, err = tls.DialWithDialer(d, "tcp", c.addr, c.Opts.TLSConfig)
-	} else {
-		conn, err = d.Dial("tcp", c.addr)
+	return c.start(conn, readConn)
+}
+
+// ConnectWithRetry establishes the connection to the server like Connect,
+// but if it fails to connect (or connection is not ready, see
+// ReadinessProbe), it retries after the time returned by backoff until it
+// succeeds or ctx is done. Errors of the failed attempts
+// are passed to the ErrorHandler.
+func (c *Connection) ConnectWithRetry(ctx context.Context, backoff Backoff) error {
+	if c.conn != nil {
+		return c.Connect()
 	}
 
-	if err != nil {
-		return fmt.Errorf("connecting to server %s: %w", c.addr, err)
+	for attempt := 1; ; attempt++ {
+		conn, readConn, err := c.dialConns(ctx)
+		if err == nil {
+			// connection that is not ready yet is retried
+			if err = c.start(conn, readConn); !errors.Is(err, ErrNotReady) {
+				return err
+			}
+		}
+
+		c.handleError(fmt.Errorf("connect attempt %d: %w", attempt, err))
+
+		select {
+		case <-c.Opts.Clock.After(backoff(attempt)):
+		case <-ctx.Done():
+			return c.withName(fmt.Errorf("connecting with retry: %w (last error: %v)", ctx.Err(), err))
+		}
+	}
+}
+
+// Attach starts the connection on the already established network
+// connection (e.g. handed over from other subsystem or tunneled) instead
+// of dialing it. OnConnect, AutoSignOn and ConnectionEstablishedHandler
+// are handled like in Connect. As connection doesn't own the dialing, it's
+// not re-established (AutoReconnect) when it's lost.
+func (c *Connection) Attach(conn net.Conn) error {
+	if c.Opts.NoDelay != nil {
+		if err := setNoDelay(conn, *c.Opts.NoDelay); err != nil {
+			return c.withName(fmt.Errorf("setting no delay: %w", err))
+		}
+	}
+
+	c.mutex.Lock()
+	if c.closing {
+		c.mutex.Unlock()
+		return ErrConnectionClosed
+	}
+	if c.conn != nil {
+		c.mutex.Unlock()
+		return c.withName(errors.New("network connection is already established"))
 	}
+	c.attached = true
+	c.mutex.Unlock()
+
+	return c.start(conn, nil)
+}
 
+// start runs the loops of the established network connections and calls
+// OnConnect
+func (c *Connection) start(conn, readConn net.Conn) error {
+	c.mutex.Lock()
 	c.conn = conn
+	c.readConn = readConn
+	c.mutex.Unlock()
 
-	c.run()
+	sessionDone := c.run()
+
+	if c.Opts.ReadinessProbe {
+		if err := c.probeReadiness(sessionDone); err != nil {
+			return c.withName(err)
+		}
+	}
 
 	if c.Opts.OnConnect != nil {
 		if err := c.Opts.OnConnect(c); err != nil {
@@ -173,25 +502,178 @@ func (c *Connection) Connect() error {
 			// as it's a rare case
 			_ = c.Close()
 
-			return fmt.Errorf("on connect callback %s: %w", c.addr, err)
+			return c.withName(fmt.Errorf("on connect callback %s: %w", c.Addr(), err))
+		}
+	}
+
+	if c.Opts.AutoSignOn {
+		if err := c.autoSignOn(); err != nil {
+			// close connection if sign-on failed
+			_ = c.Close()
+
+			return c.withName(fmt.Errorf("auto sign-on %s: %w", c.Addr(), err))
 		}
 	}
 
 	if c.Opts.ConnectionEstablishedHandler != nil {
-		go c.Opts.ConnectionEstablishedHandler(c)
+		c.goCallback(func() { c.Opts.ConnectionEstablishedHandler(c) })
 	}
 
 	return nil
 }
 
-// run starts read and write loops in goroutines
-func (c *Connection) run() {
-	go c.writeLoop()
-	go c.readLoop()
-	go c.readResponseLoop()
+// dialConns establishes network connection to the server using configured
+// Addr (or address returned by the AddrResolver). In dual-socket mode it
+// also establishes read connection to the ReadAddr, otherwise returned
+// readConn is nil.
+func (c *Connection) dialConns(ctx context.Context) (conn, readConn net.Conn, err error) {
+	addr := c.Addr()
+	if c.Opts.AddrResolver != nil {
+		addr, err = c.Opts.AddrResolver(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolving server address: %w", err)
+		}
+	}
+
+	return c.dialConnsTo(ctx, addr)
+}
+
+// dialConnsTo establishes network connection to the addr (and to the
+// ReadAddr in dual-socket mode)
+func (c *Connection) dialConnsTo(ctx context.Context, addr string) (conn, readConn net.Conn, err error) {
+	conn, err = c.dial(ctx, addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to server %s: %w", addr, err)
+	}
+
+	if c.Opts.ReadAddr == "" {
+		return conn, nil, nil
+	}
+
+	readConn, err = c.dial(ctx, c.Opts.ReadAddr)
+	if err != nil {
+		// ignore the error as we return the dial error
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("connecting to server %s: %w", c.Opts.ReadAddr, err)
+	}
+
+	return conn, readConn, nil
+}
+
+// dial establishes network connection to the addr. Dial is aborted when
+// ctx is done.
+func (c *Connection) dial(ctx context.Context, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: c.Opts.ConnectTimeout}
+	if c.Opts.LocalAddr != nil {
+		d.LocalAddr = c.Opts.LocalAddr
+	}
+
+	var conn net.Conn
+	var err error
+	if c.Opts.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: d, Config: c.Opts.TLSConfig}
+		conn, err = tlsDialer.DialContext(ctx, c.Opts.Network, addr)
+	} else {
+		conn, err = d.DialContext(ctx, c.Opts.Network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Opts.Linger >= 0 {
+		if err := setLinger(conn, c.Opts.Linger); err != nil {
+			// ignore the error as we return the linger error
+			_ = conn.Close()
+			return nil, fmt.Errorf("setting linger: %w", err)
+		}
+	}
+
+	if c.Opts.NoDelay != nil {
+		if err := setNoDelay(conn, *c.Opts.NoDelay); err != nil {
+			// ignore the error as we return the no delay error
+			_ = conn.Close()
+			return nil, fmt.Errorf("setting no delay: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// setLinger sets SO_LINGER of the TCP connection (or TCP connection under
+// TLS). It does nothing for other connections.
+func setLinger(conn net.Conn, sec int) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	return tcpConn.SetLinger(sec)
+}
+
+// setNoDelay sets TCP_NODELAY of the TCP connection (or TCP connection
+// under TLS), or of other connection that supports it. It does nothing for
+// other connections.
+func setNoDelay(conn net.Conn, enable bool) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	noDelayConn, ok := conn.(interface{ SetNoDelay(bool) error })
+	if !ok {
+		return nil
+	}
+
+	return noDelayConn.SetNoDelay(enable)
+}
+
+// run starts read and write loops of the current network connection in
+// goroutines. It returns the done channel of the network connection.
+func (c *Connection) run() chan struct{} {
+	c.mutex.Lock()
+	conn := c.conn
+	readConn := c.conn
+	if c.readConn != nil {
+		readConn = c.readConn
+	}
+	sessionDone := make(chan struct{})
+	if c.closing {
+		// connection is shut down, so loops are not started
+		c.mutex.Unlock()
+		close(sessionDone)
+		return sessionDone
+	}
+	c.sessionDone = sessionDone
+	sessionDrain := make(chan struct{})
+	c.sessionDrain = sessionDrain
+	writeLoopDone := make(chan struct{})
+	c.writeLoopDone = writeLoopDone
+	maxAge := c.Opts.MaxConnectionAge > 0 && c.addr != "" && !c.attached
+	// calling loopsWg.Add within mutex guarantees that it does not pass
+	// the loopsWg.Wait() call in the shutdown
+	c.loopsWg.Add(3)
+	c.mutex.Unlock()
+
+	go func() {
+		defer close(writeLoopDone)
+		c.writeLoop(conn, sessionDone, sessionDrain)
+	}()
+	go c.readLoop(readConn, sessionDone)
+	go c.readResponseLoop(sessionDone)
+
+	if maxAge {
+		go c.maxAgeLoop(sessionDone)
+	}
+
+	return sessionDone
 }
 
 func (c *Connection) handleError(err error) {
+	c.stats.errors.Add(1)
+
 	if c.Opts.ErrorHandler == nil {
 		return
 	}
@@ -203,66 +685,198 @@ func (c *Connection) handleError(err error) {
 	}
 	c.mutex.Unlock()
 
-	go c.Opts.ErrorHandler(err)
+	err = c.withName(err)
+	c.goCallback(func() { c.Opts.ErrorHandler(err) })
+}
+
+// withName prefixes err with the connection name (if it's set), so errors
+// of multiple connections can be told apart
+func (c *Connection) withName(err error) error {
+	if c.Opts.Name == "" {
+		return err
+	}
+
+	return fmt.Errorf("%s: %w", c.Opts.Name, err)
 }
 
-// when connection fails it cleans up all the things
-func (c *Connection) handleConnectionError(err error) {
+// LastError returns the error that terminated the read or write loop of the
+// last network connection. It's cleared when connection is re-established.
+func (c *Connection) LastError() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lastError
+}
+
+// when connection fails it cleans up all the things. If AutoReconnect is
+// set, only the network connection of the sessionDone is dropped and
+// re-established in the background.
+func (c *Connection) handleConnectionError(sessionDone chan struct{}, err error) {
 	// lock to check and update `closing`
 	c.mutex.Lock()
-	if err == nil || c.closing {
+	if err == nil || c.closing || c.sessionDone != sessionDone {
+		c.mutex.Unlock()
+		return
+	}
+
+	c.lastError = err
+
+	if c.reconnectEnabled() {
+		c.dropSession()
 		c.mutex.Unlock()
+
+		if !c.Opts.ResubmitOnReconnect {
+			c.failPendingRequests(ErrConnectionReset)
+		}
+
+		go c.reconnect()
+
 		return
 	}
 
 	c.closing = true
+	// release Send calls waiting for Resume
+	c.resumeLocked()
 	c.mutex.Unlock()
 
-	// channel to wait for all goroutines to exit
-	done := make(chan bool)
+	// shutdown waits for the loops to exit, and we are called from one
+	// of them
+	go c.shutdown(false, ErrConnectionReset)
+}
 
+// isPending returns true if request or expected response with the ID is
+// waiting for the response
+func (c *Connection) isPending(reqID string) bool {
 	c.pendingRequestsMu.Lock()
-	for _, resp := range c.respMap {
-		resp.errCh <- ErrConnectionClosed
-	}
+	defer c.pendingRequestsMu.Unlock()
+
+	_, pending := c.respMap[reqID]
+
+	return pending
+}
+
+// PendingAge returns the time elapsed since the request with the ID was
+// queued by Send (or its response was registered with Expect) if it's
+// waiting for the response, e.g. to show how long in-flight transactions
+// have been waiting
+func (c *Connection) PendingAge(requestID string) (time.Duration, bool) {
+	c.pendingRequestsMu.Lock()
+	resp, pending := c.respMap[requestID]
 	c.pendingRequestsMu.Unlock()
 
-	// return error to all Send methods
-	go func() {
-		for {
+	if !pending {
+		return 0, false
+	}
+
+	return c.Opts.Clock.Now().Sub(resp.enqueuedAt), true
+}
+
+// CancelAll returns err to all Send calls waiting for responses and closes
+// channels of the expected responses (see Expect). Unlike Close, it
+// doesn't close the connection, so it can be used for new requests.
+// Responses to the cancelled requests are handled as unmatched messages.
+func (c *Connection) CancelAll(err error) {
+	c.failPendingRequests(err)
+}
+
+// failPendingRequests returns err to all Send calls waiting for responses
+// and closes channels of the expected responses
+func (c *Connection) failPendingRequests(err error) {
+	c.pendingRequestsMu.Lock()
+	for reqID, resp := range c.respMap {
+		if resp.expected {
+			close(resp.replyCh)
+		} else {
 			select {
-			case req := <-c.requestsCh:
-				req.errCh <- ErrConnectionClosed
-			case <-done:
-				return
+			case resp.errCh <- err:
+			default:
 			}
+		}
+		delete(c.respMap, reqID)
+	}
+	c.pendingRequestsMu.Unlock()
+}
+
+// failRequest returns err to the caller of the request unless other error
+// was already returned
+func failRequest(req request, err error) {
+	select {
+	case req.errCh <- err:
+	default:
+	}
+}
+
+// shutdown closes the connection. It's called once, after closing is set,
+// so new Send calls are rejected. Then it:
+//  1. waits for Send calls in progress to complete (if graceful)
+//  2. closes network connections
+//  3. waits for read and write loops to exit
+//  4. fails pending and queued requests with the cause
+//  5. calls ConnectionClosedHandlers (if not graceful)
+//  6. releases WaitClosed
+func (c *Connection) shutdown(graceful bool, cause error) error {
+	if graceful {
+		// wait for all requests to complete before closing the connection
+		c.wg.Wait()
+	}
+
+	close(c.done)
 
+	err := c.closeConns()
+
+	c.loopsWg.Wait()
+
+	c.failPendingRequests(cause)
+	c.failQueuedRequests(cause)
+	c.closeTaps()
+
+	if !graceful {
+		for _, handler := range c.Opts.ConnectionClosedHandlers {
+			handler := handler
+			c.goCallback(func() { handler(c) })
 		}
-	}()
+	}
+
+	close(c.closed)
+
+	return err
+}
 
+// failQueuedRequests returns err to the requests queued for writing until
+// all Send calls return. It should be called when loops have exited.
+func (c *Connection) failQueuedRequests(err error) {
+	sendsDone := make(chan struct{})
 	go func() {
 		c.wg.Wait()
-		done <- true
+		close(sendsDone)
 	}()
 
-	// close everything else we close normally
-	c.close()
-
-	if c.Opts.ConnectionClosedHandlers != nil && len(c.Opts.ConnectionClosedHandlers) > 0 {
-		for _, handler := range c.Opts.ConnectionClosedHandlers {
-			go handler(c)
+	for {
+		select {
+		case req := <-c.requestsCh:
+			failRequest(req, err)
+		case <-sendsDone:
+			return
 		}
 	}
 }
 
-func (c *Connection) close() error {
-	// wait for all requests to complete before closing the connection
-	c.wg.Wait()
+// closeConns closes network connections
+func (c *Connection) closeConns() error {
+	c.mutex.Lock()
+	conn := c.conn
+	readConn := c.readConn
+	c.mutex.Unlock()
 
-	close(c.done)
+	if readConn != nil {
+		err := readConn.Close()
+		if err != nil {
+			return fmt.Errorf("closing read connection: %w", err)
+		}
+	}
 
-	if c.conn != nil {
-		err := c.conn.Close()
+	if conn != nil {
+		err := conn.Close()
 		if err != nil {
 			return fmt.Errorf("closing connection: %w", err)
 		}
@@ -271,9 +885,14 @@ func (c *Connection) close() error {
 	return nil
 }
 
-// Close waits for pending requests to complete and then closes network
-// connection with ISO 8583 server
+// Close calls OnClose, waits for pending requests to complete and then
+// closes network connection with ISO 8583 server. It returns when loops
+// have exited and requests still waiting for responses (e.g. expected
+// ones) were failed.
 func (c *Connection) Close() error {
+	// OnClose is called first, while connection still accepts Send calls
+	// and pending requests still wait for responses, so it can send
+	// messages (e.g. SignOff) and cancel closing by returning error
 	if c.Opts.OnClose != nil {
 		if err := c.Opts.OnClose(c); err != nil {
 			return fmt.Errorf("on close callback: %w", err)
@@ -287,15 +906,29 @@ func (c *Connection) Close() error {
 		return nil
 	}
 	c.closing = true
+	// release Send calls waiting for Resume
+	c.resumeLocked()
 	c.mutex.Unlock()
 
-	return c.close()
+	return c.shutdown(true, ErrConnectionClosed)
 }
 
 func (c *Connection) Done() <-chan struct{} {
 	return c.done
 }
 
+// WaitClosed waits until connection is shut down: network connection is
+// closed, its loops have exited and pending requests were failed. It
+// returns ctx error if ctx is done first.
+func (c *Connection) WaitClosed(ctx context.Context) error {
+	select {
+	case <-c.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // request represents request to the ISO 8583 server
 type request struct {
 	// includes length header and message itself
@@ -309,6 +942,27 @@ type request struct {
 
 	// channel to receive error that may happen down the road
 	errCh chan error
+
+	// flush request is not written into the connection. It's used to
+	// wait until all requests queued before it are written.
+	flush bool
+
+	// time when request was queued for writing
+	enqueuedAt time.Time
+
+	// message of the request. It's used to resubmit the request after
+	// reconnect and to check if it bypasses rate limiter.
+	message *iso8583.Message
+
+	// request is resubmitted after reconnect
+	resubmit bool
+
+	// trace ID passed to SendTraced
+	traceID string
+
+	// writes the length header of the message sent with SendWithHeader.
+	// It's nil when connection's MessageLengthWriter is used.
+	lengthWriter MessageLengthWriter
 }
 
 type response struct {
@@ -317,14 +971,101 @@ type response struct {
 
 	// channel to receive error that may happen down the road
 	errCh chan error
-}
 
-// Send sends message and waits for the response
-func (c *Connection) Send(message *iso8583.Message) (*iso8583.Message, error) {
+	// time when request was queued for writing (or response was
+	// registered with Expect)
+	enqueuedAt time.Time
+
+	// time when request was written into the connection
+	writtenAt time.Time
+
+	// message of the request
+	message *iso8583.Message
+
+	// response is registered with Expect, not by Send
+	expected bool
+
+	// trace ID of the request
+	traceID string
+
+	// length header writer of the request (to resubmit it)
+	lengthWriter MessageLengthWriter
+
+	// done channel of the network connection request was written into
+	sessionDone chan struct{}
+}
+
+// RequestTiming describes where the time of the request was spent
+type RequestTiming struct {
+	// RequestID is the ID of the request (STAN)
+	RequestID string
+
+	// QueueWait is the time between the request was queued by Send and
+	// written into the connection
+	QueueWait time.Duration
+
+	// RoundTrip is the time between the request was written into the
+	// connection and its response was received
+	RoundTrip time.Duration
+
+	// TraceID is the trace ID passed to SendTraced
+	TraceID string
+}
+
+// Send sends message and waits for the response. When
+// ApprovedResponseCodes or DeclinedResponseCodes option is set, Send
+// returns both the response and *DeclineError if the response was not
+// approved. When CircuitBreaker option is set, Send returns ErrCircuitOpen
+// without sending the message while the circuit is open.
+func (c *Connection) Send(message *iso8583.Message) (*iso8583.Message, error) {
+	return c.sendMessage(message, false, "", nil)
+}
+
+// TrySend is like Send, but it returns ErrQueueFull right away when the
+// write queue (see QueueSize option) can't accept the message instead of
+// waiting for it.
+func (c *Connection) TrySend(message *iso8583.Message) (*iso8583.Message, error) {
+	return c.sendMessage(message, true, "", nil)
+}
+
+func (c *Connection) sendMessage(message *iso8583.Message, failFast bool, traceID string, lengthWriter MessageLengthWriter) (*iso8583.Message, error) {
+	if mc := c.Opts.ManagementConnection; mc != nil && isNetworkManagement(message) {
+		return mc.sendMessage(message, failFast, traceID, lengthWriter)
+	}
+
+	if c.Opts.CircuitBreakerThreshold <= 0 {
+		resp, err := c.send(message, failFast, traceID, lengthWriter)
+		return resp, unwrapLocal(err)
+	}
+
+	allowed, trial := c.circuit.allow(c.Opts.CircuitBreakerCooldown, c.Opts.Clock.Now())
+	if !allowed {
+		return nil, ErrCircuitOpen
+	}
+
+	resp, err := c.send(message, failFast, traceID, lengthWriter)
+	c.circuit.done(trial, err, c.Opts.CircuitBreakerThreshold, c.Opts.Clock.Now())
+
+	return resp, unwrapLocal(err)
+}
+
+func (c *Connection) send(message *iso8583.Message, failFast bool, traceID string, lengthWriter MessageLengthWriter) (*iso8583.Message, error) {
 	c.mutex.Lock()
+	if c.failed {
+		c.mutex.Unlock()
+		return nil, localErr(ErrConnectionFailed)
+	}
 	if c.closing {
 		c.mutex.Unlock()
-		return nil, ErrConnectionClosed
+		return nil, localErr(ErrConnectionClosed)
+	}
+	if c.reconnecting && c.Opts.FailFastDuringReconnect {
+		c.mutex.Unlock()
+		return nil, localErr(ErrReconnecting)
+	}
+	if c.Opts.RequireSignOn && !c.signedOnLocked() && !isNetworkManagement(message) {
+		c.mutex.Unlock()
+		return nil, localErr(ErrNotSignedOn)
 	}
 	// calling wg.Add(1) within mutex guarantees that it does not pass the wg.Wait() call in the Close method
 	// otherwise we will have data race issue
@@ -332,53 +1073,133 @@ func (c *Connection) Send(message *iso8583.Message) (*iso8583.Message, error) {
 	c.mutex.Unlock()
 	defer c.wg.Done()
 
-	var buf bytes.Buffer
+	sendTimeout := time.After(c.Opts.SendTimeout)
+
+	if c.Opts.ValidateMTI {
+		if err := checkMTI(message); err != nil {
+			return nil, localErr(err)
+		}
+	}
+
+	if err := c.waitResumed(message, failFast, sendTimeout); err != nil {
+		return nil, localErr(err)
+	}
+
+	if c.Opts.AutoDateTimeFields {
+		if err := c.setDateTimeFields(message); err != nil {
+			return nil, localErr(fmt.Errorf("setting date and time fields: %w", err))
+		}
+	}
+
+	if c.Opts.AutoSTAN {
+		if err := c.setMessageSTAN(message); err != nil {
+			return nil, localErr(fmt.Errorf("setting STAN: %w", err))
+		}
+	}
+
+	if c.Opts.AutoRRN {
+		if err := c.setRRN(message); err != nil {
+			return nil, localErr(err)
+		}
+	}
+
+	if c.Opts.AutoCorrelationID && c.Opts.CorrelationField != 0 {
+		if err := c.setCorrelationID(message); err != nil {
+			return nil, localErr(err)
+		}
+	}
+
 	packed, err := message.Pack()
 	if err != nil {
-		return nil, fmt.Errorf("packing message: %w", err)
+		return nil, localErr(fmt.Errorf("packing message: %w", err))
 	}
 
-	// create header
-	_, err = c.writeMessageLength(&buf, len(packed))
+	rawMessage, err := c.frameMessageWith(packed, lengthWriter)
 	if err != nil {
-		return nil, fmt.Errorf("writing message header to buffer: %w", err)
+		return nil, localErr(err)
 	}
 
-	_, err = buf.Write(packed)
-	if err != nil {
-		return nil, fmt.Errorf("writing packed message to buffer: %w", err)
+	c.handleMessagePacked(message, packed)
+
+	if c.Opts.MaxInflightBytes > 0 {
+		if err := c.inflight.acquire(len(packed), c.Opts.MaxInflightBytes, failFast, sendTimeout); err != nil {
+			return nil, localErr(err)
+		}
+		defer c.inflight.release(len(packed))
+	}
+
+	if c.Opts.MaxPendingRequests > 0 {
+		if err := c.pending.acquire(c.Opts.MaxPendingRequests); err != nil {
+			return nil, localErr(err)
+		}
+		defer c.pending.release()
 	}
 
 	// prepare request
-	reqID, err := requestID(message)
+	reqID, err := c.requestID(message)
 	if err != nil {
-		return nil, fmt.Errorf("creating request ID: %w", err)
+		return nil, localErr(fmt.Errorf("creating request ID: %w", err))
+	}
+
+	if c.Opts.StrictCorrelation && c.isPending(reqID) {
+		return nil, localErr(fmt.Errorf("request ID %s: %w", reqID, ErrRequestIDPending))
 	}
 
 	req := request{
-		rawMessage: buf.Bytes(),
+		rawMessage: rawMessage,
 		requestID:  reqID,
-		replyCh:    make(chan *iso8583.Message),
-		errCh:      make(chan error),
+		// buffered, so response and errors can be delivered
+		// without blocking
+		replyCh:    make(chan *iso8583.Message, 1),
+		errCh:      make(chan error, 1),
+		enqueuedAt: c.Opts.Clock.Now(),
+		message:    message,
+		traceID:    traceID,
+
+		lengthWriter: lengthWriter,
 	}
 
 	var resp *iso8583.Message
 
-	c.requestsCh <- req
+	// write loop runs only when connection is established, so we wait
+	// for it to pick up the request no longer than SendTimeout (or
+	// WriteQueueTimeout)
+	if failFast {
+		select {
+		case c.requestsCh <- req:
+		default:
+			return nil, localErr(ErrQueueFull)
+		}
+	} else {
+		select {
+		case c.requestsCh <- req:
+		case <-c.writeQueueTimeout():
+			return nil, ErrWriteQueueTimeout
+		case <-sendTimeout:
+			return nil, ErrConnectionUnavailable
+		}
+	}
+
+	c.handleRequestEvent(RequestEnqueued, reqID, traceID)
+
+	var timedOutAt time.Time
 
 	select {
 	case resp = <-req.replyCh:
 	case err = <-req.errCh:
-	case <-time.After(c.Opts.SendTimeout):
+	case <-sendTimeout:
 		err = ErrSendTimeout
+		timedOutAt = c.Opts.Clock.Now()
+		c.stats.timeouts.Add(1)
+		c.handleRequestEvent(RequestTimedOut, reqID, traceID)
 		// reply can still be sent after SendTimeout received.
 		// if we have UnmatchedMessageHandler set, then we want reply
 		// to not be lost but handled by it.
-		if c.Opts.InboundMessageHandler != nil {
+		if handler := c.inboundMessageHandler(); handler != nil {
 			go func() {
 				select {
 				case resp := <-req.replyCh:
-					go c.Opts.InboundMessageHandler(c, resp)
+					c.goCallback(func() { handler(c, resp) })
 				case <-time.After(1 * time.Second):
 					// if no reply received within 1 second
 					// we return from the goroutine
@@ -388,10 +1209,27 @@ func (c *Connection) Send(message *iso8583.Message) (*iso8583.Message, error) {
 		}
 	}
 
+	// remove request if it's still pending (e.g. when it timed out). Entry
+	// may belong to the other request with the same ID (e.g. registered
+	// with Expect).
 	c.pendingRequestsMu.Lock()
-	delete(c.respMap, req.requestID)
+	if resp, found := c.respMap[req.requestID]; found && resp.replyCh == req.replyCh {
+		delete(c.respMap, req.requestID)
+
+		if !timedOutAt.IsZero() && c.Opts.OnLateResponse != nil {
+			c.timedOut.add(req.requestID, timedOutAt, lateResponseWindow)
+		}
+
+		if !timedOutAt.IsZero() && c.Opts.InDoubtWindow > 0 {
+			c.inDoubt.add(req.requestID, message, timedOutAt, c.Opts.InDoubtWindow)
+		}
+	}
 	c.pendingRequestsMu.Unlock()
 
+	if err == nil && c.declineCheckEnabled() {
+		err = c.checkResponseCode(resp)
+	}
+
 	return resp, err
 }
 
@@ -411,37 +1249,221 @@ func (c *Connection) Reply(message *iso8583.Message) error {
 	defer c.wg.Done()
 
 	// prepare message for sending
-	var buf bytes.Buffer
 	packed, err := message.Pack()
 	if err != nil {
 		return fmt.Errorf("packing message: %w", err)
 	}
 
+	rawMessage, err := c.frameMessage(packed)
+	if err != nil {
+		return err
+	}
+
+	c.handleMessagePacked(message, packed)
+
+	req := request{
+		rawMessage: rawMessage,
+		errCh:      make(chan error, 1),
+		message:    message,
+		enqueuedAt: c.Opts.Clock.Now(),
+	}
+
+	sendTimeout := time.After(c.Opts.SendTimeout)
+
+	select {
+	case c.requestsCh <- req:
+	case <-c.writeQueueTimeout():
+		return ErrWriteQueueTimeout
+	case <-sendTimeout:
+		return ErrConnectionUnavailable
+	}
+
+	select {
+	case err = <-req.errCh:
+	case <-sendTimeout:
+		err = ErrSendTimeout
+	}
+
+	return err
+}
+
+// PackedMessage describes the message packed for sending
+type PackedMessage struct {
+	// MTI of the message
+	MTI string
+
+	// Length is the length of the packed message without the length
+	// header
+	Length int
+
+	// FieldCount is the number of set data fields (MTI and bitmap are not
+	// counted)
+	FieldCount int
+}
+
+// handleMessagePacked calls OnMessagePacked with the size of the packed
+// message
+func (c *Connection) handleMessagePacked(message *iso8583.Message, packed []byte) {
+	if c.Opts.OnMessagePacked == nil {
+		return
+	}
+
+	mti, _ := message.GetMTI()
+
+	var fieldCount int
+	for id := range message.GetFields() {
+		// skip MTI and bitmap
+		if id > 1 {
+			fieldCount++
+		}
+	}
+
+	packedMessage := PackedMessage{
+		MTI:        mti,
+		Length:     len(packed),
+		FieldCount: fieldCount,
+	}
+
+	c.goCallback(func() { c.Opts.OnMessagePacked(c, packedMessage) })
+}
+
+// writeQueueTimeout returns channel that receives time when request has
+// been waiting in the write queue for WriteQueueTimeout. If
+// WriteQueueTimeout is not set, nil channel is returned.
+func (c *Connection) writeQueueTimeout() <-chan time.Time {
+	if c.Opts.WriteQueueTimeout <= 0 {
+		return nil
+	}
+
+	return time.After(c.Opts.WriteQueueTimeout)
+}
+
+// writeQueueTimedOut returns true if request has been waiting in the write
+// queue longer than WriteQueueTimeout
+func (c *Connection) writeQueueTimedOut(req request) bool {
+	if c.Opts.WriteQueueTimeout <= 0 {
+		return false
+	}
+
+	return c.Opts.Clock.Now().Sub(req.enqueuedAt) > c.Opts.WriteQueueTimeout
+}
+
+// frameMessage returns packed message prefixed with the message length
+// header. It returns ErrMessageTooLarge if packed message exceeds
+// MaxSendSize.
+func (c *Connection) frameMessage(packed []byte) ([]byte, error) {
+	return c.frameMessageWith(packed, nil)
+}
+
+// frameMessageWith frames the packed message like frameMessage, but writes
+// length header with the lengthWriter unless it's nil
+func (c *Connection) frameMessageWith(packed []byte, lengthWriter MessageLengthWriter) ([]byte, error) {
+	if lengthWriter == nil {
+		lengthWriter = c.writeMessageLength
+	}
+
+	if c.Opts.MaxSendSize > 0 && len(packed) > c.Opts.MaxSendSize {
+		return nil, fmt.Errorf("%w: packed message size %d exceeds max send size %d", ErrMessageTooLarge, len(packed), c.Opts.MaxSendSize)
+	}
+
+	var buf bytes.Buffer
+
+	length := len(packed)
+	if c.Opts.LengthIncludesHeader {
+		// write header to find out its size
+		headerSize, err := lengthWriter(io.Discard, length)
+		if err != nil {
+			return nil, fmt.Errorf("writing message header to buffer: %w", err)
+		}
+		length += headerSize
+	}
+
 	// create header
-	_, err = c.writeMessageLength(&buf, len(packed))
+	_, err := lengthWriter(&buf, length)
 	if err != nil {
-		return fmt.Errorf("writing message header to buffer: %w", err)
+		return nil, fmt.Errorf("writing message header to buffer: %w", err)
 	}
 
 	_, err = buf.Write(packed)
 	if err != nil {
-		return fmt.Errorf("writing packed message to buffer: %w", err)
+		return nil, fmt.Errorf("writing packed message to buffer: %w", err)
+	}
+
+	if c.Opts.FrameChecksum != nil {
+		_, err = buf.Write(c.Opts.FrameChecksum(packed))
+		if err != nil {
+			return nil, fmt.Errorf("writing frame checksum to buffer: %w", err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Flush blocks until all requests queued before the call are written into
+// the connection or ctx is done. Unlike Close, it doesn't wait for the
+// responses.
+func (c *Connection) Flush(ctx context.Context) error {
+	c.mutex.Lock()
+	if c.closing {
+		c.mutex.Unlock()
+		return ErrConnectionClosed
 	}
+	c.wg.Add(1)
+	c.mutex.Unlock()
+	defer c.wg.Done()
 
 	req := request{
-		rawMessage: buf.Bytes(),
-		errCh:      make(chan error),
+		errCh: make(chan error, 1),
+		flush: true,
 	}
 
-	c.requestsCh <- req
+	select {
+	case c.requestsCh <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	select {
-	case err = <-req.errCh:
-	case <-time.After(c.Opts.SendTimeout):
-		err = ErrSendTimeout
+	case err := <-req.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	return err
+// Expect registers interest in the response with the requestID before the
+// request is sent (e.g. for advices sent by other means). Returned channel
+// receives the response once, and it's closed if connection is closed.
+// Call cancel when the response is no longer expected. While response is
+// expected, Send of the request with the same ID returns
+// ErrRequestIDPending.
+func (c *Connection) Expect(requestID string) (<-chan *iso8583.Message, func(), error) {
+	replyCh := make(chan *iso8583.Message, 1)
+
+	c.pendingRequestsMu.Lock()
+	defer c.pendingRequestsMu.Unlock()
+
+	if _, pending := c.respMap[requestID]; pending {
+		return nil, nil, ErrRequestIDPending
+	}
+
+	c.respMap[requestID] = response{
+		replyCh:    replyCh,
+		expected:   true,
+		enqueuedAt: c.Opts.Clock.Now(),
+	}
+
+	cancel := func() {
+		c.pendingRequestsMu.Lock()
+		defer c.pendingRequestsMu.Unlock()
+
+		// response may be already delivered and the ID reused
+		if resp, found := c.respMap[requestID]; found && resp.replyCh == replyCh {
+			delete(c.respMap, requestID)
+		}
+	}
+
+	return replyCh, cancel, nil
 }
 
 // requestID is a unique identifier for a request.  responses from the server
@@ -452,9 +1474,9 @@ func requestID(message *iso8583.Message) (string, error) {
 		return "", fmt.Errorf("message required")
 	}
 
-	stan, err := message.GetString(11)
+	stan, err := stanString(message)
 	if err != nil {
-		return "", fmt.Errorf("getting STAN (field 11) of the message: %w", err)
+		return "", fmt.Errorf("%w: %v", ErrSTANFieldUnavailable, err)
 	}
 
 	if stan == "" {
@@ -464,6 +1486,66 @@ func requestID(message *iso8583.Message) (string, error) {
 	return stan, nil
 }
 
+// nextSTAN returns next STAN from the STANProvider if it's set. Otherwise,
+// it returns next STAN in the range MinSTAN-MaxSTAN (000001-999999 by
+// default, limited by the STANPrefix) prefixed with the STANPrefix that is
+// not used by pending requests, or ErrSTANExhausted when
+// all STANs of the range are pending. With STANDateCorrelation only the
+// pending requests of the message date are taken into account.
+func (c *Connection) nextSTAN(message *iso8583.Message) (string, error) {
+	if c.Opts.STANProvider != nil {
+		return c.Opts.STANProvider.Next()
+	}
+
+	var date string
+	if c.Opts.STANDateCorrelation {
+		// STAN is set before the date when field 7 is not set yet
+		date, _ = transmissionDate(message)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pendingRequestsMu.Lock()
+	defer c.pendingRequestsMu.Unlock()
+
+	min, max := c.stanRange()
+	for i := min; i <= max; i++ {
+		c.stan++
+		if c.stan < min || c.stan > max {
+			c.stan = min
+		}
+
+		stan := c.formatSTAN(c.stan)
+		if _, pending := c.respMap[stan+date]; !pending {
+			return stan, nil
+		}
+	}
+
+	return "", ErrSTANExhausted
+}
+
+// setMessageSTAN sets STAN (field 11) of the message if it's not set yet
+func (c *Connection) setMessageSTAN(message *iso8583.Message) error {
+	if _, set := message.GetFields()[11]; set {
+		return nil
+	}
+
+	stan, err := c.nextSTAN(message)
+	if err != nil {
+		if errors.Is(err, ErrSTANExhausted) && c.Opts.OnSTANExhausted != nil {
+			c.goCallback(func() { c.Opts.OnSTANExhausted(c) })
+		}
+		return err
+	}
+
+	if err := setSTANField(message, stan); err != nil {
+		return fmt.Errorf("%w: %v", ErrSTANFieldUnavailable, err)
+	}
+
+	return nil
+}
+
 const (
 	// position of the MTI specifies the message function which
 	// defines how the message should flow within the system.
@@ -500,30 +1582,116 @@ func isResponse(message *iso8583.Message) bool {
 	return false
 }
 
+// pingAllowed returns true if PingDelay has passed and AutoSignOn is not in
+// progress
+func (c *Connection) pingAllowed(pingAfter time.Time) bool {
+	if c.Opts.Clock.Now().Before(pingAfter) {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return !c.signingOn
+}
+
 // writeLoop reads requests from the channel and writes request message into
 // the socket connection. It also sends message when idle time passes
-func (c *Connection) writeLoop() {
+func (c *Connection) writeLoop(conn io.Writer, sessionDone, sessionDrain chan struct{}) {
+	defer c.loopsWg.Done()
+
 	var err error
 
+	if c.Opts.OnWriteLoopExit != nil {
+		defer func() {
+			loopErr := err
+			c.goCallback(func() { c.Opts.OnWriteLoopExit(c, loopErr) })
+		}()
+	}
+
+	// no pings are sent during PingDelay after the network connection was
+	// established
+	pingAfter := c.Opts.Clock.Now().Add(c.Opts.PingDelay)
+
+	var limiter *rateLimiter
+	if c.Opts.RateLimit > 0 {
+		limiter = newRateLimiter(c.Opts.RateLimit, c.Opts.RateLimitBurst)
+	}
+
 	for err == nil {
 		select {
 		case req := <-c.requestsCh:
+			// all requests queued before flush request were written
+			if req.flush {
+				req.errCh <- nil
+				continue
+			}
+
+			if limiter != nil && c.rateLimited(req.message) {
+				if wait := limiter.reserve(c.Opts.Clock.Now()); wait > 0 {
+					select {
+					case <-c.Opts.Clock.After(wait):
+					case <-sessionDone:
+						failRequest(req, ErrConnectionReset)
+						return
+					case <-c.done:
+						failRequest(req, ErrConnectionClosed)
+						return
+					}
+				}
+			}
+
+			if c.writeQueueTimedOut(req) {
+				failRequest(req, ErrWriteQueueTimeout)
+				continue
+			}
+
 			// if it's a request message, not a response
 			if req.replyCh != nil {
 				c.pendingRequestsMu.Lock()
+				existing, pending := c.respMap[req.requestID]
+				if req.resubmit && !pending {
+					// Send of the resubmitted request has
+					// already returned (e.g. timed out)
+					c.pendingRequestsMu.Unlock()
+					continue
+				}
+				if pending && (existing.expected || (c.Opts.StrictCorrelation && !req.resubmit)) {
+					// response with the same ID is expected
+					// by the Expect caller or by other request
+					c.pendingRequestsMu.Unlock()
+					failRequest(req, ErrRequestIDPending)
+					continue
+				}
 				c.respMap[req.requestID] = response{
-					replyCh: req.replyCh,
-					errCh:   req.errCh,
+					replyCh:    req.replyCh,
+					errCh:      req.errCh,
+					enqueuedAt: req.enqueuedAt,
+					writtenAt:  c.Opts.Clock.Now(),
+					message:    req.message,
+					traceID:    req.traceID,
+
+					lengthWriter: req.lengthWriter,
+					sessionDone:  sessionDone,
 				}
 				c.pendingRequestsMu.Unlock()
 			}
 
-			_, err = c.conn.Write([]byte(req.rawMessage))
+			err = writeFull(conn, req.rawMessage)
 			if err != nil {
-				c.handleError(utils.NewSafeError(err, "failed to write message into connection"))
+				if !isDone(sessionDone) {
+					c.handleError(utils.NewSafeError(err, "failed to write message into connection"))
+				}
 				break
 			}
 
+			c.stats.sent.Add(1)
+			c.logMessage("sent", req.message, req.traceID)
+
+			if req.replyCh != nil {
+				c.handleRequestEvent(RequestWritten, req.requestID, req.traceID)
+			}
+
 			// for replies (requests without replyCh) we just
 			// return nil to errCh as caller is waiting for error
 			// or send timeout. Regular requests waits for responses
@@ -531,104 +1699,455 @@ func (c *Connection) writeLoop() {
 			if req.replyCh == nil {
 				req.errCh <- nil
 			}
-		case <-time.After(c.Opts.IdleTime):
+		case <-c.Opts.Clock.After(c.Opts.IdleTime):
 			// if no message was sent during idle time, we have to send ping message
-			if c.Opts.PingHandler != nil {
-				go c.Opts.PingHandler(c)
+			if c.Opts.PingHandler != nil && c.pingAllowed(pingAfter) {
+				c.goCallback(func() { c.Opts.PingHandler(c) })
 			}
+		case <-sessionDrain:
+			// network connection is rotated, so new requests are
+			// written into the new one
+			return
+		case <-sessionDone:
+			return
 		case <-c.done:
 			return
 		}
 
 	}
 
-	c.handleConnectionError(err)
+	c.handleConnectionError(sessionDone, err)
 }
 
 // readLoop reads data from the socket (message length header and raw message)
-// and runs a goroutine to handle the message
-func (c *Connection) readLoop() {
+// and runs a goroutine to handle the message. Reads are buffered for the
+// lifetime of the network connection, so frames that arrive together (e.g.
+// in a single TCP segment) are all read, one after another.
+func (c *Connection) readLoop(conn io.Reader, sessionDone chan struct{}) {
+	defer c.loopsWg.Done()
+
 	var err error
 	var messageLength int
 
-	r := bufio.NewReader(c.conn)
+	if c.Opts.OnReadLoopExit != nil {
+		defer func() {
+			loopErr := err
+			c.goCallback(func() { c.Opts.OnReadLoopExit(c, loopErr) })
+		}()
+	}
+
+	r := bufio.NewReader(conn)
+	if c.Opts.ReadBufferSize > 0 {
+		r = bufio.NewReaderSize(conn, c.Opts.ReadBufferSize)
+	}
+
 	for {
-		messageLength, err = c.readMessageLength(r)
+		messageLength, err = c.readLength(r, c.selectLengthReader(r))
 		if err != nil {
+			if isDone(sessionDone) {
+				// network connection was dropped for reconnect
+				return
+			}
 			c.handleError(utils.NewSafeError(err, "failed to read message length"))
 			break
 		}
 
+		// some hosts send zero-length frames as keepalives, there is
+		// nothing to unpack
+		if messageLength == 0 {
+			continue
+		}
+
 		// read the packed message
 		rawMessage := make([]byte, messageLength)
 		_, err = io.ReadFull(r, rawMessage)
 		if err != nil {
+			if isDone(sessionDone) {
+				return
+			}
 			c.handleError(utils.NewSafeError(err, "failed to read message from connection"))
 			break
 		}
 
-		c.readResponseCh <- rawMessage
+		if c.Opts.OnFrameSize != nil {
+			c.goCallback(func() { c.Opts.OnFrameSize(c, len(rawMessage)) })
+		}
+
+		if trailerSize := c.trailerSize(rawMessage); trailerSize > 0 {
+			trailer := make([]byte, trailerSize)
+			_, err = io.ReadFull(r, trailer)
+			if err != nil {
+				if isDone(sessionDone) {
+					return
+				}
+				c.handleError(utils.NewSafeError(err, "failed to read message trailer from connection"))
+				break
+			}
+
+			// invalid message is dropped, but the stream is still
+			// in sync, so we keep reading
+			if err := c.validateTrailer(rawMessage, trailer); err != nil {
+				c.handleError(err)
+				continue
+			}
+		}
+
+		// unwanted messages are dropped before they are unpacked
+		if c.mtiDenied(rawMessage) {
+			c.stats.dropped.Add(1)
+			continue
+		}
+
+		select {
+		case c.readResponseCh <- rawMessage:
+		case <-sessionDone:
+			return
+		case <-c.done:
+			return
+		}
 	}
 
-	c.handleConnectionError(err)
+	c.handleConnectionError(sessionDone, err)
 }
 
-func (c *Connection) readResponseLoop() {
+// readLength reads message length header with the readMessageLength and
+// returns the length of the message that follows the header
+func (c *Connection) readLength(r io.Reader, readMessageLength MessageLengthReader) (int, error) {
+	if !c.Opts.LengthIncludesHeader {
+		return readMessageLength(r)
+	}
+
+	cr := &countingReader{r: r}
+
+	length, err := readMessageLength(cr)
+	if err != nil {
+		return 0, err
+	}
+
+	length -= cr.n
+	if length < 0 {
+		return 0, fmt.Errorf("message length %d is less than header size %d", length+cr.n, cr.n)
+	}
+
+	return length, nil
+}
+
+// trailerSize returns the number of bytes that follow the message. When
+// TrailerSize is not set, it's the size of the frame checksum.
+func (c *Connection) trailerSize(rawMessage []byte) int {
+	if c.Opts.TrailerSize > 0 {
+		return c.Opts.TrailerSize
+	}
+
+	if c.Opts.FrameChecksum != nil {
+		return len(c.Opts.FrameChecksum(rawMessage))
+	}
+
+	return 0
+}
+
+// validateTrailer validates the trailer of the message with the
+// TrailerValidator
+func (c *Connection) validateTrailer(rawMessage, trailer []byte) error {
+	if c.Opts.TrailerValidator == nil {
+		return nil
+	}
+
+	var err error
+	if c.callback(func() { err = c.Opts.TrailerValidator(rawMessage, trailer) }) {
+		err = errors.New("trailer validator panicked")
+	}
+
+	if err != nil {
+		return &ErrInvalidTrailer{
+			Err:        err,
+			RawMessage: rawMessage,
+			Trailer:    trailer,
+		}
+	}
+
+	return nil
+}
+
+// writeFull writes all bytes of b into w. Unlike io.Writer contract
+// requires, some writers (e.g. wrapped codecs) may write only part of b
+// without error, so we keep writing the rest of it. Write that makes no
+// progress is reported as io.ErrShortWrite.
+func writeFull(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// countingReader counts bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+// readResponseLoop handles received messages. It calls ReadTimeoutHandler
+// when no messages were received during ReadTimeout and closes the
+// connection when MaxReadTimeouts consecutive read timeouts have passed.
+func (c *Connection) readResponseLoop(sessionDone chan struct{}) {
+	defer c.loopsWg.Done()
+
+	// number of consecutive read timeouts without received messages
+	var readTimeouts int
+
 	for {
 		select {
 		case mess := <-c.readResponseCh:
+			readTimeouts = 0
 			go c.handleResponse(mess)
-		case <-time.After(c.Opts.ReadTimeout):
+		case <-c.Opts.Clock.After(c.Opts.ReadTimeout):
+			readTimeouts++
+			if c.Opts.MaxReadTimeouts > 0 && readTimeouts >= c.Opts.MaxReadTimeouts {
+				c.handleError(ErrReadTimeoutsExceeded)
+				c.handleConnectionError(sessionDone, ErrReadTimeoutsExceeded)
+				return
+			}
+
 			if c.Opts.ReadTimeoutHandler != nil {
-				go c.Opts.ReadTimeoutHandler(c)
+				c.goCallback(func() { c.Opts.ReadTimeoutHandler(c) })
 			}
+		case <-sessionDone:
+			return
 		case <-c.done:
 			return
 		}
 	}
 }
 
+// failPartialResponse returns err to the Send call waiting for the
+// partially unpacked response, if the response has enough fields to be
+// matched with the request
+func (c *Connection) failPartialResponse(message *iso8583.Message, err error) {
+	if !isResponse(message) {
+		return
+	}
+
+	reqID, idErr := c.requestID(message)
+	if idErr != nil {
+		return
+	}
+
+	c.pendingRequestsMu.Lock()
+	resp, found := c.respMap[reqID]
+	if found && !resp.expected {
+		delete(c.respMap, reqID)
+	}
+	c.pendingRequestsMu.Unlock()
+
+	if found && !resp.expected {
+		select {
+		case resp.errCh <- err:
+		default:
+		}
+	}
+}
+
 // handleResponse unpacks the message and then sends it to the reply channel
 // that corresponds to the message ID (request ID)
 func (c *Connection) handleResponse(rawMessage []byte) {
+	c.stats.received.Add(1)
+
 	// create message
-	message := iso8583.NewMessage(c.spec)
+	message := iso8583.NewMessage(c.messageSpec(rawMessage))
 	err := message.Unpack(rawMessage)
+	if err == nil && c.Opts.StrictResponseBitmap {
+		err = checkBitmap(message, rawMessage)
+	}
 	if err != nil {
 		unpackErr := &ErrUnpack{
 			Err:        err,
 			RawMessage: rawMessage,
 		}
+		if c.Opts.DeliverPartialUnpack {
+			unpackErr.Message = message
+			c.failPartialResponse(message, unpackErr)
+		}
 		c.handleError(utils.NewSafeError(unpackErr, "failed to unpack message"))
 		return
 	}
 
+	c.handleTaps(message)
+
 	if isResponse(message) {
-		reqID, err := requestID(message)
+		reqID, err := c.requestID(message)
 		if err != nil {
-			c.handleError(fmt.Errorf("creating request ID:  %w", err))
+			c.logMessage("received", message, "")
+			// response can't be matched with any request, but it's
+			// not a reason to drop it
+			c.handleError(fmt.Errorf("unmatched response: creating request ID: %w", err))
+			c.handleUnmatched(message, "")
 			return
 		}
 
-		// send response message to the reply channel
+		// send response message to the reply channel. Request is
+		// removed from the pending ones together with the lookup,
+		// so its ID can be reused as soon as Send returns.
+		dropDuplicates := c.Opts.DuplicateResponsePolicy == DuplicateDrop
+		now := c.Opts.Clock.Now()
+
+		var duplicate, late bool
+		var timedOutAt time.Time
+
 		c.pendingRequestsMu.Lock()
 		response, found := c.respMap[reqID]
+		if found {
+			delete(c.respMap, reqID)
+			if dropDuplicates {
+				c.answered.add(reqID, now, c.Opts.SendTimeout)
+			}
+		} else {
+			if dropDuplicates {
+				duplicate = c.answered.answered(reqID, now, c.Opts.SendTimeout)
+			}
+			if c.Opts.OnLateResponse != nil {
+				timedOutAt, late = c.timedOut.answeredAt(reqID, now, lateResponseWindow)
+			}
+			if c.Opts.InDoubtWindow > 0 {
+				// late response resolves the request in doubt
+				at, inDoubt := c.inDoubt.remove(reqID, now, c.Opts.InDoubtWindow)
+				if inDoubt && !late && c.Opts.OnLateResponse != nil {
+					timedOutAt, late = at, true
+				}
+			}
+		}
 		c.pendingRequestsMu.Unlock()
 
+		// response is logged with the trace ID of its request
+		c.logMessage("received", message, response.traceID)
+
+		if duplicate {
+			return
+		}
+
+		if late {
+			lateBy := now.Sub(timedOutAt)
+			c.goCallback(func() { c.Opts.OnLateResponse(c, message, lateBy) })
+		}
+
+		if found {
+			c.stats.matched.Add(1)
+		}
+
+		if found && response.expected {
+			response.replyCh <- message
+			return
+		}
+
 		if found {
+			receivedAt := c.Opts.Clock.Now()
+			latency := receivedAt.Sub(response.writtenAt)
+			c.stats.lastLatency.Store(int64(latency))
+			if c.Opts.LatencyWindow > 0 {
+				c.latencies.add(latency, c.Opts.LatencyWindow)
+			}
 			response.replyCh <- message
-		} else if c.Opts.InboundMessageHandler != nil {
-			go c.Opts.InboundMessageHandler(c, message)
-		} else {
-			c.handleError(fmt.Errorf("can't find request for ID: %s", reqID))
+
+			c.handleRequestEvent(RequestResponded, reqID, response.traceID)
+
+			if c.Opts.OnRequestTiming != nil {
+				timing := RequestTiming{
+					RequestID: reqID,
+					QueueWait: response.writtenAt.Sub(response.enqueuedAt),
+					RoundTrip: receivedAt.Sub(response.writtenAt),
+					TraceID:   response.traceID,
+				}
+				c.goCallback(func() { c.Opts.OnRequestTiming(c, timing) })
+			}
+
+			return
 		}
+
+		c.handleUnmatched(message, reqID)
 	} else {
-		if c.Opts.InboundMessageHandler != nil {
-			go c.Opts.InboundMessageHandler(c, message)
+		if handler := c.inboundMessageHandler(); handler != nil {
+			c.goCallback(func() { handler(c, message) })
 		}
 	}
 }
 
+// handleUnmatched passes response that doesn't match any pending request to
+// OnUnmatched and InboundMessageHandler. Empty reqID means that request ID
+// can't be created for the response (e.g. STAN is missing).
+func (c *Connection) handleUnmatched(message *iso8583.Message, reqID string) {
+	c.stats.unmatched.Add(1)
+
+	handler := c.inboundMessageHandler()
+	if handler == nil && reqID != "" {
+		c.handleError(fmt.Errorf("can't find request for ID: %s", reqID))
+	}
+
+	if c.unmatchedWorkers == nil {
+		if c.Opts.OnUnmatched != nil {
+			c.goCallback(func() { c.Opts.OnUnmatched(c, message, reqID) })
+		}
+		if handler != nil {
+			c.goCallback(func() { handler(c, message) })
+		}
+		return
+	}
+
+	if c.Opts.OnUnmatched == nil && handler == nil {
+		return
+	}
+
+	// take the free worker or drop the response
+	select {
+	case c.unmatchedWorkers <- struct{}{}:
+	default:
+		c.stats.unmatchedDropped.Add(1)
+		return
+	}
+
+	c.goCallback(func() {
+		defer func() { <-c.unmatchedWorkers }()
+
+		if c.Opts.OnUnmatched != nil {
+			c.callback(func() { c.Opts.OnUnmatched(c, message, reqID) })
+		}
+		if handler != nil {
+			handler(c, message)
+		}
+	})
+}
+
+// SetInboundMessageHandler replaces the InboundMessageHandler. It's safe
+// to call it while connection is in use, e.g. to change how unmatched and
+// incoming messages are handled during maintenance window. Messages that
+// are being handled during the switch may still be passed to the previous
+// handler.
+func (c *Connection) SetInboundMessageHandler(handler func(c *Connection, message *iso8583.Message)) {
+	c.mutex.Lock()
+	c.Opts.InboundMessageHandler = handler
+	c.mutex.Unlock()
+}
+
+// inboundMessageHandler returns the current InboundMessageHandler
+func (c *Connection) inboundMessageHandler() func(c *Connection, message *iso8583.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.Opts.InboundMessageHandler
+}
+
 // SetStatus sets the connection status
 func (c *Connection) SetStatus(status Status) {
 	c.mutex.Lock()
@@ -644,7 +2163,15 @@ func (c *Connection) Status() Status {
 	return c.status
 }
 
+// Name returns the name of the connection set with Name option
+func (c *Connection) Name() string {
+	return c.Opts.Name
+}
+
 // Addr returns the remote address of the connection
 func (c *Connection) Addr() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	return c.addr
 }
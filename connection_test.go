@@ -1,19 +1,23 @@
 package connection_test
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/moov-io/iso8583"
 	connection "github.com/moov-io/iso8583-connection"
-	"github.com/moov-io/iso8583-connection/server"
 	"github.com/moov-io/iso8583/encoding"
 	"github.com/moov-io/iso8583/field"
 	"github.com/moov-io/iso8583/prefix"
@@ -42,6 +46,30 @@ func getSTAN() string {
 	return fmt.Sprintf("%06d", stan)
 }
 
+// unresponsiveAddr returns the address of the listener that doesn't
+// complete TCP handshakes: its accept queue (of zero backlog) is filled by
+// the connection that is never accepted
+func unresponsiveAddr(t *testing.T) string {
+	t.Helper()
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	require.NoError(t, syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	require.NoError(t, syscall.Listen(fd, 0))
+
+	sa, err := syscall.Getsockname(fd)
+	require.NoError(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return addr
+}
+
 func TestClient_Connect(t *testing.T) {
 	t.Run("unsecure connection", func(t *testing.T) {
 		server, err := NewTestServer()
@@ -57,6 +85,37 @@ func TestClient_Connect(t *testing.T) {
 		require.NoError(t, c.Close())
 	})
 
+	t.Run("Linger(0) resets connection on Close", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		c, err := connection.New(ln.Addr().String(), testSpec, readMessageLength, writeMessageLength,
+			connection.Linger(0),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+
+		serverConn := <-accepted
+		defer serverConn.Close()
+
+		require.NoError(t, c.Close())
+
+		// server gets reset instead of EOF
+		_, err = serverConn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+	})
+
 	t.Run("with TLS", func(t *testing.T) {
 		srv := http.Server{
 			ReadHeaderTimeout: 1 * time.Second,
@@ -111,6 +170,342 @@ func TestClient_Connect(t *testing.T) {
 		require.NoError(t, c.Close())
 	})
 
+	t.Run("ConnectContext returns when context is canceled during dial", func(t *testing.T) {
+		addr := unresponsiveAddr(t)
+
+		c, err := connection.New(addr, testSpec, readMessageLength, writeMessageLength, connection.ConnectTimeout(10*time.Second))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		err = c.ConnectContext(ctx)
+
+		require.ErrorIs(t, err, context.Canceled)
+		require.Less(t, time.Since(start), 2*time.Second)
+
+		require.NoError(t, c.Close())
+	})
+
+	t.Run("connects to Unix domain socket", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "iso8583.sock")
+
+		ln, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		// server side of the connection replies to all messages
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			reply := func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}
+
+			sc, err := connection.NewFrom(conn, testSpec, readMessageLength, writeMessageLength,
+				connection.InboundMessageHandler(reply),
+			)
+			if err != nil {
+				return
+			}
+			<-sc.Done()
+		}()
+
+		c, err := connection.New(socketPath, testSpec, readMessageLength, writeMessageLength,
+			connection.Network("unix"),
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+	})
+
+	t.Run("connects from LocalAddr", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		remoteAddrs := make(chan net.Addr, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			remoteAddrs <- conn.RemoteAddr()
+			conn.Close()
+		}()
+
+		// find free local port to bind to
+		free, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		localAddr := free.Addr().(*net.TCPAddr)
+		require.NoError(t, free.Close())
+
+		c, err := connection.New(ln.Addr().String(), testSpec, readMessageLength, writeMessageLength,
+			connection.LocalAddr(localAddr),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		select {
+		case addr := <-remoteAddrs:
+			require.Equal(t, localAddr.String(), addr.String())
+		case <-time.After(time.Second):
+			t.Fatal("connection was not accepted")
+		}
+	})
+
+	t.Run("Attach starts connection on the established network connection", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		defer echo.Close()
+
+		onConnect := make(chan struct{}, 1)
+		c, err := connection.New("127.0.0.1:9999", testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(10*time.Millisecond),
+			connection.SendTimeout(500*time.Millisecond),
+			connection.OnConnect(func(c *connection.Connection) error {
+				onConnect <- struct{}{}
+				return nil
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.NoError(t, c.Attach(clientConn))
+		<-onConnect
+
+		require.Error(t, c.Attach(clientConn))
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+
+		// attached connection is closed (not re-established) when
+		// network connection is lost
+		require.NoError(t, echo.Close())
+
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+	})
+
+	t.Run("NoDelay is set on the TCP connections", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		// wrapper of the TCP connection records SetNoDelay calls
+		conn := &noDelayConn{Conn: clientConn}
+
+		c, err := connection.New("", testSpec, readMessageLength, writeMessageLength,
+			connection.NoDelay(false),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.NoError(t, c.Attach(conn))
+		require.Equal(t, []bool{false}, conn.NoDelays())
+
+		// dialed TCP connections accept the option too
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err = connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.NoDelay(true),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.NoError(t, c.Connect())
+	})
+
+	t.Run("ConnectWithRetry retries until server is available", func(t *testing.T) {
+		// listen and close to get address nobody listens on
+		ln, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		require.NoError(t, ln.Close())
+
+		var attempts int32
+
+		c, err := connection.New(addr, testSpec, readMessageLength, writeMessageLength,
+			connection.ErrorHandler(func(err error) {
+				atomic.AddInt32(&attempts, 1)
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		connected := make(chan error, 1)
+		go func() {
+			connected <- c.ConnectWithRetry(context.Background(), connection.ConstantBackoff(50*time.Millisecond))
+		}()
+
+		// let client fail a couple of times
+		time.Sleep(120 * time.Millisecond)
+
+		server, err := NewTestServerWithAddr(addr)
+		require.NoError(t, err)
+		defer server.Close()
+
+		select {
+		case err := <-connected:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("connection was not established")
+		}
+
+		require.GreaterOrEqual(t, atomic.LoadInt32(&attempts), int32(2))
+	})
+
+	t.Run("ConnectWithRetry waits for backoff on the Clock", func(t *testing.T) {
+		// listen and close to get address nobody listens on
+		ln, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		require.NoError(t, ln.Close())
+
+		clock := &testClock{}
+		clock.Set(time.Now())
+
+		var attempts int32
+
+		c, err := connection.New(addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SetClock(clock),
+			connection.ErrorHandler(func(err error) {
+				atomic.AddInt32(&attempts, 1)
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		connected := make(chan error, 1)
+		go func() {
+			connected <- c.ConnectWithRetry(ctx, connection.ConstantBackoff(time.Minute))
+		}()
+
+		// the next attempt waits for the backoff timer of the clock
+		require.Eventually(t, func() bool {
+			return clock.Waiters() == 1
+		}, time.Second, time.Millisecond)
+		require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+
+		clock.Advance(time.Minute)
+
+		require.Eventually(t, func() bool {
+			return clock.Waiters() == 1 && atomic.LoadInt32(&attempts) == 2
+		}, time.Second, time.Millisecond)
+
+		cancel()
+		require.ErrorIs(t, <-connected, context.Canceled)
+	})
+
+	t.Run("AddrResolver returns address before each connect attempt", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		// listen and close to get address nobody listens on
+		ln, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		unavailableAddr := ln.Addr().String()
+		require.NoError(t, ln.Close())
+
+		var mu sync.Mutex
+		var resolves int
+		var handledErrors []error
+
+		c, err := connection.New("", testSpec, readMessageLength, writeMessageLength,
+			connection.AddrResolver(func(ctx context.Context) (string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				resolves++
+				switch resolves {
+				case 1:
+					return unavailableAddr, nil
+				case 2:
+					return "", errors.New("no healthy endpoints")
+				default:
+					return server.Addr, nil
+				}
+			}),
+			connection.ErrorHandler(func(err error) {
+				mu.Lock()
+				handledErrors = append(handledErrors, err)
+				mu.Unlock()
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		err = c.ConnectWithRetry(context.Background(), connection.ConstantBackoff(10*time.Millisecond))
+		require.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.Equal(t, 3, resolves)
+		require.Len(t, handledErrors, 2)
+		require.ErrorContains(t, handledErrors[0], "connecting to server "+unavailableAddr)
+		require.ErrorContains(t, handledErrors[1], "resolving server address: no healthy endpoints")
+	})
+
+	t.Run("ConnectWithRetry returns error when context is done", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		require.NoError(t, ln.Close())
+
+		c, err := connection.New(addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err = c.ConnectWithRetry(ctx, connection.ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
 	t.Run("no panic when Close before Connect", func(t *testing.T) {
 		// our client can connect to the server
 		c, err := connection.New("", testSpec, readMessageLength, writeMessageLength)
@@ -292,6 +687,46 @@ func TestClient_Send(t *testing.T) {
 		require.NoError(t, c.Close())
 	})
 
+	t.Run("it unpacks received messages using spec set with SetSpec", func(t *testing.T) {
+		// spec without field 63 that server adds to the response
+		oldSpec := &iso8583.MessageSpec{
+			Name:   "spec without field 63",
+			Fields: map[int]field.Field{},
+		}
+		for id, f := range testSpec.Fields {
+			if id != 63 {
+				oldSpec.Fields[id] = f
+			}
+		}
+
+		c, err := connection.New(server.Addr, oldSpec, readMessageLength, writeMessageLength, connection.SendTimeout(500*time.Millisecond))
+		require.NoError(t, err)
+
+		require.EqualError(t, c.SetSpec(nil), "spec is required")
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// switch to the spec with field 63
+		require.NoError(t, c.SetSpec(testSpec))
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseRespondWithExtraField),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		extra, err := response.GetString(63)
+		require.NoError(t, err)
+		require.Equal(t, "EXTRA", extra)
+	})
+
 	t.Run("it returns ErrConnectionClosed when Close was called", func(t *testing.T) {
 		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
 		require.NoError(t, err)
@@ -346,214 +781,288 @@ func TestClient_Send(t *testing.T) {
 		require.Equal(t, connection.ErrSendTimeout, err)
 	})
 
-	t.Run("it returns error when message does not have STAN", func(t *testing.T) {
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(100*time.Millisecond))
-		require.NoError(t, err)
-
-		err = c.Connect()
+	t.Run("it waits for connection to be established before writing the request", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(500*time.Millisecond))
 		require.NoError(t, err)
 		defer c.Close()
 
-		// regular network management message
 		message := iso8583.NewMessage(testSpec)
 		err = message.Marshal(baseFields{
-			MTI: field.NewStringValue("0800"),
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
 		})
 		require.NoError(t, err)
 
+		// connection is not established yet, so request can't be written
 		_, err = c.Send(message)
-		require.EqualError(t, err, "creating request ID: STAN is missing")
-	})
+		require.ErrorIs(t, err, connection.ErrConnectionUnavailable)
 
-	t.Run("pending requests should complete after Close was called", func(t *testing.T) {
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		// request sent during the gap is written when connection is
+		// established
+		connectErr := make(chan error, 1)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			connectErr <- c.Connect()
+		}()
+
+		response, err := c.Send(message)
 		require.NoError(t, err)
+		require.NoError(t, <-connectErr)
 
-		err = c.Connect()
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+	})
+
+	t.Run("it waits for connection to be re-established before writing the request", func(t *testing.T) {
+		// connection is re-established only when the clock is advanced
+		clock := &testClock{}
+		clock.Set(time.Now())
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(500*time.Millisecond),
+			connection.AutoReconnect(time.Second),
+			connection.SetClock(clock),
+		)
 		require.NoError(t, err)
+		require.NoError(t, c.Connect())
 		defer c.Close()
 
-		var wg sync.WaitGroup
-		for i := 0; i < 10; i++ {
-			wg.Add(1)
-			go func(i int) {
-				defer func() {
-					wg.Done()
-				}()
+		newMessage := func(testCaseCode string) *iso8583.Message {
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(testCaseCode),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+			return message
+		}
 
-				// network management message
-				message := iso8583.NewMessage(testSpec)
-				err := message.Marshal(baseFields{
-					MTI:          field.NewStringValue("0800"),
-					TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
-					STAN:         field.NewStringValue(getSTAN()),
-				})
-				require.NoError(t, err)
+		// server replies and drops the connection
+		_, err = c.Send(newMessage(TestCaseCloseConnection))
+		require.NoError(t, err)
+		require.Eventually(t, c.Reconnecting, time.Second, 10*time.Millisecond)
 
-				response, err := c.Send(message)
-				require.NoError(t, err)
+		// request is not written within SendTimeout during the gap
+		_, err = c.Send(newMessage(TestCaseReply))
+		require.ErrorIs(t, err, connection.ErrConnectionUnavailable)
 
-				mti, err := response.GetMTI()
-				require.NoError(t, err)
-				require.Equal(t, "0810", mti)
-			}(i)
+		// request queued during the gap is written when connection is
+		// re-established
+		sendErr := make(chan error, 1)
+		go func() {
+			_, err := c.Send(newMessage(TestCaseReply))
+			sendErr <- err
+		}()
+
+		require.Eventually(t, func() bool {
+			clock.Advance(time.Second)
+			return !c.Reconnecting()
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, <-sendErr)
+	})
+
+	t.Run("it returns ErrWriteQueueTimeout when request was not written within WriteQueueTimeout", func(t *testing.T) {
+		// nobody reads from the server side of the pipe, so writes
+		// are blocked
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(time.Second),
+			connection.WriteQueueTimeout(100*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		newMessage := func() *iso8583.Message {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(11, getSTAN()))
+			return message
 		}
 
-		// let's wait all messages to be sent
-		time.Sleep(200 * time.Millisecond)
+		// this request blocks the write loop
+		go c.Send(newMessage())
+		time.Sleep(50 * time.Millisecond)
 
-		// while server is waiting, we will close the connection
-		require.NoError(t, c.Close())
-		wg.Wait()
+		start := time.Now()
+		_, err = c.Send(newMessage())
+		require.ErrorIs(t, err, connection.ErrWriteQueueTimeout)
+		require.Less(t, time.Since(start), 500*time.Millisecond)
 	})
 
-	t.Run("responses received asynchronously", func(t *testing.T) {
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+	t.Run("it returns ErrMessageTooLarge when packed message exceeds MaxSendSize", func(t *testing.T) {
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.MaxSendSize(len(packed)-1),
+		)
 		require.NoError(t, err)
 
 		err = c.Connect()
 		require.NoError(t, err)
 		defer c.Close()
 
-		// send first message and tell server to respond in 500ms
-		var (
-			receivedSTANs []string
-			wg            sync.WaitGroup
-			mu            sync.Mutex
-			stan1         string
-			stan2         string
-		)
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrMessageTooLarge)
 
-		wg.Add(1)
-		go func() {
-			defer func() {
-				wg.Done()
-			}()
+		err = c.Reply(message)
+		require.ErrorIs(t, err, connection.ErrMessageTooLarge)
 
-			message := iso8583.NewMessage(testSpec)
-			err := message.Marshal(baseFields{
-				MTI:          field.NewStringValue("0800"),
-				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
-				STAN:         field.NewStringValue(getSTAN()),
-			})
-			require.NoError(t, err)
+		// message of the max size is sent
+		require.NoError(t, c.SetOptions(connection.MaxSendSize(len(packed))))
 
-			response, err := c.Send(message)
-			require.NoError(t, err)
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
 
-			// put received STAN into slice so we can check the order
-			stan1, err = response.GetString(11)
-			require.NoError(t, err)
-			mu.Lock()
-			receivedSTANs = append(receivedSTANs, stan1)
-			mu.Unlock()
-		}()
+	t.Run("it writes the whole message when connection writes only part of it", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
 
-		wg.Add(1)
-		go func() {
-			defer func() {
-				wg.Done()
-			}()
+		echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		defer echo.Close()
 
-			// this message will be sent after the first one
-			time.Sleep(100 * time.Millisecond)
+		// connection writes at most 3 bytes per Write call
+		c, err := connection.NewFrom(&chunkedWriteConn{ReadWriteCloser: clientConn, chunk: 3}, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
 
-			message := iso8583.NewMessage(testSpec)
-			err := message.Marshal(baseFields{
-				MTI:  field.NewStringValue("0800"),
-				STAN: field.NewStringValue(getSTAN()),
-			})
-			require.NoError(t, err)
+		correlationID := strings.Repeat("A", 36)
 
-			response, err := c.Send(message)
-			require.NoError(t, err)
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(62, correlationID))
 
-			// put received STAN into slice so we can check the order
-			stan2, err = response.GetString(11)
-			require.NoError(t, err)
-			mu.Lock()
-			receivedSTANs = append(receivedSTANs, stan2)
-			mu.Unlock()
-		}()
+		response, err := c.Send(message)
+		require.NoError(t, err)
 
-		// let's wait all messages to be sent
-		time.Sleep(200 * time.Millisecond)
+		responseID, err := response.GetString(62)
+		require.NoError(t, err)
+		require.Equal(t, correlationID, responseID)
+	})
 
-		wg.Wait()
-		require.NoError(t, c.Close())
+	t.Run("it closes connection when write makes no progress", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
 
-		// we expect that response for the second message was received first
-		require.Equal(t, receivedSTANs[0], stan2)
+		// connection writes nothing and returns no error
+		c, err := connection.NewFrom(&chunkedWriteConn{ReadWriteCloser: clientConn}, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
 
-		// and that response for the first message was received second
-		require.Equal(t, receivedSTANs[1], stan1)
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
 
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
 	})
 
-	t.Run("automatically sends ping messages after ping interval", func(t *testing.T) {
-		// we create server instance here to isolate pings count
-		server, err := NewTestServer()
+	t.Run("STAN can be reused right after response was received", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(500*time.Millisecond),
+		)
 		require.NoError(t, err)
-		defer server.Close()
 
-		pingHandler := func(c *connection.Connection) {
-			pingMessage := iso8583.NewMessage(testSpec)
-			err := pingMessage.Marshal(baseFields{
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// Expect fails if request with the STAN is still pending
+		stan := getSTAN()
+		for i := 0; i < 100; i++ {
+			message := iso8583.NewMessage(testSpec)
+			err = message.Marshal(baseFields{
 				MTI:          field.NewStringValue("0800"),
-				TestCaseCode: field.NewStringValue(TestCasePingCounter),
-				STAN:         field.NewStringValue(getSTAN()),
+				TestCaseCode: field.NewStringValue(TestCaseReply),
+				STAN:         field.NewStringValue(stan),
 			})
 			require.NoError(t, err)
 
-			response, err := c.Send(pingMessage)
-			// we may get error because test closed server and connection
-			// it it's a connection closed error - that's ok. just return
-			if err != nil && errors.Is(err, connection.ErrConnectionClosed) {
-				return
-			}
+			_, err = c.Send(message)
 			require.NoError(t, err)
 
-			mti, err := response.GetMTI()
+			_, cancel, err := c.Expect(stan)
 			require.NoError(t, err)
-			require.Equal(t, "0810", mti)
+			cancel()
 		}
+	})
 
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
-			connection.IdleTime(50*time.Millisecond),
-			connection.PingHandler(pingHandler),
-		)
+	t.Run("it returns error when message does not have STAN", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(100*time.Millisecond))
 		require.NoError(t, err)
 
 		err = c.Connect()
 		require.NoError(t, err)
 		defer c.Close()
 
-		// we expect that ping interval in 50ms has not passed yet
-		// and server has not being pinged
-		require.Equal(t, 0, server.ReceivedPings())
-
-		time.Sleep(200 * time.Millisecond)
+		// regular network management message
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI: field.NewStringValue("0800"),
+		})
+		require.NoError(t, err)
 
-		require.True(t, server.ReceivedPings() > 0)
+		_, err = c.Send(message)
+		require.EqualError(t, err, "creating request ID: STAN is missing")
 	})
 
-	t.Run("it handles unrecognized responses", func(t *testing.T) {
-		// unmatchedMessageHandler should be called for the second message
-		// reply because connection.Send will return ErrSendTimeout and
-		// reply will not be handled by the original caller
-		unmatchedMessageHandler := func(c *connection.Connection, message *iso8583.Message) {
-			mti, err := message.GetMTI()
-			require.NoError(t, err)
-			require.Equal(t, "0810", mti)
-
-			pan, err := message.GetString(2)
-			require.NoError(t, err)
-			require.Equal(t, TestCaseDelayedResponse, pan)
+	t.Run("it returns ErrSTANFieldUnavailable when spec does not define STAN", func(t *testing.T) {
+		specWithoutSTAN := &iso8583.MessageSpec{
+			Name:   "spec without field 11",
+			Fields: map[int]field.Field{},
+		}
+		for id, f := range testSpec.Fields {
+			if id != 11 {
+				specWithoutSTAN.Fields[id] = f
+			}
 		}
 
+		c, err := connection.New(server.Addr, specWithoutSTAN, readMessageLength, writeMessageLength, connection.SendTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(specWithoutSTAN)
+		message.MTI("0800")
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrSTANFieldUnavailable)
+
+		// messages built by the connection can't get STAN too
+		err = c.SignOn(context.Background())
+		require.ErrorIs(t, err, connection.ErrSTANFieldUnavailable)
+	})
+
+	t.Run("AutoSTAN sets STAN that is not used by pending requests", func(t *testing.T) {
 		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
-			connection.SendTimeout(100*time.Millisecond),
-			connection.InboundMessageHandler(unmatchedMessageHandler),
+			connection.AutoSTAN(),
+			connection.STANRange(1, 2),
 		)
 		require.NoError(t, err)
 
@@ -561,46 +1070,910 @@ func TestClient_Send(t *testing.T) {
 		require.NoError(t, err)
 		defer c.Close()
 
-		// network management message to test timeout
+		// pending request with STAN 000002
 		message := iso8583.NewMessage(testSpec)
 		err = message.Marshal(baseFields{
 			MTI:          field.NewStringValue("0800"),
 			TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
-			STAN:         field.NewStringValue(getSTAN()),
+			STAN:         field.NewStringValue("000002"),
 		})
 		require.NoError(t, err)
 
-		_, err = c.Send(message)
-		require.Equal(t, connection.ErrSendTimeout, err)
+		go c.Send(message)
+		time.Sleep(100 * time.Millisecond)
 
-		// let's sleep here to wait for the server response to our message
-		// we should not panic :)
-		time.Sleep(1 * time.Second)
+		var stans []string
+		for i := 0; i < 2; i++ {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+
+			_, err = c.Send(message)
+			require.NoError(t, err)
+
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+			stans = append(stans, stan)
+		}
+
+		// 000002 is pending, so 000001 is used again
+		require.Equal(t, []string{"000001", "000001"}, stans)
 	})
 
-	// if server sends a message to the client with the STAN that client is
-	// waiting for reply with, we should distinguish reply from incoming
-	// message
-	t.Run("it handles incoming messages with same STANs not as reply but as incoming message", func(t *testing.T) {
-		originalSTAN := getSTAN()
+	t.Run("connections share STAN sequence of the STANProvider", func(t *testing.T) {
+		provider := &connection.STANCounter{}
 
-		unmatchedMessageHandler := func(c *connection.Connection, message *iso8583.Message) {
-			mti, err := message.GetMTI()
+		var conns []*connection.Connection
+		for i := 0; i < 2; i++ {
+			c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+				connection.AutoSTAN(),
+				connection.SetSTANProvider(provider),
+			)
 			require.NoError(t, err)
-			require.Equal(t, "0800", mti)
 
-			receivedSTAN, err := message.GetString(11)
+			err = c.Connect()
 			require.NoError(t, err)
-			require.Equal(t, originalSTAN, receivedSTAN)
+			defer c.Close()
 
-			message.MTI("0810")
+			conns = append(conns, c)
+		}
+
+		var stans []string
+		for i := 0; i < 4; i++ {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+
+			_, err = conns[i%2].Send(message)
 			require.NoError(t, err)
-			c.Reply(message)
+
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+			stans = append(stans, stan)
 		}
 
+		require.Equal(t, []string{"000001", "000002", "000003", "000004"}, stans)
+	})
+
+	t.Run("ResetSTAN resets STAN counter unless reset STANs are pending", func(t *testing.T) {
 		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
-			connection.SendTimeout(1*time.Second),
-			connection.InboundMessageHandler(unmatchedMessageHandler),
+			connection.AutoSTAN(),
+			connection.STANRange(1, 1000),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		send := func(code string) string {
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(code),
+			})
+			require.NoError(t, err)
+
+			_, err = c.Send(message)
+			require.NoError(t, err)
+
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+
+			return stan
+		}
+
+		require.Equal(t, "000001", send(TestCaseReply))
+		require.Equal(t, "000002", send(TestCaseReply))
+
+		// STAN 000050 is pending
+		require.NoError(t, c.ResetSTAN(50))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			require.Equal(t, "000050", send(TestCaseDelayedResponse))
+		}()
+
+		require.Eventually(t, func() bool {
+			return c.Stats().Pending == 1
+		}, 200*time.Millisecond, 10*time.Millisecond)
+
+		err = c.ResetSTAN(1)
+		require.ErrorIs(t, err, connection.ErrRequestIDPending)
+		require.EqualError(t, err, "resetting STAN to 1: STAN 000050: request with the same ID is pending")
+
+		// STANs after the pending one can be used
+		require.NoError(t, c.ResetSTAN(51))
+		require.Equal(t, "000051", send(TestCaseReply))
+
+		<-done
+
+		require.NoError(t, c.ResetSTAN(1))
+		require.Equal(t, "000001", send(TestCaseReply))
+
+		require.EqualError(t, c.ResetSTAN(1001), "STAN 1001 is out of range 1-1000")
+	})
+
+	t.Run("STANPrefix prefixes STANs and reduces their range", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSTAN(),
+			connection.STANPrefix("A"),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		send := func() string {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+
+			_, err := c.Send(message)
+			require.NoError(t, err)
+
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+
+			return stan
+		}
+
+		seen := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			stan := send()
+			require.Len(t, stan, 6)
+			require.False(t, seen[stan], "STAN %s is not unique", stan)
+			seen[stan] = true
+		}
+		require.True(t, seen["A00001"])
+		require.True(t, seen["A00005"])
+
+		// numbers of the STANs wrap within the reduced range
+		require.EqualError(t, c.ResetSTAN(100000), "STAN 100000 is out of range 1-99999")
+		require.NoError(t, c.ResetSTAN(99999))
+		require.Equal(t, "A99999", send())
+		require.Equal(t, "A00001", send())
+
+		_, err = connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.STANPrefix("ABCDEF"),
+		)
+		require.Error(t, err)
+
+		// range doesn't fit the numbers left after the prefix
+		_, err = connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.STANPrefix("12"),
+			connection.STANRange(50000, 999999),
+		)
+		require.EqualError(t, err, `STAN range 50000-999999 doesn't fit STAN prefix "12": max STAN is 9999`)
+	})
+
+	t.Run("requests with the same STAN are matched using CorrelationField", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoCorrelationID(62),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan := getSTAN()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				message := iso8583.NewMessage(testSpec)
+				err := message.Marshal(baseFields{
+					MTI:          field.NewStringValue("0800"),
+					TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+					STAN:         field.NewStringValue(stan),
+				})
+				require.NoError(t, err)
+
+				response, err := c.Send(message)
+				require.NoError(t, err)
+
+				correlationID, err := message.GetString(62)
+				require.NoError(t, err)
+				require.Len(t, correlationID, 36)
+
+				responseCorrelationID, err := response.GetString(62)
+				require.NoError(t, err)
+				require.Equal(t, correlationID, responseCorrelationID)
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("STAN is reused on the next day with STANDateCorrelation", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSTAN(),
+			connection.STANRange(1, 1),
+			connection.STANDateCorrelation(),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// the only STAN is pending on the last day when request of the
+		// next day is sent
+		var wg sync.WaitGroup
+		for i, dateTime := range []string{"1013235959", "1014000000"} {
+			wg.Add(1)
+			go func(dateTime string) {
+				defer wg.Done()
+
+				message := iso8583.NewMessage(testSpec)
+				err := message.Marshal(baseFields{
+					MTI:          field.NewStringValue("0800"),
+					TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+				})
+				require.NoError(t, err)
+				require.NoError(t, message.Field(7, dateTime))
+
+				response, err := c.Send(message)
+				require.NoError(t, err)
+
+				stan, err := response.GetString(11)
+				require.NoError(t, err)
+				require.Equal(t, "000001", stan)
+
+				responseDateTime, err := response.GetString(7)
+				require.NoError(t, err)
+				require.Equal(t, dateTime, responseDateTime)
+			}(dateTime)
+
+			// let the first request be pending
+			if i == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		wg.Wait()
+
+		// request without field 7 can't be matched
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.EqualError(t, err, "creating request ID: transmission date & time (field 7) is missing")
+	})
+
+	t.Run("it returns ErrSTANExhausted when all STANs are used by pending requests", func(t *testing.T) {
+		exhausted := make(chan struct{}, 1)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSTAN(),
+			connection.STANRange(1, 3),
+			connection.OnSTANExhausted(func(c *connection.Connection) {
+				exhausted <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// fill all STANs with pending requests
+		for i := 0; i < 3; i++ {
+			message := iso8583.NewMessage(testSpec)
+			err = message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+			})
+			require.NoError(t, err)
+
+			go c.Send(message)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrSTANExhausted)
+
+		select {
+		case <-exhausted:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("OnSTANExhausted was not called")
+		}
+	})
+
+	t.Run("pending requests should complete after Close was called", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer func() {
+					wg.Done()
+				}()
+
+				// network management message
+				message := iso8583.NewMessage(testSpec)
+				err := message.Marshal(baseFields{
+					MTI:          field.NewStringValue("0800"),
+					TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+					STAN:         field.NewStringValue(getSTAN()),
+				})
+				require.NoError(t, err)
+
+				response, err := c.Send(message)
+				require.NoError(t, err)
+
+				mti, err := response.GetMTI()
+				require.NoError(t, err)
+				require.Equal(t, "0810", mti)
+			}(i)
+		}
+
+		// let's wait all messages to be sent
+		time.Sleep(200 * time.Millisecond)
+
+		// while server is waiting, we will close the connection
+		require.NoError(t, c.Close())
+		wg.Wait()
+	})
+
+	t.Run("responses received asynchronously", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// send first message and tell server to respond in 500ms
+		var (
+			receivedSTANs []string
+			wg            sync.WaitGroup
+			mu            sync.Mutex
+			stan1         string
+			stan2         string
+		)
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				wg.Done()
+			}()
+
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			response, err := c.Send(message)
+			require.NoError(t, err)
+
+			// put received STAN into slice so we can check the order
+			stan1, err = response.GetString(11)
+			require.NoError(t, err)
+			mu.Lock()
+			receivedSTANs = append(receivedSTANs, stan1)
+			mu.Unlock()
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				wg.Done()
+			}()
+
+			// this message will be sent after the first one
+			time.Sleep(100 * time.Millisecond)
+
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:  field.NewStringValue("0800"),
+				STAN: field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			response, err := c.Send(message)
+			require.NoError(t, err)
+
+			// put received STAN into slice so we can check the order
+			stan2, err = response.GetString(11)
+			require.NoError(t, err)
+			mu.Lock()
+			receivedSTANs = append(receivedSTANs, stan2)
+			mu.Unlock()
+		}()
+
+		// let's wait all messages to be sent
+		time.Sleep(200 * time.Millisecond)
+
+		wg.Wait()
+		require.NoError(t, c.Close())
+
+		// we expect that response for the second message was received first
+		require.Equal(t, receivedSTANs[0], stan2)
+
+		// and that response for the first message was received second
+		require.Equal(t, receivedSTANs[1], stan1)
+
+	})
+
+	t.Run("automatically sends ping messages after ping interval", func(t *testing.T) {
+		// we create server instance here to isolate pings count
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		pingHandler := func(c *connection.Connection) {
+			pingMessage := iso8583.NewMessage(testSpec)
+			err := pingMessage.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCasePingCounter),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			response, err := c.Send(pingMessage)
+			// we may get error because test closed server and connection
+			// it it's a connection closed error - that's ok. just return
+			if err != nil && errors.Is(err, connection.ErrConnectionClosed) {
+				return
+			}
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+		}
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.IdleTime(50*time.Millisecond),
+			connection.PingHandler(pingHandler),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// we expect that ping interval in 50ms has not passed yet
+		// and server has not being pinged
+		require.Equal(t, 0, server.ReceivedPings())
+
+		time.Sleep(200 * time.Millisecond)
+
+		require.True(t, server.ReceivedPings() > 0)
+	})
+
+	t.Run("sends ping messages when idle time passes on the Clock", func(t *testing.T) {
+		// we create server instance here to isolate pings count
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		pingHandler := func(c *connection.Connection) {
+			pingMessage := iso8583.NewMessage(testSpec)
+			err := pingMessage.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCasePingCounter),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			_, err = c.Send(pingMessage)
+			if err != nil && errors.Is(err, connection.ErrConnectionClosed) {
+				return
+			}
+			require.NoError(t, err)
+		}
+
+		clock := &testClock{}
+		clock.Set(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC))
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SetClock(clock),
+			connection.IdleTime(time.Minute),
+			connection.ReadTimeout(time.Hour),
+			connection.PingHandler(pingHandler),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// wait for the write loop to start idle timer
+		require.Eventually(t, func() bool {
+			return clock.Waiters() >= 2
+		}, time.Second, 10*time.Millisecond)
+
+		clock.Advance(59 * time.Second)
+		require.Never(t, func() bool {
+			return server.ReceivedPings() > 0
+		}, 50*time.Millisecond, 10*time.Millisecond)
+
+		clock.Advance(time.Second)
+		require.Eventually(t, func() bool {
+			return server.ReceivedPings() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// idle timer is restarted after the ping was written, so
+		// we keep advancing the time until it's done
+		require.Eventually(t, func() bool {
+			clock.Advance(time.Minute)
+			return server.ReceivedPings() >= 2
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("does not send pings during PingDelay", func(t *testing.T) {
+		// we create server instance here to isolate pings count
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		pingHandler := func(c *connection.Connection) {
+			pingMessage := iso8583.NewMessage(testSpec)
+			err := pingMessage.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCasePingCounter),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			_, err = c.Send(pingMessage)
+			if err != nil && errors.Is(err, connection.ErrConnectionClosed) {
+				return
+			}
+			require.NoError(t, err)
+		}
+
+		clock := &testClock{}
+		clock.Set(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC))
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SetClock(clock),
+			connection.IdleTime(time.Minute),
+			connection.PingDelay(5*time.Minute),
+			connection.ReadTimeout(time.Hour),
+			connection.PingHandler(pingHandler),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// idle time passes 4 times during the PingDelay
+		for i := 0; i < 4; i++ {
+			// wait for the write loop to start idle timer
+			require.Eventually(t, func() bool {
+				return clock.Waiters() >= 2
+			}, time.Second, 10*time.Millisecond)
+
+			clock.Advance(time.Minute)
+		}
+
+		require.Never(t, func() bool {
+			return server.ReceivedPings() > 0
+		}, 50*time.Millisecond, 10*time.Millisecond)
+
+		// ping is sent when PingDelay has passed
+		require.Eventually(t, func() bool {
+			return clock.Waiters() >= 2
+		}, time.Second, 10*time.Millisecond)
+
+		clock.Advance(time.Minute)
+		require.Eventually(t, func() bool {
+			return server.ReceivedPings() == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it handles unrecognized responses", func(t *testing.T) {
+		// unmatchedMessageHandler should be called for the second message
+		// reply because connection.Send will return ErrSendTimeout and
+		// reply will not be handled by the original caller
+		unmatchedMessageHandler := func(c *connection.Connection, message *iso8583.Message) {
+			mti, err := message.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+
+			pan, err := message.GetString(2)
+			require.NoError(t, err)
+			require.Equal(t, TestCaseDelayedResponse, pan)
+		}
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(100*time.Millisecond),
+			connection.InboundMessageHandler(unmatchedMessageHandler),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// network management message to test timeout
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.Equal(t, connection.ErrSendTimeout, err)
+
+		// let's sleep here to wait for the server response to our message
+		// we should not panic :)
+		time.Sleep(1 * time.Second)
+	})
+
+	t.Run("it calls OnUnmatched with request ID of the unmatched response", func(t *testing.T) {
+		var mu sync.Mutex
+		var unmatchedIDs []string
+
+		onUnmatched := func(c *connection.Connection, message *iso8583.Message, requestID string) {
+			mu.Lock()
+			defer mu.Unlock()
+			unmatchedIDs = append(unmatchedIDs, requestID)
+		}
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(100*time.Millisecond),
+			connection.OnUnmatched(onUnmatched),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// network management message to test timeout
+		stan := getSTAN()
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+			STAN:         field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.Equal(t, connection.ErrSendTimeout, err)
+
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return len(unmatchedIDs) == 1 && unmatchedIDs[0] == stan
+		}, 1*time.Second, 50*time.Millisecond, "OnUnmatched was not called with request ID")
+	})
+
+	t.Run("it calls OnLateResponse when response to timed out request is received", func(t *testing.T) {
+		type lateResponse struct {
+			stan string
+			late time.Duration
+		}
+		lateResponses := make(chan lateResponse, 1)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(100*time.Millisecond),
+			connection.OnLateResponse(func(c *connection.Connection, message *iso8583.Message, late time.Duration) {
+				stan, _ := message.GetString(11)
+				lateResponses <- lateResponse{stan: stan, late: late}
+			}),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// server replies in 500ms
+		stan := getSTAN()
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+			STAN:         field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		select {
+		case resp := <-lateResponses:
+			require.Equal(t, stan, resp.stan)
+			require.Greater(t, resp.late, 200*time.Millisecond)
+			require.Less(t, resp.late, 500*time.Millisecond)
+		case <-time.After(1 * time.Second):
+			t.Fatal("OnLateResponse was not called")
+		}
+	})
+
+	// if server sends a message to the client with the STAN that client is
+	// waiting for reply with, we should distinguish reply from incoming
+	// message
+	t.Run("it passes response without STAN to unmatched handlers and keeps connection alive", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		writeMessage := func(message *iso8583.Message) {
+			packed, err := message.Pack()
+			if err != nil {
+				return
+			}
+			writeMessageLength(serverConn, len(packed))
+			serverConn.Write(packed)
+		}
+
+		// mock server that sends response without STAN before the
+		// response to the request
+		go func() {
+			length, err := readMessageLength(serverConn)
+			if err != nil {
+				return
+			}
+
+			packed := make([]byte, length)
+			if _, err := io.ReadFull(serverConn, packed); err != nil {
+				return
+			}
+
+			message := iso8583.NewMessage(testSpec)
+			if err := message.Unpack(packed); err != nil {
+				return
+			}
+			message.MTI("0810")
+
+			withoutSTAN := iso8583.NewMessage(testSpec)
+			withoutSTAN.MTI("0810")
+			withoutSTAN.Field(2, TestCaseReply)
+
+			writeMessage(withoutSTAN)
+			writeMessage(message)
+		}()
+
+		inboundMessages := make(chan *iso8583.Message, 1)
+		unmatchedIDs := make(chan string, 1)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(500*time.Millisecond),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				inboundMessages <- message
+			}),
+			connection.OnUnmatched(func(c *connection.Connection, message *iso8583.Message, requestID string) {
+				unmatchedIDs <- requestID
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		select {
+		case inbound := <-inboundMessages:
+			code, err := inbound.GetString(2)
+			require.NoError(t, err)
+			require.Equal(t, TestCaseReply, code)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("response without STAN was not passed to InboundMessageHandler")
+		}
+
+		select {
+		case requestID := <-unmatchedIDs:
+			require.Empty(t, requestID)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("OnUnmatched was not called")
+		}
+	})
+
+	t.Run("InboundMessageHandler can be replaced while messages are received", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		const messagesNum = 100
+
+		// mock server that sends incoming messages to the client
+		go func() {
+			for i := 0; i < messagesNum; i++ {
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0800")
+				message.Field(11, fmt.Sprintf("%06d", i+1))
+
+				packed, err := message.Pack()
+				if err != nil {
+					return
+				}
+				writeMessageLength(serverConn, len(packed))
+				serverConn.Write(packed)
+			}
+		}()
+
+		var wg sync.WaitGroup
+		wg.Add(messagesNum)
+
+		var handledA, handledB int32
+		handlerA := func(c *connection.Connection, message *iso8583.Message) {
+			atomic.AddInt32(&handledA, 1)
+			wg.Done()
+		}
+		handlerB := func(c *connection.Connection, message *iso8583.Message) {
+			atomic.AddInt32(&handledB, 1)
+			wg.Done()
+		}
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(handlerA),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if i%2 == 0 {
+					c.SetInboundMessageHandler(handlerB)
+				} else {
+					c.SetInboundMessageHandler(handlerA)
+				}
+			}
+		}()
+
+		wg.Wait()
+		close(done)
+
+		require.Equal(t, int32(messagesNum), atomic.LoadInt32(&handledA)+atomic.LoadInt32(&handledB))
+	})
+
+	t.Run("it handles incoming messages with same STANs not as reply but as incoming message", func(t *testing.T) {
+		originalSTAN := getSTAN()
+
+		unmatchedMessageHandler := func(c *connection.Connection, message *iso8583.Message) {
+			mti, err := message.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0800", mti)
+
+			receivedSTAN, err := message.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, originalSTAN, receivedSTAN)
+
+			message.MTI("0810")
+			require.NoError(t, err)
+			c.Reply(message)
+		}
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(1*time.Second),
+			connection.InboundMessageHandler(unmatchedMessageHandler),
 		)
 		require.NoError(t, err)
 
@@ -612,219 +1985,1293 @@ func TestClient_Send(t *testing.T) {
 		message := iso8583.NewMessage(testSpec)
 		err = message.Marshal(baseFields{
 			MTI:          field.NewStringValue("0800"),
-			TestCaseCode: field.NewStringValue(TestCaseSameSTANRequest),
-			STAN:         field.NewStringValue(originalSTAN),
+			TestCaseCode: field.NewStringValue(TestCaseSameSTANRequest),
+			STAN:         field.NewStringValue(originalSTAN),
+		})
+		require.NoError(t, err)
+
+		res, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := res.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+	})
+
+	t.Run("should allow setting a custom connection without overwriting it in connect", func(t *testing.T) {
+		closer := &TrackingRWCloser{}
+
+		c, err := connection.NewFrom(closer, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		msg := iso8583.NewMessage(testSpec)
+
+		c.Reply(msg)
+
+		require.Equal(t, closer.Used, true, "client didn't use custom connection")
+	})
+
+	t.Run("CancelAll returns error to pending requests and keeps connection open", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(2*time.Second),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		errCancelled := errors.New("emergency shutdown")
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				message := iso8583.NewMessage(testSpec)
+				err := message.Marshal(baseFields{
+					MTI:          field.NewStringValue("0800"),
+					TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+					STAN:         field.NewStringValue(getSTAN()),
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				_, err = c.Send(message)
+				errs <- err
+			}()
+		}
+
+		// let requests be written
+		time.Sleep(100 * time.Millisecond)
+
+		c.CancelAll(errCancelled)
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.ErrorIs(t, err, errCancelled)
+		}
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+
+	t.Run("Expect receives response with the request ID", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan := getSTAN()
+		responseCh, cancel, err := c.Expect(stan)
+		require.NoError(t, err)
+		defer cancel()
+
+		// response with the same ID can be expected only once
+		_, _, err = c.Expect(stan)
+		require.ErrorIs(t, err, connection.ErrRequestIDPending)
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		// Send doesn't take over the expected response
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrRequestIDPending)
+
+		// send the request without waiting for the response
+		require.NoError(t, c.Reply(message))
+
+		select {
+		case response := <-responseCh:
+			responseSTAN, err := response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, stan, responseSTAN)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("expected response was not received")
+		}
+
+		// after the response was received, request ID can be used again
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+
+	t.Run("StrictCorrelation fails request with the ID of the pending request", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(2*time.Second),
+			connection.StrictCorrelation(),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan := getSTAN()
+		newMessage := func(code string) *iso8583.Message {
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(code),
+				STAN:         field.NewStringValue(stan),
+			})
+			require.NoError(t, err)
+
+			return message
+		}
+
+		sendErr := make(chan error, 1)
+		go func() {
+			_, err := c.Send(newMessage(TestCaseDelayedResponse))
+			sendErr <- err
+		}()
+
+		require.Eventually(t, func() bool {
+			return c.Stats().Pending == 1
+		}, time.Second, 10*time.Millisecond)
+
+		start := time.Now()
+		_, err = c.Send(newMessage(TestCaseReply))
+		require.ErrorIs(t, err, connection.ErrRequestIDPending)
+		require.Less(t, time.Since(start), 100*time.Millisecond)
+
+		// the pending request still gets its response
+		require.NoError(t, <-sendErr)
+	})
+
+	t.Run("Expect cancel removes the expectation", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan := getSTAN()
+		_, cancel, err := c.Expect(stan)
+		require.NoError(t, err)
+		cancel()
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+
+	t.Run("OnRequestTiming is called with queue wait and round trip time", func(t *testing.T) {
+		timings := make(chan connection.RequestTiming, 1)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.OnRequestTiming(func(c *connection.Connection, timing connection.RequestTiming) {
+				timings <- timing
+			}),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan := getSTAN()
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+			STAN:         field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		select {
+		case timing := <-timings:
+			require.Equal(t, stan, timing.RequestID)
+			// server delays response for 500ms
+			require.GreaterOrEqual(t, timing.RoundTrip, 500*time.Millisecond)
+			require.Less(t, timing.QueueWait, 100*time.Millisecond)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("OnRequestTiming was not called")
+		}
+	})
+
+	t.Run("OnMessagePacked is called with packed message length and field count", func(t *testing.T) {
+		packedCh := make(chan connection.PackedMessage, 1)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.OnMessagePacked(func(c *connection.Connection, message connection.PackedMessage) {
+				packedCh <- message
+			}),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		select {
+		case packedMessage := <-packedCh:
+			require.Equal(t, "0800", packedMessage.MTI)
+			require.Equal(t, len(packed), packedMessage.Length)
+			// fields 2 and 11
+			require.Equal(t, 2, packedMessage.FieldCount)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("OnMessagePacked was not called")
+		}
+	})
+
+	t.Run("OnFrameSize is called with size of the received message", func(t *testing.T) {
+		sizes := make(chan int, 1)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.OnFrameSize(func(c *connection.Connection, size int) {
+				sizes <- size
+			}),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		packed, err := response.Pack()
+		require.NoError(t, err)
+
+		select {
+		case size := <-sizes:
+			require.Equal(t, len(packed), size)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("OnFrameSize was not called")
+		}
+	})
+
+	t.Run("Flush waits until queued requests are written", func(t *testing.T) {
+		conn := &recordingConn{writeDelay: 100 * time.Millisecond}
+
+		c, err := connection.NewFrom(conn, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(300*time.Millisecond))
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		// response will never be received
+		go c.Send(message)
+
+		// let Send to queue the request
+		time.Sleep(20 * time.Millisecond)
+
+		require.NoError(t, c.Flush(context.Background()))
+		require.Equal(t, 1, conn.Writes())
+	})
+
+	t.Run("Flush returns when context is done", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// connection is not established, so flush request is not handled
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		require.ErrorIs(t, c.Flush(ctx), context.DeadlineExceeded)
+	})
+
+	// if server closed the connection, we want Send method to receive
+	// ErrConnectionClosed and not ErrSendTimeout
+	t.Run("pending requests get ErrConnectionClosed if server closed the connection", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(500*time.Millisecond))
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		done := make(chan bool)
+
+		// send message that will trigger server handler to sleep
+		// trigger server to close connection
+		go func() {
+			// regardless of the test result, we have to finish parent t.Run
+			defer func() {
+				done <- true
+			}()
+
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			_, err = c.Send(message)
+
+			// instead of ErrSendTimeout we want to receive
+			// ErrConnectionReset (it's ErrConnectionClosed too)
+			require.ErrorIs(t, err, connection.ErrConnectionReset)
+			require.ErrorIs(t, err, connection.ErrConnectionClosed)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+
+		// trigger server to close connection
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		// we can get reply or connection can be closed here too
+		// but because in test server we have a tiny delay before
+		// we close the connection, we are safe here to get no err
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		<-done
+	})
+
+	t.Run("it returns ErrConnectionClosed when connection was closed by server", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(2*time.Second))
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer func() {
+			c.Close()
+		}()
+
+		// trigger server to close connection
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		// let's wait for connection to be close
+		time.Sleep(100 * time.Millisecond)
+
+		// because connection was closed (by server) we should receive
+		// ErrConnectionClosed error
+		message = iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.Equal(t, connection.ErrConnectionClosed, err)
+	})
+
+	t.Run("ReadTimeoutHandler called after ReadTimeout elapses", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		readTimeoutHandler := func(c *connection.Connection) {
+			// send a ping message on timeout
+			pingMessage := iso8583.NewMessage(testSpec)
+			err := pingMessage.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCasePingCounter),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			response, err := c.Send(pingMessage)
+			// we may get error because test closed server and connection
+			// it it's a connection closed error - that's ok. just return
+			if err != nil && errors.Is(err, connection.ErrConnectionClosed) {
+				return
+			}
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+		}
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.ReadTimeout(50*time.Millisecond),
+			connection.ReadTimeoutHandler(readTimeoutHandler),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// less than 50 ms timeout, should not have any pings
+		require.Equal(t, 0, server.ReceivedPings())
+
+		// time elapsed is greater than timeout, expect one ping
+		require.Eventually(t, func() bool {
+			return server.ReceivedPings() > 0
+		}, 200*time.Millisecond, 50*time.Millisecond, "no ping messages were sent after read timeout")
+	})
+
+	t.Run("connection is closed after MaxReadTimeouts read timeouts without messages", func(t *testing.T) {
+		// server that accepts connection and never sends anything back
+		ln, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}()
+
+		var heartbeats int32
+		readTimeoutHandler := func(c *connection.Connection) {
+			atomic.AddInt32(&heartbeats, 1)
+		}
+
+		clock := &testClock{}
+		clock.Set(time.Now())
+
+		closed := make(chan struct{})
+		c, err := connection.New(ln.Addr().String(), testSpec, readMessageLength, writeMessageLength,
+			connection.SetClock(clock),
+			connection.IdleTime(time.Hour),
+			connection.ReadTimeout(time.Second),
+			connection.ReadTimeoutHandler(readTimeoutHandler),
+			connection.MaxReadTimeouts(3),
+			connection.ConnectionClosedHandler(func(c *connection.Connection) {
+				close(closed)
+			}),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// readTimeout fires the next read timeout when the read loop
+		// waits for it (the other timer is the idle time of pings)
+		readTimeout := func() {
+			require.Eventually(t, func() bool {
+				return clock.Waiters() == 2
+			}, time.Second, time.Millisecond)
+			clock.Advance(time.Second)
+		}
+
+		for i := 1; i < 3; i++ {
+			readTimeout()
+
+			// heartbeat is sent on each read timeout before connection
+			// is closed
+			require.Eventually(t, func() bool {
+				return atomic.LoadInt32(&heartbeats) == int32(i)
+			}, time.Second, time.Millisecond)
+
+			select {
+			case <-closed:
+				t.Fatalf("connection was closed after %d read timeouts", i)
+			default:
+			}
+		}
+
+		readTimeout()
+
+		select {
+		case <-closed:
+		case <-time.After(1 * time.Second):
+			t.Fatal("connection was not closed after max read timeouts")
+		}
+
+		require.Equal(t, int32(2), atomic.LoadInt32(&heartbeats))
+	})
+
+}
+
+func TestClient_Options(t *testing.T) {
+	t.Run("SpecSelector selects spec to unpack received message", func(t *testing.T) {
+		// file update messages use different length of field 2
+		fileUpdateSpec := &iso8583.MessageSpec{
+			Name:   "file update spec",
+			Fields: map[int]field.Field{},
+		}
+		for id, f := range testSpec.Fields {
+			fileUpdateSpec.Fields[id] = f
+		}
+		fileUpdateSpec.Fields[2] = field.NewString(&field.Spec{
+			Length:      5,
+			Description: "File Name",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
 		})
+
+		selector := func(rawMessage []byte) *iso8583.MessageSpec {
+			if string(rawMessage[:2]) == "03" {
+				return fileUpdateSpec
+			}
+			return nil
+		}
+
+		received := make(chan *iso8583.Message, 2)
+		inboundMessageHandler := func(c *connection.Connection, message *iso8583.Message) {
+			received <- message
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SpecSelector(selector),
+			connection.InboundMessageHandler(inboundMessageHandler),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// send authorization and file update messages to the client
+		authorization := iso8583.NewMessage(testSpec)
+		authorization.MTI("0100")
+		require.NoError(t, authorization.Field(2, "123"))
+
+		fileUpdate := iso8583.NewMessage(fileUpdateSpec)
+		fileUpdate.MTI("0300")
+		require.NoError(t, fileUpdate.Field(2, "FILE1"))
+
+		for _, message := range []*iso8583.Message{authorization, fileUpdate} {
+			packed, err := message.Pack()
+			require.NoError(t, err)
+
+			_, err = writeMessageLength(serverConn, len(packed))
+			require.NoError(t, err)
+			_, err = serverConn.Write(packed)
+			require.NoError(t, err)
+		}
+
+		values := map[string]string{}
+		for i := 0; i < 2; i++ {
+			select {
+			case message := <-received:
+				mti, err := message.GetMTI()
+				require.NoError(t, err)
+				values[mti], err = message.GetString(2)
+				require.NoError(t, err)
+			case <-time.After(500 * time.Millisecond):
+				t.Fatal("message was not received")
+			}
+		}
+
+		require.Equal(t, map[string]string{"0100": "123", "0300": "FILE1"}, values)
+	})
+
+	t.Run("ErrorHandler is called when connection is closed", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		var callsCounter int32
+
+		errorHandler := func(err error) {
+			atomic.AddInt32(&callsCounter, 1)
+		}
+		c.SetOptions(connection.ErrorHandler(errorHandler))
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+		require.Equal(t, int32(0), atomic.LoadInt32(&callsCounter))
+
+		// let's wait for server and client to connect
+		// before we close the server
+		time.Sleep(100 * time.Millisecond)
+
+		// when we close server
+		server.Close()
+
+		// then errorHandler should be called at least once
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&callsCounter) > 0
+		}, 500*time.Millisecond, 50*time.Millisecond, "error handler was never called")
+
+	})
+
+	t.Run("LengthIncludesHeader makes length header include its size", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		// mock server that uses length of the whole frame in the header
+		go func() {
+			length, err := readMessageLength(serverConn)
+			if err != nil {
+				return
+			}
+
+			// 2 bytes header is included into the length
+			packed := make([]byte, length-2)
+			if _, err := io.ReadFull(serverConn, packed); err != nil {
+				return
+			}
+
+			message := iso8583.NewMessage(testSpec)
+			if err := message.Unpack(packed); err != nil {
+				return
+			}
+			message.MTI("0810")
+
+			packed, err = message.Pack()
+			if err != nil {
+				return
+			}
+
+			writeMessageLength(serverConn, len(packed)+2)
+			serverConn.Write(packed)
+		}()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.LengthIncludesHeader(),
+			connection.SendTimeout(500*time.Millisecond),
+		)
 		require.NoError(t, err)
+		defer c.Close()
 
-		res, err := c.Send(message)
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
 		require.NoError(t, err)
 
-		mti, err := res.GetMTI()
+		mti, err := response.GetMTI()
 		require.NoError(t, err)
 		require.Equal(t, "0810", mti)
 	})
 
-	t.Run("should allow setting a custom connection without overwriting it in connect", func(t *testing.T) {
-		closer := &TrackingRWCloser{}
+	t.Run("TrailerSize reads LRC after each message and TrailerValidator checks it", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
 
-		c, err := connection.NewFrom(closer, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(100*time.Millisecond))
-		require.NoError(t, err)
+		lrc := func(data []byte) byte {
+			var sum byte
+			for _, b := range data {
+				sum ^= b
+			}
+			return sum
+		}
 
-		err = c.Connect()
+		// mock server that appends LRC to each reply. LRC of the first
+		// reply is invalid.
+		go func() {
+			for i := 0; ; i++ {
+				length, err := readMessageLength(serverConn)
+				if err != nil {
+					return
+				}
+
+				packed := make([]byte, length)
+				if _, err := io.ReadFull(serverConn, packed); err != nil {
+					return
+				}
+
+				message := iso8583.NewMessage(testSpec)
+				if err := message.Unpack(packed); err != nil {
+					return
+				}
+				message.MTI("0810")
+
+				packed, err = message.Pack()
+				if err != nil {
+					return
+				}
+
+				trailer := lrc(packed)
+				if i == 0 {
+					trailer++
+				}
+
+				writeMessageLength(serverConn, len(packed))
+				serverConn.Write(append(packed, trailer))
+			}
+		}()
+
+		errCh := make(chan error, 1)
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.TrailerSize(1),
+			connection.TrailerValidator(func(rawMessage, trailer []byte) error {
+				if trailer[0] != lrc(rawMessage) {
+					return errors.New("LRC mismatch")
+				}
+				return nil
+			}),
+			connection.ErrorHandler(func(err error) {
+				select {
+				case errCh <- err:
+				default:
+				}
+			}),
+			connection.SendTimeout(200*time.Millisecond),
+		)
 		require.NoError(t, err)
 		defer c.Close()
 
-		msg := iso8583.NewMessage(testSpec)
+		// reply with invalid LRC is dropped
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
 
-		c.Reply(msg)
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
 
-		require.Equal(t, closer.Used, true, "client didn't use custom connection")
+		var trailerErr *connection.ErrInvalidTrailer
+		require.ErrorAs(t, <-errCh, &trailerErr)
+		require.Len(t, trailerErr.Trailer, 1)
+
+		// next replies are read correctly
+		for i := 0; i < 2; i++ {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(11, getSTAN()))
+
+			response, err := c.Send(message)
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+		}
 	})
 
-	// if server closed the connection, we want Send method to receive
-	// ErrConnectionClosed and not ErrSendTimeout
-	t.Run("pending requests get ErrConnectionClosed if server closed the connection", func(t *testing.T) {
-		server, err := NewTestServer()
+	t.Run("FrameChecksum computes and validates LRC of the messages", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		lrc := func(packed []byte) []byte {
+			var sum byte
+			for _, b := range packed {
+				sum ^= b
+			}
+			return []byte{sum}
+		}
+		validateLRC := func(payload, checksum []byte) error {
+			if !bytes.Equal(lrc(payload), checksum) {
+				return errors.New("LRC mismatch")
+			}
+			return nil
+		}
+
+		var serverErrors int32
+		server, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+			connection.FrameChecksum(lrc, validateLRC),
+			connection.ErrorHandler(func(err error) {
+				atomic.AddInt32(&serverErrors, 1)
+			}),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
 		require.NoError(t, err)
 		defer server.Close()
 
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(500*time.Millisecond))
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.FrameChecksum(lrc, validateLRC),
+			connection.SendTimeout(500*time.Millisecond),
+		)
 		require.NoError(t, err)
+		defer c.Close()
 
-		err = c.Connect()
+		for i := 0; i < 3; i++ {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(11, getSTAN()))
+
+			response, err := c.Send(message)
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+		}
+
+		require.Zero(t, atomic.LoadInt32(&serverErrors))
+	})
+
+	t.Run("TrySend returns ErrQueueFull when write queue is full", func(t *testing.T) {
+		// server doesn't read, so the write loop is blocked by the first
+		// request
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.QueueSize(1),
+			connection.SendTimeout(500*time.Millisecond),
+		)
 		require.NoError(t, err)
 		defer c.Close()
 
-		done := make(chan bool)
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-		// send message that will trigger server handler to sleep
-		// trigger server to close connection
-		go func() {
-			// regardless of the test result, we have to finish parent t.Run
-			defer func() {
-				done <- true
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0800")
+				message.Field(11, getSTAN())
+
+				c.Send(message)
 			}()
+		}
+
+		// let the first request be picked up by the write loop and the
+		// second one be queued
+		time.Sleep(100 * time.Millisecond)
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		start := time.Now()
+		_, err = c.TrySend(message)
+		require.ErrorIs(t, err, connection.ErrQueueFull)
+		require.Less(t, time.Since(start), 50*time.Millisecond)
+
+		wg.Wait()
+	})
+
+	t.Run("DeliverPartialUnpack returns partially unpacked response to Send", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		// mock server that replies with truncated response: response
+		// code (field 39) is cut off
+		go func() {
+			length, err := readMessageLength(serverConn)
+			if err != nil {
+				return
+			}
+
+			packed := make([]byte, length)
+			if _, err := io.ReadFull(serverConn, packed); err != nil {
+				return
+			}
 
 			message := iso8583.NewMessage(testSpec)
-			err := message.Marshal(baseFields{
-				MTI:          field.NewStringValue("0800"),
-				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
-				STAN:         field.NewStringValue(getSTAN()),
-			})
-			require.NoError(t, err)
+			if err := message.Unpack(packed); err != nil {
+				return
+			}
+			message.MTI("0810")
+			message.Field(39, "00")
 
-			_, err = c.Send(message)
+			packed, err = message.Pack()
+			if err != nil {
+				return
+			}
+			packed = packed[:len(packed)-2]
 
-			// instead of ErrSendTimeout we want to receive
-			// ErrConnectionClosed
-			require.Equal(t, connection.ErrConnectionClosed, err)
+			writeMessageLength(serverConn, len(packed))
+			serverConn.Write(packed)
 		}()
 
-		time.Sleep(50 * time.Millisecond)
+		errCh := make(chan error, 1)
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.DeliverPartialUnpack(),
+			connection.ErrorHandler(func(err error) {
+				select {
+				case errCh <- err:
+				default:
+				}
+			}),
+			connection.SendTimeout(time.Second),
+		)
+		require.NoError(t, err)
+		defer c.Close()
 
-		// trigger server to close connection
+		stan := getSTAN()
 		message := iso8583.NewMessage(testSpec)
-		err = message.Marshal(baseFields{
-			MTI:          field.NewStringValue("0800"),
-			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
-			STAN:         field.NewStringValue(getSTAN()),
-		})
-		require.NoError(t, err)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, stan))
 
-		// we can get reply or connection can be closed here too
-		// but because in test server we have a tiny delay before
-		// we close the connection, we are safe here to get no err
+		start := time.Now()
 		_, err = c.Send(message)
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+
+		var unpackErr *connection.ErrUnpack
+		require.ErrorAs(t, err, &unpackErr)
+		require.NotNil(t, unpackErr.Message)
+
+		mti, err := unpackErr.Message.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+
+		responseSTAN, err := unpackErr.Message.GetString(11)
 		require.NoError(t, err)
+		require.Equal(t, stan, responseSTAN)
 
-		<-done
+		// error handler gets the same error
+		require.ErrorAs(t, <-errCh, &unpackErr)
 	})
 
-	t.Run("it returns ErrConnectionClosed when connection was closed by server", func(t *testing.T) {
+	t.Run("DuplicateResponsePolicy defines how duplicate responses are handled", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			options    []connection.Option
+			unmatchedN int
+		}{
+			{"duplicates are unmatched by default", nil, 1},
+			{"duplicates are dropped", []connection.Option{connection.DuplicateResponsePolicy(connection.DuplicateDrop)}, 0},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				clientConn, serverConn := net.Pipe()
+
+				// server sends the response twice
+				echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+					connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+						message.MTI("0810")
+						c.Reply(message)
+						c.Reply(message)
+					}),
+				)
+				require.NoError(t, err)
+				defer echo.Close()
+
+				var unmatched int32
+				options := append([]connection.Option{
+					connection.SendTimeout(500 * time.Millisecond),
+					connection.OnUnmatched(func(c *connection.Connection, message *iso8583.Message, reqID string) {
+						atomic.AddInt32(&unmatched, 1)
+					}),
+				}, tt.options...)
+
+				c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, options...)
+				require.NoError(t, err)
+				defer c.Close()
+
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0800")
+				require.NoError(t, message.Field(11, getSTAN()))
+
+				_, err = c.Send(message)
+				require.NoError(t, err)
+
+				// let the duplicate be received
+				time.Sleep(100 * time.Millisecond)
+
+				require.Equal(t, int32(tt.unmatchedN), atomic.LoadInt32(&unmatched))
+			})
+		}
+	})
+
+	t.Run("RateLimit limits the rate of written messages", func(t *testing.T) {
 		server, err := NewTestServer()
 		require.NoError(t, err)
 		defer server.Close()
 
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(2*time.Second))
-		require.NoError(t, err)
+		// sendMessages sends n messages concurrently and returns channel
+		// that is closed when all of them get responses
+		sendMessages := func(t *testing.T, c *connection.Connection, n int) <-chan struct{} {
+			var wg sync.WaitGroup
 
-		err = c.Connect()
-		require.NoError(t, err)
-		defer func() {
-			c.Close()
-		}()
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
 
-		// trigger server to close connection
-		message := iso8583.NewMessage(testSpec)
-		err = message.Marshal(baseFields{
-			MTI:          field.NewStringValue("0800"),
-			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
-			STAN:         field.NewStringValue(getSTAN()),
+					message := iso8583.NewMessage(testSpec)
+					message.MTI("0800")
+					require.NoError(t, message.Field(11, getSTAN()))
+
+					_, err := c.Send(message)
+					require.NoError(t, err)
+				}()
+			}
+
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+
+			return done
+		}
+
+		t.Run("messages wait for the rate limiter", func(t *testing.T) {
+			clock := &testClock{}
+			clock.Set(time.Now())
+
+			c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+				connection.RateLimit(20, 2),
+				connection.SetClock(clock),
+			)
+			require.NoError(t, err)
+			require.NoError(t, c.Connect())
+			defer c.Close()
+
+			started := clock.Now()
+			done := sendMessages(t, c, 10)
+
+			require.Eventually(t, func() bool {
+				select {
+				case <-done:
+					return true
+				default:
+					clock.Advance(10 * time.Millisecond)
+					return false
+				}
+			}, 5*time.Second, time.Millisecond)
+
+			// 2 messages are written at once, the rest 8 - every 50ms
+			require.GreaterOrEqual(t, clock.Now().Sub(started), 400*time.Millisecond)
+		})
+
+		t.Run("bypassed messages are not rate limited", func(t *testing.T) {
+			clock := &testClock{}
+			clock.Set(time.Now())
+
+			c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+				connection.RateLimit(20, 2),
+				connection.SetClock(clock),
+				connection.RateLimitBypass(func(message *iso8583.Message) bool {
+					mti, _ := message.GetMTI()
+					return mti == "0800"
+				}),
+			)
+			require.NoError(t, err)
+			require.NoError(t, c.Connect())
+			defer c.Close()
+
+			// clock doesn't move, so rate limited messages would
+			// wait forever
+			select {
+			case <-sendMessages(t, c, 10):
+			case <-time.After(time.Second):
+				t.Fatal("bypassed messages were rate limited")
+			}
+		})
+
+		t.Run("rate and burst should be positive", func(t *testing.T) {
+			_, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+				connection.RateLimit(0, 1),
+			)
+			require.Error(t, err)
 		})
+	})
+
+	t.Run("DualSocket writes requests and reads responses on separate connections", func(t *testing.T) {
+		writeListener, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		defer writeListener.Close()
+
+		readListener, err := net.Listen("tcp", "127.0.0.1:")
 		require.NoError(t, err)
+		defer readListener.Close()
+
+		// mock host that receives requests on one socket and sends
+		// responses on another one
+		go func() {
+			outbound, err := writeListener.Accept()
+			if err != nil {
+				return
+			}
+			defer outbound.Close()
+
+			inbound, err := readListener.Accept()
+			if err != nil {
+				return
+			}
+			defer inbound.Close()
+
+			length, err := readMessageLength(outbound)
+			if err != nil {
+				return
+			}
+
+			packed := make([]byte, length)
+			if _, err := io.ReadFull(outbound, packed); err != nil {
+				return
+			}
+
+			message := iso8583.NewMessage(testSpec)
+			if err := message.Unpack(packed); err != nil {
+				return
+			}
+			message.MTI("0810")
+
+			packed, err = message.Pack()
+			if err != nil {
+				return
+			}
 
-		_, err = c.Send(message)
+			writeMessageLength(inbound, len(packed))
+			inbound.Write(packed)
+
+			// keep connections open until client is closed
+			io.Copy(io.Discard, outbound)
+		}()
+
+		c, err := connection.New(writeListener.Addr().String(), testSpec, readMessageLength, writeMessageLength,
+			connection.DualSocket(readListener.Addr().String()),
+			connection.SendTimeout(500*time.Millisecond),
+		)
 		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
 
-		// let's wait for connection to be close
-		time.Sleep(100 * time.Millisecond)
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
 
-		// because connection was closed (by server) we should receive
-		// ErrConnectionClosed error
-		message = iso8583.NewMessage(testSpec)
-		err = message.Marshal(baseFields{
-			MTI:          field.NewStringValue("0800"),
-			TestCaseCode: field.NewStringValue(TestCaseReply),
-			STAN:         field.NewStringValue(getSTAN()),
-		})
+		response, err := c.Send(message)
 		require.NoError(t, err)
 
-		_, err = c.Send(message)
-		require.Equal(t, connection.ErrConnectionClosed, err)
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
 	})
 
-	t.Run("ReadTimeoutHandler called after ReadTimeout elapses", func(t *testing.T) {
+	t.Run("DualSocket fails to connect when read address is not available", func(t *testing.T) {
 		server, err := NewTestServer()
 		require.NoError(t, err)
 		defer server.Close()
 
-		readTimeoutHandler := func(c *connection.Connection) {
-			// send a ping message on timeout
-			pingMessage := iso8583.NewMessage(testSpec)
-			err := pingMessage.Marshal(baseFields{
-				MTI:          field.NewStringValue("0800"),
-				TestCaseCode: field.NewStringValue(TestCasePingCounter),
-				STAN:         field.NewStringValue(getSTAN()),
-			})
-			require.NoError(t, err)
-
-			response, err := c.Send(pingMessage)
-			// we may get error because test closed server and connection
-			// it it's a connection closed error - that's ok. just return
-			if err != nil && errors.Is(err, connection.ErrConnectionClosed) {
-				return
-			}
-			require.NoError(t, err)
-
-			mti, err := response.GetMTI()
-			require.NoError(t, err)
-			require.Equal(t, "0810", mti)
-		}
+		// listen and close to get address nobody listens on
+		ln, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		readAddr := ln.Addr().String()
+		ln.Close()
 
 		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
-			connection.ReadTimeout(50*time.Millisecond),
-			connection.ReadTimeoutHandler(readTimeoutHandler),
+			connection.DualSocket(readAddr),
 		)
 		require.NoError(t, err)
 
 		err = c.Connect()
-		require.NoError(t, err)
-		defer c.Close()
-
-		// less than 50 ms timeout, should not have any pings
-		require.Equal(t, 0, server.ReceivedPings())
-
-		// time elapsed is greater than timeout, expect one ping
-		require.Eventually(t, func() bool {
-			return server.ReceivedPings() > 0
-		}, 200*time.Millisecond, 50*time.Millisecond, "no ping messages were sent after read timeout")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), readAddr)
 	})
 
-}
-
-func TestClient_Options(t *testing.T) {
-	t.Run("ErrorHandler is called when connection is closed", func(t *testing.T) {
+	t.Run("Name prefixes errors and is available in handlers", func(t *testing.T) {
 		server, err := NewTestServer()
 		require.NoError(t, err)
 
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
-		require.NoError(t, err)
-
-		var callsCounter int32
+		errCh := make(chan error, 10)
+		closedName := make(chan string, 1)
 
-		errorHandler := func(err error) {
-			atomic.AddInt32(&callsCounter, 1)
-		}
-		c.SetOptions(connection.ErrorHandler(errorHandler))
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.Name("acquirer-a"),
+			connection.ErrorHandler(func(err error) {
+				errCh <- err
+			}),
+			connection.ConnectionClosedHandler(func(c *connection.Connection) {
+				closedName <- c.Name()
+			}),
+		)
+		require.NoError(t, err)
+		require.Equal(t, "acquirer-a", c.Name())
 
 		err = c.Connect()
 		require.NoError(t, err)
 		defer c.Close()
-		require.Equal(t, int32(0), atomic.LoadInt32(&callsCounter))
 
 		// let's wait for server and client to connect
-		// before we close the server
 		time.Sleep(100 * time.Millisecond)
-
-		// when we close server
 		server.Close()
 
-		// then errorHandler should be called at least once
-		require.Eventually(t, func() bool {
-			return atomic.LoadInt32(&callsCounter) > 0
-		}, 500*time.Millisecond, 50*time.Millisecond, "error handler was never called")
+		select {
+		case err := <-errCh:
+			require.Regexp(t, "^acquirer-a: ", err.Error())
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("error handler was not called")
+		}
+
+		select {
+		case name := <-closedName:
+			require.Equal(t, "acquirer-a", name)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("connection closed handler was not called")
+		}
+
+		// Connect errors are prefixed with the name too
+		c, err = connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.Name("acquirer-a"))
+		require.NoError(t, err)
 
+		err = c.Connect()
+		require.Error(t, err)
+		require.Regexp(t, "^acquirer-a: connecting to server", err.Error())
 	})
 
 	t.Run("ClosedHandler is called when connection is closed", func(t *testing.T) {
@@ -878,6 +3325,65 @@ func TestClient_Options(t *testing.T) {
 		require.Equal(t, 1, callsCounter)
 	})
 
+	t.Run("OnWriteLoopExit and OnReadLoopExit are called once when connection is closed by server", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		writeLoopErrs := make(chan error, 2)
+		readLoopErrs := make(chan error, 2)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(500*time.Millisecond),
+			connection.OnWriteLoopExit(func(c *connection.Connection, err error) {
+				writeLoopErrs <- err
+			}),
+			connection.OnReadLoopExit(func(c *connection.Connection, err error) {
+				readLoopErrs <- err
+			}),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// trigger server to close connection
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		if err != nil && !errors.Is(err, connection.ErrConnectionClosed) {
+			require.NoError(t, err)
+		}
+
+		select {
+		case err := <-readLoopErrs:
+			require.ErrorIs(t, err, io.EOF)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("OnReadLoopExit was not called")
+		}
+
+		// write loop was stopped as connection was closed
+		select {
+		case err := <-writeLoopErrs:
+			require.NoError(t, err)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("OnWriteLoopExit was not called")
+		}
+
+		require.NoError(t, c.Close())
+		time.Sleep(50 * time.Millisecond)
+
+		require.Empty(t, readLoopErrs)
+		require.Empty(t, writeLoopErrs)
+	})
+
 	t.Run("ConnectionEstablishedHandler is called when connection is connected", func(t *testing.T) {
 		server, err := NewTestServer()
 		require.NoError(t, err)
@@ -925,24 +3431,187 @@ func TestConnection(t *testing.T) {
 		c.SetStatus(connection.StatusOnline)
 		require.Equal(t, connection.StatusOnline, c.Status())
 	})
+
+	t.Run("zero-length frames are skipped as keepalives", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		errs := make(chan error, 1)
+		received := make(chan *iso8583.Message, 1)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.ErrorHandler(func(err error) {
+				errs <- err
+			}),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				received <- message
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, "123456"))
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		go func() {
+			// two keepalives followed by the message
+			frames := []byte{0x00, 0x00, 0x00, 0x00, 0x00, byte(len(packed))}
+			serverConn.Write(append(frames, packed...))
+		}()
+
+		select {
+		case message := <-received:
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, "123456", stan)
+		case err := <-errs:
+			t.Fatalf("unexpected error: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("message was not received")
+		}
+
+		require.Zero(t, c.Stats().Errors)
+		require.Equal(t, uint64(1), c.Stats().Received)
+	})
+
+	t.Run("frames written at once are all read and matched", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(time.Second),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// server reads both requests and writes both responses with a
+		// single write
+		go func() {
+			var frames bytes.Buffer
+			for i := 0; i < 2; i++ {
+				length, err := readMessageLength(serverConn)
+				if err != nil {
+					return
+				}
+
+				packed := make([]byte, length)
+				if _, err := io.ReadFull(serverConn, packed); err != nil {
+					return
+				}
+
+				message := iso8583.NewMessage(testSpec)
+				if err := message.Unpack(packed); err != nil {
+					return
+				}
+				message.MTI("0810")
+
+				packed, err = message.Pack()
+				if err != nil {
+					return
+				}
+
+				writeMessageLength(&frames, len(packed))
+				frames.Write(packed)
+			}
+
+			serverConn.Write(frames.Bytes())
+		}()
+
+		stans := []string{getSTAN(), getSTAN()}
+
+		var wg sync.WaitGroup
+		for _, stan := range stans {
+			wg.Add(1)
+			go func(stan string) {
+				defer wg.Done()
+
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0800")
+				require.NoError(t, message.Field(11, stan))
+
+				response, err := c.Send(message)
+				require.NoError(t, err)
+
+				responseSTAN, err := response.GetString(11)
+				require.NoError(t, err)
+				require.Equal(t, stan, responseSTAN)
+			}(stan)
+		}
+		wg.Wait()
+
+		require.Equal(t, uint64(2), c.Stats().Matched)
+	})
+}
+
+type TrackingRWCloser struct {
+	Used bool
+
+	once   sync.Once
+	closed chan struct{}
 }
 
-type TrackingRWCloser struct{ Used bool }
+func (m *TrackingRWCloser) init() {
+	m.once.Do(func() {
+		m.closed = make(chan struct{})
+	})
+}
 
 func (m *TrackingRWCloser) Write(p []byte) (n int, err error) {
 	m.Used = true
-	return 0, nil
+	return len(p), nil
 }
+
+// Read blocks until closer is closed, so read loop doesn't spin
 func (m *TrackingRWCloser) Read(p []byte) (n int, err error) {
-	return 0, nil
+	m.init()
+	<-m.closed
+	return 0, io.EOF
 }
+
 func (m *TrackingRWCloser) Close() error {
+	m.init()
+	select {
+	case <-m.closed:
+	default:
+		close(m.closed)
+	}
 	return nil
 }
 
 // interface guard
 var _ io.ReadWriteCloser = (*TrackingRWCloser)(nil)
 
+// recordingConn counts writes that take writeDelay each. Read blocks until
+// conn is closed.
+type recordingConn struct {
+	TrackingRWCloser
+
+	writeDelay time.Duration
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (m *recordingConn) Write(p []byte) (int, error) {
+	time.Sleep(m.writeDelay)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes++
+
+	return len(p), nil
+}
+
+func (m *recordingConn) Writes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.writes
+}
+
 func TestClient_SetOptions(t *testing.T) {
 	c, err := connection.New("", testSpec, readMessageLength, writeMessageLength)
 	require.NoError(t, err)
@@ -970,15 +3639,22 @@ func BenchmarkSend10000(b *testing.B) { benchmarkSend(10000, b) }
 
 func BenchmarkSend100000(b *testing.B) { benchmarkSend(100000, b) }
 
-func benchmarkSend(m int, b *testing.B) {
-	server := server.New(testSpec, readMessageLength, writeMessageLength)
-	// start on random port
-	err := server.Start("127.0.0.1:")
+func BenchmarkInitialPendingCapacity(b *testing.B) {
+	b.Run("default", func(b *testing.B) { benchmarkSend(10000, b) })
+
+	b.Run("10000", func(b *testing.B) {
+		benchmarkSend(10000, b, connection.InitialPendingCapacity(10000))
+	})
+}
+
+func benchmarkSend(m int, b *testing.B, options ...connection.Option) {
+	// test server replies to the messages
+	server, err := NewTestServer()
 	if err != nil {
 		b.Fatal("starting server: ", err)
 	}
 
-	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, options...)
 	if err != nil {
 		b.Fatal("creating client: ", err)
 	}
@@ -1001,6 +3677,110 @@ func benchmarkSend(m int, b *testing.B) {
 	server.Close()
 }
 
+func BenchmarkReadBufferSize(b *testing.B) {
+	largeSpec := &iso8583.MessageSpec{
+		Fields: map[int]field.Field{
+			0:  testSpec.Fields[0],
+			1:  testSpec.Fields[1],
+			11: testSpec.Fields[11],
+			48: field.NewString(&field.Spec{
+				Length:      9999,
+				Description: "Additional Data",
+				Enc:         encoding.ASCII,
+				Pref:        prefix.ASCII.LLLL,
+			}),
+		},
+	}
+
+	message := iso8583.NewMessage(largeSpec)
+	message.MTI("0800")
+	message.Field(11, "000001")
+	message.Field(48, strings.Repeat("A", 8000))
+
+	packed, err := message.Pack()
+	if err != nil {
+		b.Fatal("packing message: ", err)
+	}
+
+	var frame bytes.Buffer
+	writeMessageLength(&frame, len(packed))
+	frame.Write(packed)
+
+	for _, size := range []int{4096, 65536} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			conn := &readCountingConn{r: bytes.NewReader(bytes.Repeat(frame.Bytes(), b.N))}
+
+			var wg sync.WaitGroup
+			wg.Add(b.N)
+
+			b.ResetTimer()
+
+			c, err := connection.NewFrom(conn, largeSpec, readMessageLength, writeMessageLength,
+				connection.ReadBufferSize(size),
+				connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+					wg.Done()
+				}),
+			)
+			if err != nil {
+				b.Fatal("creating client: ", err)
+			}
+			wg.Wait()
+
+			b.StopTimer()
+			b.ReportMetric(float64(conn.Reads())/float64(b.N), "reads/op")
+			c.Close()
+		})
+	}
+}
+
+// readCountingConn reads from r and counts the number of reads
+type readCountingConn struct {
+	r     io.Reader
+	mu    sync.Mutex
+	reads int
+}
+
+func (rc *readCountingConn) Read(p []byte) (int, error) {
+	rc.mu.Lock()
+	rc.reads++
+	rc.mu.Unlock()
+
+	return rc.r.Read(p)
+}
+
+func (rc *readCountingConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (rc *readCountingConn) Close() error {
+	return nil
+}
+
+func (rc *readCountingConn) Reads() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.reads
+}
+
+// chunkedWriteConn writes at most chunk bytes per Write call
+type chunkedWriteConn struct {
+	io.ReadWriteCloser
+	chunk int
+}
+
+func (cw *chunkedWriteConn) Write(p []byte) (int, error) {
+	if len(p) > cw.chunk {
+		p = p[:cw.chunk]
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	return cw.ReadWriteCloser.Write(p)
+}
+
 // send/receive m messages
 func processMessages(b *testing.B, m int, c *connection.Connection) {
 	var wg sync.WaitGroup
@@ -1015,6 +3795,8 @@ func processMessages(b *testing.B, m int, c *connection.Connection) {
 
 			message := iso8583.NewMessage(testSpec)
 			message.MTI("0800")
+			message.Field(2, TestCaseReply)
+			message.Field(11, getSTAN())
 
 			_, err := c.Send(message)
 			if err != nil {
@@ -1029,3 +3811,28 @@ func processMessages(b *testing.B, m int, c *connection.Connection) {
 		b.Fatal("sending message: ", gerr)
 	}
 }
+
+// noDelayConn is the network connection that records the values passed to
+// SetNoDelay
+type noDelayConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	noDelays []bool
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.noDelays = append(c.noDelays, noDelay)
+
+	return nil
+}
+
+func (c *noDelayConn) NoDelays() []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]bool(nil), c.noDelays...)
+}
@@ -0,0 +1,128 @@
+package connection
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// requestID returns ID of the request or response. It's STAN (field 11)
+// unless RequestIDFunc or CorrelationField is set. With STANDateCorrelation
+// it's STAN combined with the date of the transmission date & time (field 7).
+func (c *Connection) requestID(message *iso8583.Message) (string, error) {
+	if c.Opts.RequestIDFunc != nil {
+		return c.customRequestID(message)
+	}
+
+	if c.Opts.CorrelationField == 0 {
+		if c.Opts.STANDateCorrelation {
+			return stanDateRequestID(message)
+		}
+		return requestID(message)
+	}
+
+	if message == nil {
+		return "", fmt.Errorf("message required")
+	}
+
+	id, err := message.GetString(c.Opts.CorrelationField)
+	if err != nil {
+		return "", fmt.Errorf("getting correlation field %d: %w", c.Opts.CorrelationField, err)
+	}
+
+	if id == "" {
+		return "", fmt.Errorf("correlation field %d is missing", c.Opts.CorrelationField)
+	}
+
+	return id, nil
+}
+
+// stanDateRequestID returns STAN (field 11) followed by the date (MMDD) of
+// the transmission date & time (field 7) of the message
+func stanDateRequestID(message *iso8583.Message) (string, error) {
+	stan, err := requestID(message)
+	if err != nil {
+		return "", err
+	}
+
+	date, err := transmissionDate(message)
+	if err != nil {
+		return "", err
+	}
+
+	return stan + date, nil
+}
+
+// transmissionDate returns the date (MMDD) of the transmission date & time
+// (field 7) of the message. It's the first 4 characters of the field.
+func transmissionDate(message *iso8583.Message) (string, error) {
+	f, set := message.GetFields()[7]
+	if !set {
+		return "", errors.New("transmission date & time (field 7) is missing")
+	}
+
+	dateTime, err := f.String()
+	if err != nil {
+		return "", fmt.Errorf("getting transmission date & time (field 7): %w", err)
+	}
+
+	if len(dateTime) < 4 {
+		return "", fmt.Errorf("transmission date & time (field 7) %q has no date", dateTime)
+	}
+
+	return dateTime[:4], nil
+}
+
+// setCorrelationID sets the CorrelationField of the message to the new
+// UUID if it's not set yet
+func (c *Connection) setCorrelationID(message *iso8583.Message) error {
+	if _, set := message.GetFields()[c.Opts.CorrelationField]; set {
+		return nil
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return fmt.Errorf("generating correlation ID: %w", err)
+	}
+
+	if err := message.Field(c.Opts.CorrelationField, id); err != nil {
+		return fmt.Errorf("setting correlation field %d: %w", c.Opts.CorrelationField, err)
+	}
+
+	return nil
+}
+
+// newUUID returns random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// customRequestID returns the request ID of the message returned by the
+// RequestIDFunc. Its panic is recovered and returned as error.
+func (c *Connection) customRequestID(message *iso8583.Message) (string, error) {
+	var id string
+	var err error
+	if c.callback(func() { id, err = c.Opts.RequestIDFunc(message) }) {
+		return "", errors.New("request ID function panicked")
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if id == "" {
+		return "", errors.New("request ID is empty")
+	}
+
+	return id, nil
+}
@@ -0,0 +1,80 @@
+package connection
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+const (
+	// localTransactionTimeFormat is the format of the local transaction
+	// time (field 12): hhmmss
+	localTransactionTimeFormat = "150405"
+
+	// localTransactionDateFormat is the format of the local transaction
+	// date (field 13): MMDD
+	localTransactionDateFormat = "0102"
+)
+
+// Clock provides the current time and timers of the idle time (pings)
+// and read timeout to the connection. It may be replaced (e.g. in tests)
+// using SetClock option.
+type Clock interface {
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the
+	// current time on the returned channel, like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// transmissionDateTime formats the transmission date & time (field 7) using
+// the configured format and time zone. Layout elements of the default
+// format are zero-padded.
+func (c *Connection) transmissionDateTime(now time.Time) string {
+	return now.In(c.Opts.TransmissionDateTimeLocation).Format(c.Opts.TransmissionDateTimeFormat)
+}
+
+// setDateTimeFields sets transmission date & time (field 7), local
+// transaction time (field 12) and local transaction date (field 13) in the
+// configured location. Fields that are not defined in the spec or that were
+// already set are not changed.
+func (c *Connection) setDateTimeFields(message *iso8583.Message) error {
+	now := c.Opts.Clock.Now()
+	local := now.In(c.Opts.LocalTimeLocation)
+
+	values := map[int]string{
+		7:  c.transmissionDateTime(now),
+		12: local.Format(localTransactionTimeFormat),
+		13: local.Format(localTransactionDateFormat),
+	}
+
+	spec := message.GetSpec()
+	fields := message.GetFields()
+
+	for id, value := range values {
+		if _, defined := spec.Fields[id]; !defined {
+			continue
+		}
+
+		if _, set := fields[id]; set {
+			continue
+		}
+
+		if err := message.Field(id, value); err != nil {
+			return fmt.Errorf("setting field %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
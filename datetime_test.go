@@ -0,0 +1,158 @@
+package connection_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_AutoDateTimeFields(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	// UTC-5
+	loc := time.FixedZone("EST", -5*60*60)
+	clock := &testClock{}
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SetClock(clock),
+		connection.AutoDateTimeFields(loc),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	newMessage := func() *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+		return message
+	}
+
+	t.Run("sets fields 7, 12 and 13 across the day boundary", func(t *testing.T) {
+		// the last second of Dec 31 in local time zone
+		clock.Set(time.Date(2023, time.December, 31, 23, 59, 59, 0, loc))
+
+		message := newMessage()
+		_, err := c.Send(message)
+		require.NoError(t, err)
+
+		requireFields(t, message, map[int]string{
+			7:  "0101045959",
+			12: "235959",
+			13: "1231",
+		})
+
+		// the first second of the next day
+		clock.Set(time.Date(2024, time.January, 1, 0, 0, 0, 0, loc))
+
+		message = newMessage()
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		requireFields(t, message, map[int]string{
+			7:  "0101050000",
+			12: "000000",
+			13: "0101",
+		})
+	})
+
+	t.Run("preserves fields set by the caller", func(t *testing.T) {
+		clock.Set(time.Date(2024, time.March, 5, 8, 15, 0, 0, loc))
+
+		message := newMessage()
+		require.NoError(t, message.Field(7, "1231235959"))
+		require.NoError(t, message.Field(13, "1231"))
+
+		_, err := c.Send(message)
+		require.NoError(t, err)
+
+		requireFields(t, message, map[int]string{
+			7:  "1231235959",
+			12: "081500",
+			13: "1231",
+		})
+	})
+}
+
+func requireFields(t *testing.T, message *iso8583.Message, expected map[int]string) {
+	t.Helper()
+
+	for id, value := range expected {
+		actual, err := message.GetString(id)
+		require.NoError(t, err)
+		require.Equal(t, value, actual, "field %d", id)
+	}
+}
+
+func TestConnection_TransmissionDateTime(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	send := func(t *testing.T, now time.Time, options ...connection.Option) string {
+		t.Helper()
+
+		clock := &testClock{}
+		clock.Set(now)
+
+		options = append(options, connection.SetClock(clock), connection.AutoDateTimeFields(time.UTC))
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		value, err := message.GetString(7)
+		require.NoError(t, err)
+
+		return value
+	}
+
+	t.Run("default format is zero-padded MMDDhhmmss in GMT", func(t *testing.T) {
+		// UTC+3, so local midnight of Jan 1 is Dec 31 in GMT
+		loc := time.FixedZone("MSK", 3*60*60)
+
+		tests := []struct {
+			name     string
+			now      time.Time
+			expected string
+		}{
+			{"Jan 1 midnight", time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), "0101000000"},
+			{"Dec 31 last second", time.Date(2023, time.December, 31, 23, 59, 59, 0, time.UTC), "1231235959"},
+			{"single digit values", time.Date(2024, time.March, 5, 8, 7, 6, 0, time.UTC), "0305080706"},
+			{"local time is converted to GMT", time.Date(2024, time.January, 1, 0, 0, 0, 0, loc), "1231210000"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				require.Equal(t, tt.expected, send(t, tt.now))
+			})
+		}
+	})
+
+	t.Run("format and time zone can be configured", func(t *testing.T) {
+		loc := time.FixedZone("EST", -5*60*60)
+		now := time.Date(2024, time.January, 1, 3, 4, 5, 0, time.UTC)
+
+		value := send(t, now, connection.TransmissionDateTime("0102150405", loc))
+		require.Equal(t, "1231220405", value)
+	})
+
+	t.Run("format is required", func(t *testing.T) {
+		_, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.TransmissionDateTime("", nil),
+		)
+		require.Error(t, err)
+	})
+}
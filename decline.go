@@ -0,0 +1,86 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// DefaultResponseCodeField is the field of the response code
+const DefaultResponseCodeField = 39
+
+// DeclineError is returned by Send when response code (ResponseCodeField)
+// of the received response is not approved. It's returned only when
+// ApprovedResponseCodes or DeclinedResponseCodes option is set.
+type DeclineError struct {
+	// ResponseCode is the response code (ResponseCodeField) of the response
+	ResponseCode string
+
+	// Message is the received response
+	Message *iso8583.Message
+}
+
+func (e *DeclineError) Error() string {
+	return fmt.Sprintf("request was declined with response code: %s", e.ResponseCode)
+}
+
+// IsApproved returns true if response code (ResponseCodeField) of the
+// message is approved. Response code is approved when it's not in the
+// DeclinedResponseCodes and it's in the ApprovedResponseCodes (if set). When
+// none of the options is set, only "00" response code is approved.
+func (c *Connection) IsApproved(message *iso8583.Message) bool {
+	code := c.responseCode(message)
+
+	for _, declined := range c.Opts.DeclinedResponseCodes {
+		if code == declined {
+			return false
+		}
+	}
+
+	if len(c.Opts.ApprovedResponseCodes) == 0 {
+		return len(c.Opts.DeclinedResponseCodes) > 0 || code == approvedResponseCode
+	}
+
+	for _, approved := range c.Opts.ApprovedResponseCodes {
+		if code == approved {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkResponseCode returns *DeclineError if response is not approved
+func (c *Connection) checkResponseCode(response *iso8583.Message) error {
+	if c.IsApproved(response) {
+		return nil
+	}
+
+	return &DeclineError{
+		ResponseCode: c.responseCode(response),
+		Message:      response,
+	}
+}
+
+// declineCheckEnabled returns true if Send should check response code of
+// the responses
+func (c *Connection) declineCheckEnabled() bool {
+	return len(c.Opts.ApprovedResponseCodes) > 0 || len(c.Opts.DeclinedResponseCodes) > 0
+}
+
+// responseCode returns response code (ResponseCodeField) of the message or
+// empty string if it's not set
+func (c *Connection) responseCode(message *iso8583.Message) string {
+	field := c.Opts.ResponseCodeField
+	if field == 0 {
+		field = DefaultResponseCodeField
+	}
+
+	if _, set := message.GetFields()[field]; !set {
+		return ""
+	}
+
+	code, _ := message.GetString(field)
+
+	return code
+}
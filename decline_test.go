@@ -0,0 +1,147 @@
+package connection_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583/encoding"
+	"github.com/moov-io/iso8583/field"
+	"github.com/moov-io/iso8583/prefix"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_DeclineError(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	// test server echoes the message back, so response code of the
+	// response is the same as of the request
+	newMessage := func(t *testing.T, responseCode string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, TestCaseReply))
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(39, responseCode))
+
+		return message
+	}
+
+	t.Run("returns no error for approved response", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.ApprovedResponseCodes("00", "10"),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		for _, code := range []string{"00", "10"} {
+			response, err := c.Send(newMessage(t, code))
+			require.NoError(t, err)
+			require.True(t, c.IsApproved(response))
+		}
+	})
+
+	t.Run("returns DeclineError for not approved response", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.ApprovedResponseCodes("00"),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		response, err := c.Send(newMessage(t, "05"))
+		require.NotNil(t, response)
+
+		var declineErr *connection.DeclineError
+		require.True(t, errors.As(err, &declineErr))
+		require.Equal(t, "05", declineErr.ResponseCode)
+		require.Equal(t, response, declineErr.Message)
+		require.EqualError(t, err, "request was declined with response code: 05")
+	})
+
+	t.Run("returns DeclineError only for declined response codes", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.DeclinedResponseCodes("05", "51"),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		_, err = c.Send(newMessage(t, "85"))
+		require.NoError(t, err)
+
+		_, err = c.Send(newMessage(t, "51"))
+		var declineErr *connection.DeclineError
+		require.True(t, errors.As(err, &declineErr))
+		require.Equal(t, "51", declineErr.ResponseCode)
+	})
+
+	t.Run("does not check response code by default", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		response, err := c.Send(newMessage(t, "05"))
+		require.NoError(t, err)
+		require.False(t, c.IsApproved(response))
+	})
+
+	t.Run("ResponseCodeField sets the field of the response code", func(t *testing.T) {
+		// spec with response code in field 44
+		fields := make(map[int]field.Field)
+		for id, f := range testSpec.Fields {
+			fields[id] = f
+		}
+		fields[44] = field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		})
+		spec := &iso8583.MessageSpec{
+			Name:   "spec with response code in field 44",
+			Fields: fields,
+		}
+
+		clientConn, serverConn := net.Pipe()
+
+		echo, err := connection.NewFrom(serverConn, spec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		defer echo.Close()
+
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+			connection.ResponseCodeField(44),
+			connection.ApprovedResponseCodes("00"),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		newMessage := func(t *testing.T, responseCode string) *iso8583.Message {
+			message := iso8583.NewMessage(spec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(11, getSTAN()))
+			require.NoError(t, message.Field(44, responseCode))
+
+			return message
+		}
+
+		response, err := c.Send(newMessage(t, "00"))
+		require.NoError(t, err)
+		require.True(t, c.IsApproved(response))
+
+		_, err = c.Send(newMessage(t, "05"))
+		var declineErr *connection.DeclineError
+		require.True(t, errors.As(err, &declineErr))
+		require.Equal(t, "05", declineErr.ResponseCode)
+	})
+}
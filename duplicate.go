@@ -0,0 +1,78 @@
+package connection
+
+import "time"
+
+// DuplicatePolicy defines how responses to the requests that were already
+// answered are handled
+type DuplicatePolicy int
+
+const (
+	// DuplicateUnmatched passes duplicate responses to the OnUnmatched and
+	// InboundMessageHandler like any other unmatched response (default)
+	DuplicateUnmatched DuplicatePolicy = iota
+
+	// DuplicateDrop silently drops responses to the requests that were
+	// answered within the SendTimeout, e.g. responses retransmitted by
+	// the host
+	DuplicateDrop
+)
+
+// lateResponseWindow is how long timed out requests are tracked to report
+// their late responses
+const lateResponseWindow = time.Minute
+
+// answeredRequest is the ID of the request that got its response
+type answeredRequest struct {
+	id string
+	at time.Time
+}
+
+// answeredRequests tracks the requests answered within the window, so
+// duplicate responses can be detected. It's protected by the
+// pendingRequestsMu.
+type answeredRequests struct {
+	at map[string]time.Time
+
+	// in the order of answers, to prune the old ones
+	order []answeredRequest
+}
+
+// add records that the request got its response
+func (a *answeredRequests) add(id string, now time.Time, window time.Duration) {
+	a.prune(now, window)
+
+	if a.at == nil {
+		a.at = make(map[string]time.Time)
+	}
+
+	a.at[id] = now
+	a.order = append(a.order, answeredRequest{id: id, at: now})
+}
+
+// answered returns true if the request got its response within the window
+func (a *answeredRequests) answered(id string, now time.Time, window time.Duration) bool {
+	_, found := a.answeredAt(id, now, window)
+
+	return found
+}
+
+// answeredAt returns the time the request got its response if it was
+// within the window
+func (a *answeredRequests) answeredAt(id string, now time.Time, window time.Duration) (time.Time, bool) {
+	a.prune(now, window)
+
+	at, found := a.at[id]
+
+	return at, found
+}
+
+func (a *answeredRequests) prune(now time.Time, window time.Duration) {
+	var i int
+	for ; i < len(a.order) && now.Sub(a.order[i].at) > window; i++ {
+		// request may be answered again later
+		if a.at[a.order[i].id].Equal(a.order[i].at) {
+			delete(a.at, a.order[i].id)
+		}
+	}
+	a.order = a.order[i:]
+}
@@ -0,0 +1,38 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// ExtractFields returns string values of the fields of the message, e.g.
+// authorization code (field 38), response code (field 39) and RRN (field
+// 37) of the response. Fields that are not set in the message are not
+// included in the returned map. It returns error if value of the set field
+// can't be read.
+func ExtractFields(message *iso8583.Message, fields ...int) (map[int]string, error) {
+	if message == nil {
+		return nil, errors.New("message is required")
+	}
+
+	set := message.GetFields()
+	values := make(map[int]string, len(fields))
+
+	for _, id := range fields {
+		f, ok := set[id]
+		if !ok {
+			continue
+		}
+
+		value, err := f.String()
+		if err != nil {
+			return nil, fmt.Errorf("getting field %d: %w", id, err)
+		}
+
+		values[id] = value
+	}
+
+	return values, nil
+}
@@ -0,0 +1,42 @@
+package connection_test
+
+import (
+	"testing"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractFields(t *testing.T) {
+	t.Run("returns values of the set fields", func(t *testing.T) {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0810")
+		require.NoError(t, message.Field(11, "000123"))
+		require.NoError(t, message.Field(39, "00"))
+
+		values, err := connection.ExtractFields(message, 11, 39)
+		require.NoError(t, err)
+		require.Equal(t, map[int]string{11: "000123", 39: "00"}, values)
+	})
+
+	t.Run("skips fields that are not set", func(t *testing.T) {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0810")
+		require.NoError(t, message.Field(39, "05"))
+
+		// field 63 is not set and field 38 is not defined in the spec
+		values, err := connection.ExtractFields(message, 38, 39, 63)
+		require.NoError(t, err)
+		require.Equal(t, map[int]string{39: "05"}, values)
+
+		// extracting fields doesn't set them
+		_, set := message.GetFields()[63]
+		require.False(t, set)
+	})
+
+	t.Run("returns error for nil message", func(t *testing.T) {
+		_, err := connection.ExtractFields(nil, 39)
+		require.Error(t, err)
+	})
+}
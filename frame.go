@@ -0,0 +1,72 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/moov-io/iso8583"
+)
+
+// DecodeFrame decodes the first frame of raw (e.g. captured bytes of the
+// stream) without a connection: it reads message length with the Reader of
+// the header and unpacks the message that follows it with the spec. It
+// returns the message and the number of bytes of raw it consumed (header
+// and message), so raw[n:] holds the next frame. For zero-length frames
+// (keepalives) returned message is nil. It returns error wrapping
+// io.ErrUnexpectedEOF if raw doesn't hold the whole frame.
+func DecodeFrame(spec *iso8583.MessageSpec, header Header, raw []byte) (*iso8583.Message, int, error) {
+	if header.Reader == nil {
+		return nil, 0, errors.New("header reader is required")
+	}
+
+	r := bytes.NewReader(raw)
+
+	length, err := header.Reader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	headerSize := len(raw) - r.Len()
+
+	if length < 0 {
+		return nil, 0, fmt.Errorf("negative message length %d", length)
+	}
+
+	if length > r.Len() {
+		return nil, 0, fmt.Errorf("reading message of length %d: %w: %d bytes left", length, io.ErrUnexpectedEOF, r.Len())
+	}
+
+	if length == 0 {
+		return nil, headerSize, nil
+	}
+
+	message := iso8583.NewMessage(spec)
+	if err := message.Unpack(raw[headerSize : headerSize+length]); err != nil {
+		return nil, 0, fmt.Errorf("unpacking message: %w", err)
+	}
+
+	return message, headerSize + length, nil
+}
+
+// EncodeFrame returns the frame of the packed message without a connection:
+// header written by the Writer of the header followed by the packed
+// message, as connection writes it when it's created with the same header
+// (connection options like LengthIncludesHeader and FrameChecksum are not
+// applied). Use it to build frames for tests or offline tools.
+func EncodeFrame(header Header, packed []byte) ([]byte, error) {
+	if header.Writer == nil {
+		return nil, errors.New("header writer is required")
+	}
+
+	var buf bytes.Buffer
+
+	if _, err := header.Writer(&buf, len(packed)); err != nil {
+		return nil, fmt.Errorf("writing message header to buffer: %w", err)
+	}
+
+	buf.Write(packed)
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,117 @@
+package connection_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeFrame(t *testing.T) {
+	header := connection.LengthHeader(readMessageLength, writeMessageLength)
+
+	newPacked := func(t *testing.T, stan string) []byte {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, stan))
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		return packed
+	}
+
+	// captured stream of two messages and the keepalive between them
+	var stream bytes.Buffer
+	for _, packed := range [][]byte{newPacked(t, "000001"), {}, newPacked(t, "000002")} {
+		_, err := writeMessageLength(&stream, len(packed))
+		require.NoError(t, err)
+		stream.Write(packed)
+	}
+	raw := stream.Bytes()
+
+	message, n, err := connection.DecodeFrame(testSpec, header, raw)
+	require.NoError(t, err)
+	stan, err := message.GetString(11)
+	require.NoError(t, err)
+	require.Equal(t, "000001", stan)
+	raw = raw[n:]
+
+	// keepalive
+	message, n, err = connection.DecodeFrame(testSpec, header, raw)
+	require.NoError(t, err)
+	require.Nil(t, message)
+	require.Equal(t, 2, n)
+	raw = raw[n:]
+
+	message, n, err = connection.DecodeFrame(testSpec, header, raw)
+	require.NoError(t, err)
+	stan, err = message.GetString(11)
+	require.NoError(t, err)
+	require.Equal(t, "000002", stan)
+	require.Equal(t, len(raw), n)
+
+	t.Run("truncated frame", func(t *testing.T) {
+		_, _, err := connection.DecodeFrame(testSpec, header, raw[:len(raw)-1])
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("ASCII header", func(t *testing.T) {
+		packed := newPacked(t, "000003")
+		raw := append([]byte(fmt.Sprintf("%04d", len(packed))), packed...)
+
+		message, n, err := connection.DecodeFrame(testSpec, connection.ASCIILengthHeader(4), raw)
+		require.NoError(t, err)
+		require.Equal(t, len(raw), n)
+
+		stan, err := message.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, "000003", stan)
+	})
+}
+
+func TestEncodeFrame(t *testing.T) {
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, "000001"))
+
+	packed, err := message.Pack()
+	require.NoError(t, err)
+
+	for name, header := range map[string]connection.Header{
+		"binary header": connection.LengthHeader(readMessageLength, writeMessageLength),
+		"ASCII header":  connection.ASCIILengthHeader(4),
+		"composite header": connection.CompositeHeader(
+			connection.FixedPrefixHeader([]byte("ISO")),
+			connection.ASCIILengthHeader(4),
+		),
+	} {
+		t.Run(name, func(t *testing.T) {
+			raw, err := connection.EncodeFrame(header, packed)
+			require.NoError(t, err)
+
+			decoded, n, err := connection.DecodeFrame(testSpec, header, raw)
+			require.NoError(t, err)
+			require.Equal(t, len(raw), n)
+
+			repacked, err := decoded.Pack()
+			require.NoError(t, err)
+			require.Equal(t, packed, repacked)
+		})
+	}
+
+	t.Run("frame is written like connection writes it", func(t *testing.T) {
+		raw, err := connection.EncodeFrame(connection.ASCIILengthHeader(4), packed)
+		require.NoError(t, err)
+		require.Equal(t, append([]byte(fmt.Sprintf("%04d", len(packed))), packed...), raw)
+	})
+
+	t.Run("header writer errors are returned", func(t *testing.T) {
+		_, err := connection.EncodeFrame(connection.ASCIILengthHeader(1), packed)
+		require.ErrorContains(t, err, "exceeds 1 digits")
+	})
+}
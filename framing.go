@@ -0,0 +1,151 @@
+package connection
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583/encoding"
+)
+
+// framingProbeLength is the message length the sample header of the
+// FramingInfo is written for
+const framingProbeLength = 100
+
+// FramingInfo describes how messages are framed on the wire. It's derived
+// from the configured options and is meant for diagnostics, e.g. to confirm
+// that both sides of the link use the same framing.
+type FramingInfo struct {
+	// HeaderSize is the size of the message length header written by the
+	// connection's MessageLengthWriter. It's -1 if writer failed.
+	HeaderSize int
+
+	// HeaderSample is the header written for the message of 100 bytes,
+	// e.g. 0x0064 for the 2 bytes binary header or "0100" for the 4
+	// digits ASCII header
+	HeaderSample []byte
+
+	// LengthIncludesHeader is true when length in the header is the size
+	// of the whole frame rather than the size of the message only
+	LengthIncludesHeader bool
+
+	// MixedHeaders is true when HeaderSelector picks the header of each
+	// received message
+	MixedHeaders bool
+
+	// TrailerSize is the number of bytes (e.g. checksum) that follow each
+	// message and are not counted in the header
+	TrailerSize int
+
+	// Checksum is true when FrameChecksum is written after each sent
+	// message
+	Checksum bool
+
+	// Spec is the name of the spec messages are packed with. It's empty
+	// when connection has no spec.
+	Spec string
+
+	// Codec is the encoding of the MTI of the spec (e.g. ASCII or BCD).
+	// It's "unknown" when connection has no spec.
+	Codec string
+}
+
+// String returns the one-line description of the framing
+func (f FramingInfo) String() string {
+	var b strings.Builder
+
+	if f.HeaderSize < 0 {
+		b.WriteString("header: unknown")
+	} else {
+		fmt.Fprintf(&b, "header: %d bytes (%x for 100 bytes)", f.HeaderSize, f.HeaderSample)
+	}
+
+	if f.MixedHeaders {
+		b.WriteString(", mixed headers")
+	}
+
+	if f.LengthIncludesHeader {
+		b.WriteString(", length: header and message")
+	} else {
+		b.WriteString(", length: message")
+	}
+
+	switch {
+	case f.TrailerSize > 0 && f.Checksum:
+		fmt.Fprintf(&b, ", trailer: %d bytes checksum", f.TrailerSize)
+	case f.TrailerSize > 0:
+		fmt.Fprintf(&b, ", trailer: %d bytes", f.TrailerSize)
+	default:
+		b.WriteString(", trailer: none")
+	}
+
+	fmt.Fprintf(&b, ", spec: %q, codec: %s", f.Spec, f.Codec)
+
+	return b.String()
+}
+
+// FramingInfo returns the description of the framing the messages are
+// sent and received with
+func (c *Connection) FramingInfo() FramingInfo {
+	c.mutex.Lock()
+	spec := c.spec
+	c.mutex.Unlock()
+
+	info := FramingInfo{
+		HeaderSize:           -1,
+		LengthIncludesHeader: c.Opts.LengthIncludesHeader,
+		MixedHeaders:         c.Opts.HeaderSelector != nil,
+		TrailerSize:          c.trailerSize(nil),
+		Checksum:             c.Opts.FrameChecksum != nil,
+		Codec:                specCodec(spec),
+	}
+
+	if spec != nil {
+		info.Spec = spec.Name
+	}
+
+	length := framingProbeLength
+	if c.Opts.LengthIncludesHeader {
+		if n, err := c.writeMessageLength(&bytes.Buffer{}, length); err == nil {
+			length += n
+		}
+	}
+
+	var header bytes.Buffer
+	if n, err := c.writeMessageLength(&header, length); err == nil {
+		info.HeaderSize = n
+		info.HeaderSample = header.Bytes()
+	}
+
+	return info
+}
+
+// specCodec returns the name of the encoding of the MTI of the spec
+func specCodec(spec *iso8583.MessageSpec) string {
+	if spec == nil {
+		return "unknown"
+	}
+
+	mti, ok := spec.Fields[0]
+	if !ok || mti.Spec() == nil {
+		return "unknown"
+	}
+
+	switch mti.Spec().Enc {
+	case encoding.ASCII:
+		return "ASCII"
+	case encoding.BCD:
+		return "BCD"
+	case encoding.LBCD:
+		return "LBCD"
+	case encoding.EBCDIC:
+		return "EBCDIC"
+	case encoding.EBCDIC1047:
+		return "EBCDIC1047"
+	case encoding.Binary:
+		return "binary"
+	}
+
+	return fmt.Sprintf("%T", mti.Spec().Enc)
+}
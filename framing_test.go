@@ -0,0 +1,60 @@
+package connection_test
+
+import (
+	"testing"
+
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_FramingInfo(t *testing.T) {
+	t.Run("binary header", func(t *testing.T) {
+		c, err := connection.New("", testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		info := c.FramingInfo()
+		require.Equal(t, connection.FramingInfo{
+			HeaderSize:   2,
+			HeaderSample: []byte{0x00, 0x64},
+			Spec:         testSpec.Name,
+			Codec:        "ASCII",
+		}, info)
+		require.Equal(t, `header: 2 bytes (0064 for 100 bytes), length: message, trailer: none, spec: "ISO 8583 v1987 ASCII", codec: ASCII`, info.String())
+	})
+
+	t.Run("ASCII header with length of the frame and checksum", func(t *testing.T) {
+		header := connection.ASCIILengthHeader(4)
+		lrc := func(packed []byte) []byte {
+			var sum byte
+			for _, b := range packed {
+				sum ^= b
+			}
+			return []byte{sum}
+		}
+
+		c, err := connection.New("", testSpec, header.Reader, header.Writer,
+			connection.LengthIncludesHeader(),
+			connection.FrameChecksum(lrc, nil),
+		)
+		require.NoError(t, err)
+
+		info := c.FramingInfo()
+		require.Equal(t, 4, info.HeaderSize)
+		require.Equal(t, []byte("0104"), info.HeaderSample)
+		require.True(t, info.LengthIncludesHeader)
+		require.True(t, info.Checksum)
+		require.Equal(t, 1, info.TrailerSize)
+		require.Equal(t, `header: 4 bytes (30313034 for 100 bytes), length: header and message, trailer: 1 bytes checksum, spec: "ISO 8583 v1987 ASCII", codec: ASCII`, info.String())
+	})
+
+	t.Run("connection without spec", func(t *testing.T) {
+		c, err := connection.New("", nil, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		info := c.FramingInfo()
+		require.Empty(t, info.Spec)
+		require.Equal(t, "unknown", info.Codec)
+		require.Equal(t, 2, info.HeaderSize)
+		require.Equal(t, `header: 2 bytes (0064 for 100 bytes), length: message, trailer: none, spec: "", codec: unknown`, info.String())
+	})
+}
@@ -74,12 +74,42 @@ var testSpec *iso8583.MessageSpec = &iso8583.MessageSpec{
 			Enc:         encoding.ASCII,
 			Pref:        prefix.ASCII.Fixed,
 		}),
+		12: field.NewString(&field.Spec{
+			Length:      6,
+			Description: "Local Transaction Time",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		13: field.NewString(&field.Spec{
+			Length:      4,
+			Description: "Local Transaction Date",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		62: field.NewString(&field.Spec{
+			Length:      36,
+			Description: "Correlation ID",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LLL,
+		}),
 		63: field.NewString(&field.Spec{
 			Length:      5,
 			Description: "Extra field",
 			Enc:         encoding.ASCII,
 			Pref:        prefix.ASCII.Fixed,
 		}),
+		70: field.NewString(&field.Spec{
+			Length:      3,
+			Description: "Network Management Information Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
 	},
 }
 
@@ -210,3 +240,66 @@ func NewTestServer() (*testServer, error) {
 func (t *testServer) Close() {
 	t.Server.Close()
 }
+
+// testClock is a Clock that returns time set by the test. Its timers fire
+// only when the test advances the time.
+type testClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, clockWaiter{at: c.now.Add(d), ch: ch})
+
+	return ch
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+}
+
+// Advance moves the time forward by d and fires the timers that are due
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	var waiters []clockWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// Waiters returns the number of timers that have not fired yet
+func (c *testClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
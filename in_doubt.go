@@ -0,0 +1,97 @@
+package connection
+
+import (
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// inDoubtRequest is the request that timed out, so it's not known whether
+// the host processed it
+type inDoubtRequest struct {
+	message    *iso8583.Message
+	timedOutAt time.Time
+}
+
+// inDoubtRequests tracks the requests that timed out within the
+// InDoubtWindow. It's protected by the pendingRequestsMu.
+type inDoubtRequests struct {
+	requests map[string]inDoubtRequest
+
+	// in the order of timeouts, to prune the old ones
+	order []answeredRequest
+}
+
+// add records that the request timed out
+func (d *inDoubtRequests) add(id string, message *iso8583.Message, now time.Time, window time.Duration) {
+	d.prune(now, window)
+
+	if d.requests == nil {
+		d.requests = make(map[string]inDoubtRequest)
+	}
+
+	// caller may reuse the message after Send returns
+	if clone, err := message.Clone(); err == nil {
+		message = clone
+	}
+
+	d.requests[id] = inDoubtRequest{message: message, timedOutAt: now}
+	d.order = append(d.order, answeredRequest{id: id, at: now})
+}
+
+// remove removes the request when its late response was received. It
+// returns the time the request timed out if it was in doubt.
+func (d *inDoubtRequests) remove(id string, now time.Time, window time.Duration) (time.Time, bool) {
+	d.prune(now, window)
+
+	req, found := d.requests[id]
+	if !found {
+		return time.Time{}, false
+	}
+	delete(d.requests, id)
+
+	return req.timedOutAt, true
+}
+
+// messages returns the messages of the requests in doubt in the order they
+// timed out
+func (d *inDoubtRequests) messages(now time.Time, window time.Duration) []*iso8583.Message {
+	d.prune(now, window)
+
+	var messages []*iso8583.Message
+	for _, o := range d.order {
+		// request was removed or timed out again later
+		if req, found := d.requests[o.id]; found && req.timedOutAt.Equal(o.at) {
+			messages = append(messages, req.message)
+		}
+	}
+
+	return messages
+}
+
+func (d *inDoubtRequests) prune(now time.Time, window time.Duration) {
+	var i int
+	for ; i < len(d.order) && now.Sub(d.order[i].at) > window; i++ {
+		// request may time out again later
+		if req, found := d.requests[d.order[i].id]; found && req.timedOutAt.Equal(d.order[i].at) {
+			delete(d.requests, d.order[i].id)
+		}
+	}
+	d.order = d.order[i:]
+}
+
+// InDoubtRequests returns the messages of the requests that timed out
+// within the InDoubtWindow and didn't get late responses since then, in
+// the order they timed out. As it's not known whether the host processed
+// them, they should be reconciled (e.g. at the end of day). It returns
+// nil if InDoubtWindow is not set.
+func (c *Connection) InDoubtRequests() []*iso8583.Message {
+	if c.Opts.InDoubtWindow <= 0 {
+		return nil
+	}
+
+	c.pendingRequestsMu.Lock()
+	defer c.pendingRequestsMu.Unlock()
+
+	return c.inDoubt.messages(c.Opts.Clock.Now(), c.Opts.InDoubtWindow)
+}
@@ -0,0 +1,121 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_InDoubtRequests(t *testing.T) {
+	// connect returns client of the server that replies to the
+	// TestCaseDelayedResponse requests when release is closed and doesn't
+	// reply to other requests
+	connect := func(t *testing.T, release chan struct{}, options ...connection.Option) *connection.Connection {
+		clientConn, serverConn := net.Pipe()
+
+		srv, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				code, _ := message.GetString(2)
+				if code != TestCaseDelayedResponse {
+					return
+				}
+
+				<-release
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { srv.Close() })
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		return c
+	}
+
+	send := func(t *testing.T, c *connection.Connection, code string) string {
+		stan := getSTAN()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, stan))
+
+		_, err := c.Send(message)
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		return stan
+	}
+
+	inDoubtSTANs := func(t *testing.T, c *connection.Connection) []string {
+		var stans []string
+		for _, message := range c.InDoubtRequests() {
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+			stans = append(stans, stan)
+		}
+
+		return stans
+	}
+
+	t.Run("late response removes the request in doubt", func(t *testing.T) {
+		release := make(chan struct{})
+		lateResponses := make(chan string, 1)
+
+		c := connect(t, release,
+			connection.SendTimeout(50*time.Millisecond),
+			connection.InDoubtWindow(time.Minute),
+			connection.OnLateResponse(func(c *connection.Connection, message *iso8583.Message, late time.Duration) {
+				stan, _ := message.GetString(11)
+				lateResponses <- stan
+			}),
+		)
+
+		require.Empty(t, c.InDoubtRequests())
+
+		delayedSTAN := send(t, c, TestCaseDelayedResponse)
+		unansweredSTAN := send(t, c, TestCaseReply)
+
+		require.Equal(t, []string{delayedSTAN, unansweredSTAN}, inDoubtSTANs(t, c))
+
+		close(release)
+
+		select {
+		case stan := <-lateResponses:
+			require.Equal(t, delayedSTAN, stan)
+		case <-time.After(time.Second):
+			t.Fatal("OnLateResponse was not called")
+		}
+
+		require.Equal(t, []string{unansweredSTAN}, inDoubtSTANs(t, c))
+	})
+
+	t.Run("requests are kept in doubt no longer than the window", func(t *testing.T) {
+		c := connect(t, make(chan struct{}),
+			connection.SendTimeout(50*time.Millisecond),
+			connection.InDoubtWindow(100*time.Millisecond),
+		)
+
+		send(t, c, TestCaseReply)
+		require.Len(t, c.InDoubtRequests(), 1)
+
+		require.Eventually(t, func() bool {
+			return len(c.InDoubtRequests()) == 0
+		}, time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("requests are not tracked without the window", func(t *testing.T) {
+		c := connect(t, make(chan struct{}),
+			connection.SendTimeout(50*time.Millisecond),
+		)
+
+		send(t, c, TestCaseReply)
+		require.Nil(t, c.InDoubtRequests())
+	})
+}
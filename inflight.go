@@ -0,0 +1,71 @@
+package connection
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// inflightBytes tracks the total size of the packed messages of the
+// requests that are being sent (see MaxInflightBytes)
+type inflightBytes struct {
+	mu   sync.Mutex
+	size int
+
+	// closed and replaced when bytes are released to wake up waiting
+	// requests
+	releasedCh chan struct{}
+}
+
+// acquire adds size of the message to the in-flight bytes. If max would be
+// exceeded, it waits until other requests release their bytes or timeout
+// passes. With failFast it returns ErrInflightBytesExceeded right away.
+func (b *inflightBytes) acquire(size, max int, failFast bool, timeout <-chan time.Time) error {
+	if size > max {
+		return fmt.Errorf("%w: packed message size %d exceeds max in-flight bytes %d", ErrMessageTooLarge, size, max)
+	}
+
+	for {
+		b.mu.Lock()
+		if b.size+size <= max {
+			b.size += size
+			b.mu.Unlock()
+			return nil
+		}
+		if b.releasedCh == nil {
+			b.releasedCh = make(chan struct{})
+		}
+		releasedCh := b.releasedCh
+		b.mu.Unlock()
+
+		if failFast {
+			return ErrInflightBytesExceeded
+		}
+
+		select {
+		case <-releasedCh:
+		case <-timeout:
+			return ErrInflightBytesExceeded
+		}
+	}
+}
+
+// release removes size of the message from the in-flight bytes
+func (b *inflightBytes) release(size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.size -= size
+	if b.releasedCh != nil {
+		close(b.releasedCh)
+		b.releasedCh = nil
+	}
+}
+
+// load returns the current in-flight bytes
+func (b *inflightBytes) load() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size
+}
@@ -0,0 +1,87 @@
+package connection_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_MaxInflightBytes(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	newMessage := func(t *testing.T, code, data string) (*iso8583.Message, int) {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, getSTAN()))
+		if data != "" {
+			require.NoError(t, message.Field(62, data))
+		}
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		return message, len(packed)
+	}
+
+	_, largeSize := newMessage(t, TestCaseDelayedResponse, strings.Repeat("X", 36))
+	_, smallSize := newMessage(t, TestCaseDelayedResponse, "")
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(2*time.Second),
+		connection.MaxInflightBytes(largeSize+smallSize),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	// large and small delayed requests fit into the limit
+	sendErrs := make(chan error, 2)
+	for _, data := range []string{strings.Repeat("X", 36), ""} {
+		message, _ := newMessage(t, TestCaseDelayedResponse, data)
+		go func() {
+			_, err := c.Send(message)
+			sendErrs <- err
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return c.Stats().InflightBytes == largeSize+smallSize
+	}, time.Second, 10*time.Millisecond)
+
+	// even small message doesn't fit now
+	message, _ := newMessage(t, TestCaseReply, "")
+	_, err = c.TrySend(message)
+	require.ErrorIs(t, err, connection.ErrInflightBytesExceeded)
+
+	// Send waits until the delayed requests complete
+	message, _ = newMessage(t, TestCaseReply, strings.Repeat("X", 36))
+	_, err = c.Send(message)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-sendErrs)
+	}
+
+	// bytes are released on all paths
+	require.Zero(t, c.Stats().InflightBytes)
+
+	t.Run("message larger than the limit is rejected", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.MaxInflightBytes(largeSize-1),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message, _ := newMessage(t, TestCaseReply, strings.Repeat("X", 36))
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrMessageTooLarge)
+	})
+}
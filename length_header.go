@@ -0,0 +1,198 @@
+package connection
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583/network"
+)
+
+// Binary2BytesLengthReader is the MessageLengthReader of the 2 bytes binary
+// (big-endian, network byte order) message length header. Lengths from 0
+// to 65535 are supported.
+func Binary2BytesLengthReader(r io.Reader) (int, error) {
+	header := network.NewBinary2BytesHeader()
+	if _, err := header.ReadFrom(r); err != nil {
+		return 0, fmt.Errorf("reading message length header: %w", err)
+	}
+
+	return header.Length(), nil
+}
+
+// Binary2BytesLengthWriter is the MessageLengthWriter of the 2 bytes binary
+// (big-endian, network byte order) message length header. It returns error
+// if length exceeds 65535.
+func Binary2BytesLengthWriter(w io.Writer, length int) (int, error) {
+	if length < 0 {
+		return 0, fmt.Errorf("negative message length %d", length)
+	}
+
+	header := network.NewBinary2BytesHeader()
+	if err := header.SetLength(length); err != nil {
+		return 0, err
+	}
+
+	n, err := header.WriteTo(w)
+	if err != nil {
+		return n, fmt.Errorf("writing message length header: %w", err)
+	}
+
+	return n, nil
+}
+
+// ErrInvalidLengthHeader is returned by the ASCII length header reader when
+// header is not a decimal number
+var ErrInvalidLengthHeader = errors.New("invalid message length header")
+
+// ASCIILengthHeader returns the Header with message length encoded as
+// zero-padded ASCII decimal number of the width characters, e.g. "0123"
+// for the length 123 and width 4. Reader returns ErrInvalidLengthHeader
+// if header contains other characters than digits.
+func ASCIILengthHeader(width int) Header {
+	return Header{
+		Reader: func(r io.Reader) (int, error) {
+			header := make([]byte, width)
+			if _, err := io.ReadFull(r, header); err != nil {
+				return 0, fmt.Errorf("reading message length header: %w", err)
+			}
+
+			var length int
+			for _, b := range header {
+				if b < '0' || b > '9' {
+					return 0, fmt.Errorf("%w: %q is not a decimal number", ErrInvalidLengthHeader, header)
+				}
+				length = length*10 + int(b-'0')
+			}
+
+			return length, nil
+		},
+		Writer: func(w io.Writer, length int) (int, error) {
+			if length < 0 {
+				return 0, fmt.Errorf("negative message length %d", length)
+			}
+
+			header := strconv.Itoa(length)
+			if len(header) > width {
+				return 0, fmt.Errorf("message length %d exceeds %d digits", length, width)
+			}
+
+			n, err := fmt.Fprintf(w, "%0*d", width, length)
+			if err != nil {
+				return n, fmt.Errorf("writing message length header: %w", err)
+			}
+
+			return n, nil
+		},
+	}
+}
+
+// Header is the part of the message header. Reader and Writer of the part
+// that doesn't carry message length (e.g. fixed routing prefix) return 0
+// length and ignore the length they are called with.
+type Header struct {
+	Reader MessageLengthReader
+	Writer MessageLengthWriter
+}
+
+// LengthHeader returns the Header part that carries message length
+func LengthHeader(reader MessageLengthReader, writer MessageLengthWriter) Header {
+	return Header{
+		Reader: reader,
+		Writer: writer,
+	}
+}
+
+// FixedPrefixHeader returns the Header part with the fixed-width prefix
+// (e.g. originator code) that is written before or after the length
+// header. Prefix of the received messages is read and skipped, as it's
+// set by the other side.
+func FixedPrefixHeader(prefix []byte) Header {
+	return Header{
+		Reader: func(r io.Reader) (int, error) {
+			received := make([]byte, len(prefix))
+			if _, err := io.ReadFull(r, received); err != nil {
+				return 0, fmt.Errorf("reading header prefix: %w", err)
+			}
+
+			return 0, nil
+		},
+		Writer: func(w io.Writer, _ int) (int, error) {
+			n, err := w.Write(prefix)
+			if err != nil {
+				return n, fmt.Errorf("writing header prefix: %w", err)
+			}
+
+			return n, nil
+		},
+	}
+}
+
+// CompositeHeader returns the Header that reads and writes the parts in
+// order. Message length is the sum of the lengths returned by the parts,
+// so only one part should carry it. Use the Reader and Writer of the
+// returned Header as MessageLengthReader and MessageLengthWriter of the
+// connection.
+func CompositeHeader(parts ...Header) Header {
+	return Header{
+		Reader: func(r io.Reader) (int, error) {
+			var length int
+
+			for _, part := range parts {
+				n, err := part.Reader(r)
+				if err != nil {
+					return 0, err
+				}
+				length += n
+			}
+
+			return length, nil
+		},
+		Writer: func(w io.Writer, length int) (int, error) {
+			var written int
+
+			for _, part := range parts {
+				n, err := part.Writer(w, length)
+				written += n
+				if err != nil {
+					return written, err
+				}
+			}
+
+			return written, nil
+		},
+	}
+}
+
+// SendWithHeader sends message like Send, but frames it with the header
+// instead of the connection's MessageLengthWriter, for sockets that carry
+// messages of multiple framing conventions. Use HeaderSelector option to
+// read messages of these conventions.
+func (c *Connection) SendWithHeader(header Header, message *iso8583.Message) (*iso8583.Message, error) {
+	if header.Writer == nil {
+		return nil, errors.New("header writer is required")
+	}
+
+	return c.sendMessage(message, false, "", header.Writer)
+}
+
+// selectLengthReader returns the Reader of the Header returned by the
+// HeaderSelector for the next message or the connection's
+// MessageLengthReader
+func (c *Connection) selectLengthReader(r *bufio.Reader) MessageLengthReader {
+	if c.Opts.HeaderSelector == nil {
+		return c.readMessageLength
+	}
+
+	var header Header
+	c.callback(func() { header = c.Opts.HeaderSelector(r.Peek) })
+
+	if header.Reader == nil {
+		return c.readMessageLength
+	}
+
+	return header.Reader
+}
@@ -0,0 +1,324 @@
+package connection_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinary2BytesLengthHeader(t *testing.T) {
+	t.Run("lengths round-trip in big-endian byte order", func(t *testing.T) {
+		tests := []struct {
+			length  int
+			encoded []byte
+		}{
+			{0, []byte{0x00, 0x00}},
+			{319, []byte{0x01, 0x3F}},
+			{65535, []byte{0xFF, 0xFF}},
+		}
+
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			n, err := connection.Binary2BytesLengthWriter(&buf, tt.length)
+			require.NoError(t, err)
+			require.Equal(t, 2, n)
+			require.Equal(t, tt.encoded, buf.Bytes())
+
+			length, err := connection.Binary2BytesLengthReader(&buf)
+			require.NoError(t, err)
+			require.Equal(t, tt.length, length)
+		}
+	})
+
+	t.Run("writer returns error when length exceeds 65535", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := connection.Binary2BytesLengthWriter(&buf, 65536)
+		require.Error(t, err)
+		require.Zero(t, buf.Len())
+	})
+
+	t.Run("connection exchanges messages framed with 2 bytes big-endian length", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		// mock server that frames messages without the library
+		go func() {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(serverConn, header); err != nil {
+				return
+			}
+
+			packed := make([]byte, binary.BigEndian.Uint16(header))
+			if _, err := io.ReadFull(serverConn, packed); err != nil {
+				return
+			}
+
+			message := iso8583.NewMessage(testSpec)
+			if err := message.Unpack(packed); err != nil {
+				return
+			}
+			message.MTI("0810")
+
+			packed, err := message.Pack()
+			if err != nil {
+				return
+			}
+
+			binary.BigEndian.PutUint16(header, uint16(len(packed)))
+			serverConn.Write(append(header, packed...))
+		}()
+
+		c, err := connection.NewFrom(clientConn, testSpec, connection.Binary2BytesLengthReader, connection.Binary2BytesLengthWriter,
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+	})
+}
+
+func TestCompositeHeader(t *testing.T) {
+	vml := connection.LengthHeader(
+		func(r io.Reader) (int, error) {
+			header := network.NewVMLHeader()
+			_, err := header.ReadFrom(r)
+			return header.Length(), err
+		},
+		func(w io.Writer, length int) (int, error) {
+			header := network.NewVMLHeader()
+			if err := header.SetLength(length); err != nil {
+				return 0, err
+			}
+			return header.WriteTo(w)
+		},
+	)
+
+	header := connection.CompositeHeader(
+		connection.FixedPrefixHeader([]byte("ORIG1")),
+		vml,
+	)
+
+	t.Run("parts are written and read in order", func(t *testing.T) {
+		var buf bytes.Buffer
+		n, err := header.Writer(&buf, 319)
+		require.NoError(t, err)
+		require.Equal(t, 9, n)
+		require.Equal(t, []byte{'O', 'R', 'I', 'G', '1', 0x01, 0x3F, 0x00, 0x00}, buf.Bytes())
+
+		length, err := header.Reader(&buf)
+		require.NoError(t, err)
+		require.Equal(t, 319, length)
+		require.Zero(t, buf.Len())
+	})
+
+	t.Run("reader returns error when prefix is truncated", func(t *testing.T) {
+		_, err := header.Reader(bytes.NewReader([]byte("ORI")))
+		require.Error(t, err)
+	})
+
+	t.Run("connections exchange messages framed with prefix and VML", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		server, err := connection.NewFrom(serverConn, testSpec, header.Reader, header.Writer,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, header.Reader, header.Writer,
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+	})
+}
+
+func TestASCIILengthHeader(t *testing.T) {
+	header := connection.ASCIILengthHeader(4)
+
+	t.Run("lengths round-trip as zero-padded decimal numbers", func(t *testing.T) {
+		tests := []struct {
+			length  int
+			encoded string
+		}{
+			{0, "0000"},
+			{7, "0007"},
+			{123, "0123"},
+			{9999, "9999"},
+		}
+
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			n, err := header.Writer(&buf, tt.length)
+			require.NoError(t, err)
+			require.Equal(t, 4, n)
+			require.Equal(t, tt.encoded, buf.String())
+
+			length, err := header.Reader(&buf)
+			require.NoError(t, err)
+			require.Equal(t, tt.length, length)
+		}
+	})
+
+	t.Run("writer returns error when length exceeds width", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := header.Writer(&buf, 10000)
+		require.Error(t, err)
+		require.Zero(t, buf.Len())
+	})
+
+	t.Run("reader returns ErrInvalidLengthHeader for non-numeric length", func(t *testing.T) {
+		for _, malformed := range []string{"01a3", " 123", "-123", "12.3"} {
+			_, err := header.Reader(bytes.NewBufferString(malformed))
+			require.ErrorIs(t, err, connection.ErrInvalidLengthHeader, malformed)
+		}
+	})
+
+	t.Run("connection closes on malformed length header", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		errs := make(chan error, 1)
+		c, err := connection.NewFrom(clientConn, testSpec, header.Reader, header.Writer,
+			connection.ErrorHandler(func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		go serverConn.Write([]byte("12X4"))
+
+		select {
+		case err := <-errs:
+			require.ErrorIs(t, err, connection.ErrInvalidLengthHeader)
+		case <-time.After(time.Second):
+			t.Fatal("error was not handled")
+		}
+
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+	})
+
+	t.Run("connections exchange messages framed with ASCII length", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		server, err := connection.NewFrom(serverConn, testSpec, header.Reader, header.Writer,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, header.Reader, header.Writer,
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+	})
+}
+
+func TestConnection_SendWithHeader(t *testing.T) {
+	asciiHeader := connection.ASCIILengthHeader(4)
+
+	// ASCII length header starts with a digit, while binary one of the
+	// short message starts with zero byte
+	selector := func(peek func(n int) ([]byte, error)) connection.Header {
+		b, err := peek(1)
+		if err == nil && b[0] >= '0' && b[0] <= '9' {
+			return asciiHeader
+		}
+		return connection.Header{}
+	}
+
+	clientConn, serverConn := net.Pipe()
+
+	// server reads both framings and replies with ASCII length header
+	echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, asciiHeader.Writer,
+		connection.HeaderSelector(selector),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	defer echo.Close()
+
+	// client sends with binary length header by default
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.HeaderSelector(selector),
+		connection.SendTimeout(500*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func() *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+		return message
+	}
+
+	_, err = c.Send(newMessage())
+	require.NoError(t, err)
+
+	_, err = c.SendWithHeader(asciiHeader, newMessage())
+	require.NoError(t, err)
+
+	_, err = c.Send(newMessage())
+	require.NoError(t, err)
+
+	_, err = c.SendWithHeader(connection.Header{}, newMessage())
+	require.EqualError(t, err, "header writer is required")
+}
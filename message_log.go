@@ -0,0 +1,61 @@
+package connection
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583/field"
+)
+
+// MaskPAN is the field filter that masks all but the first 6 and the last 4
+// digits of the PAN
+var MaskPAN iso8583.FilterFunc = func(in string, data field.Field) string {
+	if utf8.RuneCountInString(in) <= 10 {
+		return in
+	}
+
+	return in[:6] + "****" + in[len(in)-4:]
+}
+
+// defaultMessageLogFilters returns the filters of the iso8583 package with
+// PAN (field 2) masked to the first 6 and the last 4 digits
+func defaultMessageLogFilters() []iso8583.FieldFilter {
+	return append(iso8583.DefaultFilters(), iso8583.FilterField(2, MaskPAN))
+}
+
+// logMessage writes message (with MessageLogFilters applied) into the
+// MessageLog. Entries are written with a single Write call, so they are
+// not interleaved. The traceID (if it's set) is written with the
+// direction.
+func (c *Connection) logMessage(direction string, message *iso8583.Message, traceID string) {
+	if c.Opts.MessageLog == nil || message == nil {
+		return
+	}
+
+	filters := c.Opts.MessageLogFilters
+	if len(filters) == 0 {
+		filters = defaultMessageLogFilters()
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s", c.Opts.Clock.Now().Format(time.RFC3339Nano), direction)
+	if traceID != "" {
+		fmt.Fprintf(&buf, " trace=%s", traceID)
+	}
+	buf.WriteString("\n")
+
+	if err := iso8583.Describe(message, &buf, filters...); err != nil {
+		c.handleError(fmt.Errorf("describing %s message for message log: %w", direction, err))
+	}
+	buf.WriteString("\n")
+
+	c.messageLogMu.Lock()
+	defer c.messageLogMu.Unlock()
+
+	if _, err := c.Opts.MessageLog.Write(buf.Bytes()); err != nil {
+		c.handleError(fmt.Errorf("writing message log: %w", err))
+	}
+}
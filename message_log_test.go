@@ -0,0 +1,131 @@
+package connection_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583/encoding"
+	"github.com/moov-io/iso8583/field"
+	"github.com/moov-io/iso8583/prefix"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestConnection_MessageLog(t *testing.T) {
+	// spec with PAN in field 2
+	fields := make(map[int]field.Field)
+	for id, f := range testSpec.Fields {
+		fields[id] = f
+	}
+	fields[2] = field.NewString(&field.Spec{
+		Length:      19,
+		Description: "Primary Account Number",
+		Enc:         encoding.ASCII,
+		Pref:        prefix.ASCII.LL,
+	})
+	spec := &iso8583.MessageSpec{
+		Name:   "spec with PAN",
+		Fields: fields,
+	}
+
+	const pan = "4242424242424242"
+
+	newEcho := func(t *testing.T, conn net.Conn) *connection.Connection {
+		echo, err := connection.NewFrom(conn, spec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+
+		return echo
+	}
+
+	newMessage := func(t *testing.T) *iso8583.Message {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, pan))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("logs sent and received messages with masked PAN", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		echo := newEcho(t, serverConn)
+		defer echo.Close()
+
+		log := &syncBuffer{}
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+			connection.MessageLog(log),
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Send(newMessage(t))
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return bytes.Count([]byte(log.String()), []byte("spec with PAN Message:")) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		output := log.String()
+		require.Contains(t, output, " sent\n")
+		require.Contains(t, output, " received\n")
+		require.Regexp(t, `MTI\.+: 0800`, output)
+		require.Regexp(t, `MTI\.+: 0810`, output)
+		require.Contains(t, output, "424242****4242")
+		require.NotContains(t, output, pan)
+	})
+
+	t.Run("uses field filters passed to the MessageLog", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		echo := newEcho(t, serverConn)
+		defer echo.Close()
+
+		log := &syncBuffer{}
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+			connection.MessageLog(log, iso8583.FilterField(2, iso8583.PANFilter)),
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Send(newMessage(t))
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return bytes.Count([]byte(log.String()), []byte("4242****4242")) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		require.NotContains(t, log.String(), pan)
+	})
+}
@@ -0,0 +1,74 @@
+package connection
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583/field"
+)
+
+// mtiDenied unpacks only the MTI of the raw message and reports whether
+// the message should be dropped according to the AllowedMTIs and
+// DeniedMTIs. Message with MTI that can't be unpacked is not dropped, so
+// the unpack error is reported when message is handled.
+func (c *Connection) mtiDenied(rawMessage []byte) bool {
+	if len(c.Opts.AllowedMTIs) == 0 && len(c.Opts.DeniedMTIs) == 0 {
+		return false
+	}
+
+	spec := c.messageSpec(rawMessage)
+	if spec == nil || spec.Fields[0] == nil {
+		return false
+	}
+
+	mtiField := field.NewString(spec.Fields[0].Spec())
+	if _, err := mtiField.Unpack(rawMessage); err != nil {
+		return false
+	}
+
+	mti := mtiField.Value()
+
+	if len(c.Opts.AllowedMTIs) > 0 && !matchMTI(mti, c.Opts.AllowedMTIs) {
+		return true
+	}
+
+	return matchMTI(mti, c.Opts.DeniedMTIs)
+}
+
+// matchMTI reports whether mti starts with any of the patterns
+func matchMTI(mti string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(mti, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkMTI returns ErrMissingMTI if MTI of the message is not set, or
+// ErrInvalidMTI if it's not a number of the length defined by the spec
+func checkMTI(message *iso8583.Message) error {
+	mti, err := message.GetMTI()
+	if err != nil || mti == "" {
+		return ErrMissingMTI
+	}
+
+	length := 4
+	if mtiField, defined := message.GetSpec().Fields[0]; defined && mtiField.Spec().Length > 0 {
+		length = mtiField.Spec().Length
+	}
+
+	if len(mti) != length {
+		return fmt.Errorf("%w: %q should be %d digits long", ErrInvalidMTI, mti, length)
+	}
+
+	for _, r := range mti {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("%w: %q should contain only digits", ErrInvalidMTI, mti)
+		}
+	}
+
+	return nil
+}
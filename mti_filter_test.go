@@ -0,0 +1,138 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_MTIFilter(t *testing.T) {
+	newMessage := func(t *testing.T, mti string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	tests := []struct {
+		name    string
+		option  connection.Option
+		dropped []string
+		handled []string
+	}{
+		{
+			name:    "denied MTIs are dropped",
+			option:  connection.DeniedMTIs("0820"),
+			dropped: []string{"0820"},
+			handled: []string{"0800", "0200"},
+		},
+		{
+			name:    "not allowed MTIs are dropped",
+			option:  connection.AllowedMTIs("08"),
+			dropped: []string{"0200"},
+			handled: []string{"0800", "0820"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+
+			server, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength)
+			require.NoError(t, err)
+			defer server.Close()
+
+			received := make(chan string, 10)
+			c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+				tt.option,
+				connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+					mti, _ := message.GetMTI()
+					received <- mti
+				}),
+			)
+			require.NoError(t, err)
+			defer c.Close()
+
+			for _, mti := range append(tt.dropped, tt.handled...) {
+				require.NoError(t, server.Reply(newMessage(t, mti)))
+			}
+
+			var handled []string
+			for range tt.handled {
+				select {
+				case mti := <-received:
+					handled = append(handled, mti)
+				case <-time.After(time.Second):
+					t.Fatal("message was not handled")
+				}
+			}
+			require.ElementsMatch(t, tt.handled, handled)
+
+			stats := c.Stats()
+			require.Equal(t, uint64(len(tt.dropped)), stats.Dropped)
+			require.Equal(t, uint64(len(tt.handled)), stats.Received)
+
+			select {
+			case mti := <-received:
+				t.Fatalf("dropped message %s was handled", mti)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestConnection_ValidateMTI(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	defer echo.Close()
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.ValidateMTI(),
+		connection.SendTimeout(500*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	tests := []struct {
+		name    string
+		mti     string
+		wantErr error
+	}{
+		{"MTI is not set", "", connection.ErrMissingMTI},
+		{"MTI is too short", "080", connection.ErrInvalidMTI},
+		{"MTI is not a number", "08X0", connection.ErrInvalidMTI},
+		{"MTI is valid", "0800", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := iso8583.NewMessage(testSpec)
+			if tt.mti != "" {
+				message.MTI(tt.mti)
+			}
+			require.NoError(t, message.Field(11, getSTAN()))
+
+			_, err := c.Send(message)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	// invalid messages were not sent
+	require.Equal(t, uint64(1), c.Stats().Sent)
+}
@@ -0,0 +1,209 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+const (
+	// DefaultSignOnCode is the network management information code
+	// (field 70) of the sign-on message
+	DefaultSignOnCode = "001"
+
+	// DefaultSignOffCode is the network management information code
+	// (field 70) of the sign-off message
+	DefaultSignOffCode = "002"
+
+	// DefaultEchoCode is the network management information code (field
+	// 70) of the echo message
+	DefaultEchoCode = "301"
+
+	// approvedResponseCode is the response code that is approved when
+	// no approved/declined response codes are configured
+	approvedResponseCode = "00"
+)
+
+// SignOn sends sign-on network management message (0800 with field 70 set
+// to the SignOnCode) and verifies that it was approved by the server
+func (c *Connection) SignOn(ctx context.Context) error {
+	// sign-on is approved for the network connection it was sent on
+	c.mutex.Lock()
+	sessionDone := c.sessionDone
+	c.mutex.Unlock()
+
+	if err := c.sendNetworkManagement(ctx, c.Opts.SignOnCode); err != nil {
+		return fmt.Errorf("signing on: %w", err)
+	}
+
+	c.mutex.Lock()
+	// reply for the dropped network connection doesn't sign on the new one
+	if sessionDone != nil && sessionDone == c.sessionDone {
+		c.signedOnSession = sessionDone
+	}
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// SignedOn returns true if sign-on (see SignOn and AutoSignOn) was
+// approved on the current network connection and connection was not
+// signed off since then
+func (c *Connection) SignedOn() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.signedOnLocked()
+}
+
+// signedOnLocked returns true if sign-on was approved on the current
+// network connection or, while it's rotated, on the old one. It should be
+// called with c.mutex locked.
+func (c *Connection) signedOnLocked() bool {
+	if c.signedOnSession == nil {
+		return false
+	}
+
+	return c.signedOnSession == c.sessionDone || c.signedOnSession == c.rotatingFrom
+}
+
+// SignOff sends sign-off network management message (0800 with field 70 set
+// to the SignOffCode) and verifies that it was approved by the server. It
+// can be called from the OnClose callback to sign off before connection is
+// closed.
+func (c *Connection) SignOff(ctx context.Context) error {
+	if err := c.sendNetworkManagement(ctx, c.Opts.SignOffCode); err != nil {
+		return fmt.Errorf("signing off: %w", err)
+	}
+
+	c.mutex.Lock()
+	c.signedOnSession = nil
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// Echo sends echo network management message (0800 with field 70 set to
+// the EchoCode) and verifies that it was approved by the server
+func (c *Connection) Echo(ctx context.Context) error {
+	if err := c.sendNetworkManagement(ctx, c.Opts.EchoCode); err != nil {
+		return fmt.Errorf("echo: %w", err)
+	}
+
+	return nil
+}
+
+// probeReadiness sends echo over the just established network connection.
+// If it's not approved, network connection is dropped (so Connect can be
+// retried) and error wrapping ErrNotReady is returned.
+func (c *Connection) probeReadiness(sessionDone chan struct{}) error {
+	err := c.Echo(context.Background())
+	if err == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	if c.sessionDone == sessionDone {
+		c.dropSession()
+		c.reconnecting = false
+	}
+	c.mutex.Unlock()
+
+	return fmt.Errorf("%w: echo %s: %v", ErrNotReady, c.Addr(), err)
+}
+
+// autoSignOn signs on when network connection is established. Pings are
+// not sent until it's done.
+func (c *Connection) autoSignOn() error {
+	c.mutex.Lock()
+	c.signingOn = true
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.signingOn = false
+		c.mutex.Unlock()
+	}()
+
+	return c.SignOn(context.Background())
+}
+
+// sendNetworkManagement sends network management message with the code and
+// checks the response code of the reply
+func (c *Connection) sendNetworkManagement(ctx context.Context, code string) error {
+	message, err := c.NewNetworkManagementMessage(code)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.sendContext(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return c.checkResponseCode(response)
+}
+
+// NewNetworkManagementMessage builds 0800 message of the connection spec
+// with field 70 set to the code, e.g. for echo or heartbeat messages. STAN
+// (field 11) and transmission date & time (field 7) are set if spec defines
+// them. It returns error if spec doesn't define field 70.
+func (c *Connection) NewNetworkManagementMessage(code string) (*iso8583.Message, error) {
+	c.mutex.Lock()
+	spec := c.spec
+	c.mutex.Unlock()
+
+	if spec == nil {
+		return nil, errors.New("spec is required to build network management message")
+	}
+
+	if _, ok := spec.Fields[70]; !ok {
+		return nil, errors.New("spec doesn't define network management information code (field 70)")
+	}
+
+	message := iso8583.NewMessage(spec)
+	message.MTI("0800")
+
+	if err := message.Field(70, code); err != nil {
+		return nil, fmt.Errorf("setting network management information code (field 70): %w", err)
+	}
+
+	if _, ok := spec.Fields[7]; ok {
+		err := message.Field(7, c.transmissionDateTime(c.Opts.Clock.Now()))
+		if err != nil {
+			return nil, fmt.Errorf("setting transmission date & time (field 7): %w", err)
+		}
+	}
+
+	if err := c.setMessageSTAN(message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// sendContext sends message and waits for the response or for the ctx to be
+// done. Send still completes (or times out) in the background when ctx is
+// done first.
+func (c *Connection) sendContext(ctx context.Context, message *iso8583.Message) (*iso8583.Message, error) {
+	type result struct {
+		response *iso8583.Message
+		err      error
+	}
+
+	resultCh := make(chan result, 1)
+
+	go func() {
+		response, err := c.Send(message)
+		resultCh <- result{response, err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.response, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,392 @@
+package connection_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/moov-io/iso8583/field"
+	"github.com/stretchr/testify/require"
+)
+
+// networkManagementServer replies to network management messages with the
+// configured response code and records received codes (field 70)
+type networkManagementServer struct {
+	*server.Server
+
+	mu            sync.Mutex
+	responseCode  string
+	receivedCodes []string
+}
+
+func newNetworkManagementServer(t *testing.T, responseCode string) *networkManagementServer {
+	t.Helper()
+
+	srv := &networkManagementServer{
+		responseCode: responseCode,
+	}
+
+	handler := func(c *connection.Connection, message *iso8583.Message) {
+		code, err := message.GetString(70)
+		require.NoError(t, err)
+
+		srv.mu.Lock()
+		srv.receivedCodes = append(srv.receivedCodes, code)
+		responseCode := srv.responseCode
+		srv.mu.Unlock()
+
+		message.MTI("0810")
+		require.NoError(t, message.Field(39, responseCode))
+		c.Reply(message)
+	}
+
+	srv.Server = server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(handler))
+	require.NoError(t, srv.Start("127.0.0.1:"))
+
+	return srv
+}
+
+func (s *networkManagementServer) SetResponseCode(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responseCode = code
+}
+
+func (s *networkManagementServer) ReceivedCodes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.receivedCodes...)
+}
+
+func TestConnection_SignOnSignOff(t *testing.T) {
+	t.Run("sign-on and sign-off set field 70", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "00")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.NoError(t, c.SignOn(context.Background()))
+		require.NoError(t, c.SignOff(context.Background()))
+
+		require.Equal(t, []string{connection.DefaultSignOnCode, connection.DefaultSignOffCode}, srv.ReceivedCodes())
+	})
+
+	t.Run("codes can be configured", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "00")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SignOnCode("061"),
+			connection.SignOffCode("062"),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.NoError(t, c.SignOn(context.Background()))
+		require.NoError(t, c.SignOff(context.Background()))
+
+		require.Equal(t, []string{"061", "062"}, srv.ReceivedCodes())
+	})
+
+	t.Run("returns error when sign-on is declined", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "05")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		err = c.SignOn(context.Background())
+		require.EqualError(t, err, "signing on: request was declined with response code: 05")
+	})
+
+	t.Run("returns context error when context is done", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "00")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err = c.SignOn(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("AutoSignOn signs on when connection is established", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "00")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength, connection.AutoSignOn())
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.Equal(t, []string{connection.DefaultSignOnCode}, srv.ReceivedCodes())
+	})
+
+	t.Run("RequireSignOn permits transactions only after sign-on is approved", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "05")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.RequireSignOn(),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		transaction := func() *iso8583.Message {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0200")
+			require.NoError(t, message.Field(11, getSTAN()))
+			// server records field 70 of every message
+			require.NoError(t, message.Field(70, "000"))
+
+			return message
+		}
+
+		_, err = c.Send(transaction())
+		require.ErrorIs(t, err, connection.ErrNotSignedOn)
+
+		// declined sign-on doesn't permit transactions
+		require.Error(t, c.SignOn(context.Background()))
+		require.False(t, c.SignedOn())
+
+		_, err = c.Send(transaction())
+		require.ErrorIs(t, err, connection.ErrNotSignedOn)
+
+		srv.SetResponseCode("00")
+		require.NoError(t, c.SignOn(context.Background()))
+		require.True(t, c.SignedOn())
+
+		_, err = c.Send(transaction())
+		require.NoError(t, err)
+
+		// sign-off clears sign-on state
+		require.NoError(t, c.SignOff(context.Background()))
+		require.False(t, c.SignedOn())
+
+		_, err = c.Send(transaction())
+		require.ErrorIs(t, err, connection.ErrNotSignedOn)
+	})
+
+	t.Run("RequireSignOn keeps connection signed on when it's rotated", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "00")
+		defer srv.Close()
+
+		transaction := func() *iso8583.Message {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0200")
+			require.NoError(t, message.Field(11, getSTAN()))
+			// server records field 70 of every message
+			require.NoError(t, message.Field(70, "000"))
+
+			return message
+		}
+
+		var rotating atomic.Bool
+		onConnectErrs := make(chan error, 1)
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.RequireSignOn(),
+			connection.OnConnect(func(c *connection.Connection) error {
+				if rotating.Load() {
+					// transactions are permitted while the new
+					// network connection is prepared
+					_, err := c.Send(transaction())
+					onConnectErrs <- err
+				}
+				return nil
+			}),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.NoError(t, c.SignOn(context.Background()))
+
+		rotating.Store(true)
+		require.NoError(t, c.RotateConnection(srv.Addr, time.Second))
+		require.NoError(t, <-onConnectErrs)
+
+		// new network connection was signed on
+		require.True(t, c.SignedOn())
+
+		_, err = c.Send(transaction())
+		require.NoError(t, err)
+
+		require.Equal(t, []string{connection.DefaultSignOnCode, "000", connection.DefaultSignOnCode, "000"}, srv.ReceivedCodes())
+	})
+
+	t.Run("Connect fails and closes connection when AutoSignOn fails", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "91")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength, connection.AutoSignOn())
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.ErrorContains(t, err, "request was declined with response code: 91")
+
+		select {
+		case <-c.Done():
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("connection was not closed")
+		}
+	})
+}
+
+func TestConnection_ReadinessProbe(t *testing.T) {
+	t.Run("Connect returns ErrNotReady when echo is declined", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "91")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.ReadinessProbe(),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		err = c.Connect()
+		require.ErrorIs(t, err, connection.ErrNotReady)
+		require.ErrorContains(t, err, "request was declined with response code: 91")
+
+		// connection is not closed and can be connected again when
+		// host is ready
+		srv.SetResponseCode("00")
+
+		require.NoError(t, c.Connect())
+		require.Equal(t, []string{connection.DefaultEchoCode, connection.DefaultEchoCode}, srv.ReceivedCodes())
+
+		message, err := c.NewNetworkManagementMessage("999")
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+
+	t.Run("ConnectWithRetry retries until echo is approved", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "91")
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.ReadinessProbe(),
+			connection.EchoCode("831"),
+			connection.ErrorHandler(func(err error) {
+				// host becomes ready after the first attempt
+				srv.SetResponseCode("00")
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		err = c.ConnectWithRetry(ctx, connection.ConstantBackoff(50*time.Millisecond))
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"831", "831"}, srv.ReceivedCodes())
+	})
+}
+
+func TestConnection_NewNetworkManagementMessage(t *testing.T) {
+	t.Run("builds 0800 message with field 70 set to the code", func(t *testing.T) {
+		c, err := connection.New("", testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		message, err := c.NewNetworkManagementMessage("301")
+		require.NoError(t, err)
+
+		mti, err := message.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0800", mti)
+
+		code, err := message.GetString(70)
+		require.NoError(t, err)
+		require.Equal(t, "301", code)
+
+		stan, err := message.GetString(11)
+		require.NoError(t, err)
+		require.Len(t, stan, 6)
+	})
+
+	t.Run("returns error when spec doesn't define field 70", func(t *testing.T) {
+		spec := &iso8583.MessageSpec{
+			Name:   testSpec.Name,
+			Fields: map[int]field.Field{},
+		}
+		for id, f := range testSpec.Fields {
+			if id != 70 {
+				spec.Fields[id] = f
+			}
+		}
+
+		c, err := connection.New("", spec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		_, err = c.NewNetworkManagementMessage("301")
+		require.EqualError(t, err, "spec doesn't define network management information code (field 70)")
+	})
+}
+
+func TestConnection_ManagementConnection(t *testing.T) {
+	managementSrv := newNetworkManagementServer(t, "00")
+	defer managementSrv.Close()
+
+	// closes connection if it receives 0800 message
+	transactionSrv := newDroppingServer(t)
+	defer transactionSrv.Close()
+
+	mc, err := connection.New(managementSrv.Addr, testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, err)
+	require.NoError(t, mc.Connect())
+	defer mc.Close()
+
+	c, err := connection.New(transactionSrv.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.ManagementConnection(mc),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	require.NoError(t, c.SignOn(context.Background()))
+
+	echo, err := c.NewNetworkManagementMessage("301")
+	require.NoError(t, err)
+	_, err = c.Send(echo)
+	require.NoError(t, err)
+
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0200")
+	require.NoError(t, message.Field(11, getSTAN()))
+	_, err = c.Send(message)
+	require.NoError(t, err)
+
+	// network management messages are sent over the management connection
+	require.Equal(t, []string{connection.DefaultSignOnCode, "301"}, managementSrv.ReceivedCodes())
+	require.Equal(t, []string{"0200"}, transactionSrv.ReceivedMTIs())
+}
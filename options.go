@@ -1,9 +1,12 @@
 package connection
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"time"
 
@@ -11,20 +14,194 @@ import (
 )
 
 type Options struct {
+	// Name is the label of the connection. It's used to prefix errors
+	// returned by Connect and passed to the ErrorHandler, so logs of
+	// multiple connections can be told apart.
+	Name string
+
+	// Network is the network used to connect to the server, e.g. "tcp"
+	// (default) or "unix" for Unix domain sockets. See net.Dial for all
+	// supported networks.
+	Network string
+
+	// ReadAddr enables dual-socket mode for hosts that use separate
+	// inbound and outbound sockets. Connect establishes the write
+	// connection to the connection address and the read connection to
+	// the ReadAddr. Requests and replies are written into the write
+	// connection, while responses and incoming messages are read from the
+	// read connection. Responses are matched with requests as usual.
+	ReadAddr string
+
+	// ManagementConnection is the connection network management messages
+	// (MTI class 8, e.g. sign-on, sign-off and heartbeats) are sent over
+	// by Send and SignOn/SignOff, for hosts that require separate socket
+	// for them. Other messages are sent over this connection. Management
+	// connection has its own correlation and reconnect, and it's not
+	// connected or closed by this connection.
+	ManagementConnection *Connection
+
 	// ConnectTimeout sets the timeout for establishing new connections.
 	ConnectTimeout time.Duration
 
+	// AddrResolver returns the address of the server right before each
+	// dial (on Connect and reconnects), e.g. to pick the current endpoint
+	// with custom DNS-based failover. Its error is handled as dial error.
+	AddrResolver func(ctx context.Context) (string, error)
+
+	// LocalAddr is the local address (source IP and port) the connection
+	// is dialed from, e.g. to bind to specific interface on multi-homed
+	// host. It's used for reconnects too.
+	LocalAddr *net.TCPAddr
+
+	// Linger sets SO_LINGER (see net.TCPConn.SetLinger) of the TCP
+	// connections the connection dials. With zero, Close discards unsent
+	// data and resets the connection, so it doesn't stay in TIME_WAIT.
+	// Negative (default) keeps the OS behavior.
+	Linger int
+
+	// NoDelay enables or disables Nagle's algorithm (see
+	// net.TCPConn.SetNoDelay) of the TCP connections the connection dials
+	// (on Connect and reconnects) or attaches. With true, messages are
+	// written without delay, with false they may be buffered to be sent
+	// in fewer packets. Nil (default) keeps the connection setting (Go
+	// disables Nagle's algorithm for TCP connections by default).
+	NoDelay *bool
+
 	// SendTimeout sets the timeout for a Send operation
 	SendTimeout time.Duration
 
+	// InitialPendingCapacity is the initial capacity of the map of
+	// requests waiting for responses. Pre-sizing it avoids map growth
+	// under high concurrency. It's used only when connection is created.
+	InitialPendingCapacity int
+
+	// FailWhenPaused makes Send return ErrPaused right away while sending
+	// is paused (see Pause) instead of waiting for Resume
+	FailWhenPaused bool
+
+	// LatencyWindow is the number of the latest round trip times of the
+	// matched responses kept by the connection (see RecentLatencies).
+	// Zero (default) means latencies are not kept.
+	LatencyWindow int
+
+	// QueueSize is the number of requests that can wait in the write
+	// queue while the write loop is busy. By default requests are not
+	// buffered and Send waits until the write loop picks up the request.
+	// It's used only when connection is created.
+	QueueSize int
+
+	// MaxInflightBytes is the maximum total size of the packed messages of
+	// the requests that are being sent (from Send call until it returns).
+	// Send waits (no longer than SendTimeout) for other requests to
+	// complete if its message would exceed the limit, and TrySend returns
+	// ErrInflightBytesExceeded right away. Zero (default) means no limit.
+	MaxInflightBytes int
+
+	// MaxPendingRequests is the maximum number of requests that are being
+	// sent (from Send call until it returns). Send returns
+	// ErrTooManyPendingRequests right away when the limit is reached (see
+	// WaitForCapacity). Zero (default) means no limit.
+	MaxPendingRequests int
+
+	// WriteQueueTimeout is the maximum time request may wait in the write
+	// queue before it's written into the connection (e.g. when writes
+	// are stalled). Send returns ErrWriteQueueTimeout for such requests.
+	// Zero (default) means requests wait no longer than SendTimeout.
+	WriteQueueTimeout time.Duration
+
 	// IdleTime is the period at which the client will be sending ping
 	// message to the server
 	IdleTime time.Duration
 
+	// PingDelay is the period after the network connection was
+	// established (or re-established) during which pings are not sent
+	PingDelay time.Duration
+
 	// ReadTimeout is the maximum time between read events before the
 	// ReadTimeoutHandler is called
 	ReadTimeout time.Duration
 
+	// MaxReadTimeouts is the number of consecutive read timeouts without
+	// any message received after which connection is closed. On each read
+	// timeout before that ReadTimeoutHandler is called, so it's a good
+	// place to send a heartbeat message that keeps the connection alive. Zero (default)
+	// means connection is never closed due to read timeouts.
+	MaxReadTimeouts int
+
+	// LengthIncludesHeader should be set when length in the message
+	// length header is the size of the whole frame (header and message)
+	// rather than the size of the message only
+	LengthIncludesHeader bool
+
+	// DeliverPartialUnpack makes connection keep the partially unpacked
+	// message in the *ErrUnpack passed to the ErrorHandler. If the
+	// partially unpacked response can be matched with the pending request
+	// (e.g. STAN was unpacked), the *ErrUnpack is returned by its Send.
+	DeliverPartialUnpack bool
+
+	// StrictResponseBitmap makes connection check that bitmap of each
+	// received message is consistent with its unpacked fields (e.g. there
+	// is no data after the fields indicated by the bitmap). Inconsistent
+	// messages are dropped like messages that failed to unpack, with
+	// *ErrUnpack wrapping ErrInconsistentBitmap passed to the
+	// ErrorHandler.
+	StrictResponseBitmap bool
+
+	// TrailerSize is the number of bytes (e.g. LRC) that follow each
+	// received message and are not counted in the message length header.
+	// Trailer is read after the message and passed to the
+	// TrailerValidator.
+	TrailerSize int
+
+	// TrailerValidator validates the trailer of the received message. If
+	// it returns error, message is dropped and *ErrInvalidTrailer is
+	// passed to the ErrorHandler.
+	TrailerValidator func(rawMessage, trailer []byte) error
+
+	// FrameChecksum computes checksum (e.g. LRC) of the packed message.
+	// Checksum is written after the message and is not counted in the
+	// message length header. When TrailerSize is not set, the same number
+	// of bytes is read after each received message.
+	FrameChecksum func(packed []byte) []byte
+
+	// StreamConcurrency is the maximum number of requests SendStream
+	// sends at the same time (DefaultStreamConcurrency by default)
+	StreamConcurrency int
+
+	// MessageLog is the writer where every sent and received message is
+	// logged (e.g. file for audit). Sensitive fields are masked with the
+	// MessageLogFilters.
+	MessageLog io.Writer
+
+	// MessageLogFilters are the field filters applied to the messages
+	// written into the MessageLog. When not set, PAN (field 2) is masked
+	// to the first 6 and the last 4 digits and track data, PIN block and
+	// EMV data are masked with the default filters of the iso8583
+	// package.
+	MessageLogFilters []iso8583.FieldFilter
+
+	// DuplicateResponsePolicy defines how responses to the requests that
+	// were already answered are handled. By default they are passed to
+	// the unmatched handlers (DuplicateUnmatched).
+	DuplicateResponsePolicy DuplicatePolicy
+
+	// StrictCorrelation makes Send return ErrRequestIDPending right away
+	// when request with the same ID (e.g. STAN) is already waiting for
+	// the response, instead of replacing it. Such collision usually
+	// means a bug in STAN generation.
+	StrictCorrelation bool
+
+	// ReadBufferSize is the size of the buffer used to read messages from
+	// the connection. Bigger buffer reduces the number of reads for large
+	// messages. Zero (default) means 4096 bytes.
+	ReadBufferSize int
+
+	// MaxSendSize is the maximum size of the packed message (without
+	// length header) that can be sent. Send and Reply return
+	// ErrMessageTooLarge for larger messages. Zero (default) means no
+	// limit.
+	MaxSendSize int
+
 	// PingHandler is called when no message was sent during idle time
 	// it should be safe for concurrent use
 	PingHandler func(c *Connection)
@@ -41,10 +218,109 @@ type Options struct {
 	// * to handle network management messages (echo, heartbeat, etc.)
 	InboundMessageHandler func(c *Connection, message *iso8583.Message)
 
+	// OnUnmatched is called when a response was received but no pending
+	// request was found for its request ID. If request ID can't be
+	// created for the response (e.g. STAN is missing), it's called with
+	// empty requestID. It's called in addition to the
+	// InboundMessageHandler. In production it usually signals either a
+	// correlation bug or a STAN reuse, so it's a good place for alerting.
+	OnUnmatched func(c *Connection, message *iso8583.Message, requestID string)
+
+	// UnmatchedWorkers limits the number of unmatched responses handled
+	// (by OnUnmatched and InboundMessageHandler) concurrently. Unmatched
+	// responses received when all workers are busy are dropped and
+	// counted in Stats.UnmatchedDropped, so read loop never blocks. Zero
+	// (default) means each unmatched response is handled in its own
+	// goroutine. It should be set when connection is created.
+	UnmatchedWorkers int
+
+	// OnLateResponse is called when a response was received for the
+	// request that timed out within the last minute. late is the time
+	// passed since the request timed out. It's called in addition to the
+	// OnUnmatched and InboundMessageHandler and helps to tune timeouts.
+	OnLateResponse func(c *Connection, message *iso8583.Message, late time.Duration)
+
+	// InDoubtWindow is how long requests that timed out are kept in doubt
+	// (see InDoubtRequests) for reconciliation, as it's not known whether
+	// the host processed them. Request is removed when its late response
+	// is received (OnLateResponse is called for it even after a minute).
+	// Zero (default) means requests in doubt are not tracked.
+	InDoubtWindow time.Duration
+
+	// PanicHandler is called with the value recovered from the panic of
+	// the handler or callback set in options (InboundMessageHandler,
+	// OnUnmatched, ErrorHandler, etc.) and with the stack trace of the
+	// panic. Panics are recovered, so they don't break the connection.
+	// By default, they are logged.
+	PanicHandler func(recovered interface{}, stack []byte)
+
+	// HeaderSelector is called before each received message is read with
+	// the function that returns the next n bytes of the stream without
+	// consuming them. It returns the Header the length of the message is
+	// read with, or zero Header to use the connection's
+	// MessageLengthReader. Use it with SendWithHeader when socket carries
+	// messages of multiple framing conventions.
+	HeaderSelector func(peek func(n int) ([]byte, error)) Header
+
+	// SpecSelector is called with the received raw message (it starts
+	// with the MTI) to select the spec the message should be unpacked
+	// with. It allows multiple message families with different specs to
+	// share the same connection. If it returns nil, the connection spec is
+	// used.
+	SpecSelector func(rawMessage []byte) *iso8583.MessageSpec
+
+	// AllowedMTIs is the list of MTIs of the received messages that are
+	// handled. Other messages are dropped by the read loop after only
+	// MTI is unpacked. Entries are matched as MTI prefixes, so "08"
+	// allows all network management messages. If it's empty, all
+	// messages are allowed.
+	AllowedMTIs []string
+
+	// DeniedMTIs is the list of MTIs of the received messages that are
+	// dropped by the read loop after only MTI is unpacked (e.g.
+	// administrative broadcasts). Entries are matched as MTI prefixes.
+	DeniedMTIs []string
+
+	// OnRequestTiming is called when response for the request is received
+	// with the time request spent in the write queue and the time it took
+	// to receive the response after request was written. It allows to tell
+	// client side backpressure from the server slowness.
+	OnRequestTiming func(c *Connection, timing RequestTiming)
+
+	// OnRequestEvent is called when request sent with Send or SendTraced
+	// is queued, written, responded or timed out. Events carry the trace
+	// ID of SendTraced, so request lifecycle can be correlated with the
+	// trace of the caller.
+	OnRequestEvent func(c *Connection, event RequestEvent)
+
+	// OnMessagePacked is called when message is packed by Send or Reply
+	// with the packed message length and the number of set fields. It's
+	// useful for logging message sizes without packing messages again.
+	OnMessagePacked func(c *Connection, message PackedMessage)
+
+	// OnFrameSize is called when message is read from the connection with
+	// its size (the length from the message length header, without the
+	// header and trailer), e.g. to build histogram of received message
+	// sizes. It's called for messages that are dropped afterwards, too.
+	OnFrameSize func(c *Connection, size int)
+
 	// ConnectionClosedHandlers is called when connection is closed by server or there
 	// were network errors during network read/write
 	ConnectionClosedHandlers []func(c *Connection)
 
+	// OnWriteLoopExit is called when the write loop of the network
+	// connection exits, so connection can't send messages over it
+	// anymore. err is the write error that made the loop exit, or nil if
+	// the loop was stopped (connection is closed or reconnecting). It's
+	// called once per network connection.
+	OnWriteLoopExit func(c *Connection, err error)
+
+	// OnReadLoopExit is called when the read loop of the network
+	// connection exits with the read error that made the loop exit. When
+	// connection is closed, it's usually the error of reading from the
+	// closed network connection. It's called once per network connection.
+	OnReadLoopExit func(c *Connection, err error)
+
 	// ConnectionEstablishedHandler is called when connection is
 	// established with the server
 	ConnectionEstablishedHandler func(c *Connection)
@@ -58,20 +334,298 @@ type Options struct {
 	// OnConnect is called synchronously when a connection is established
 	OnConnect func(c *Connection) error
 
-	// OnClose is called synchronously before a connection is closed
+	// OnClose is called synchronously by Close before a connection is
+	// closed: before new Send calls are rejected and pending requests are
+	// failed, so it can still send messages (e.g. SignOff). If it returns
+	// error, connection is not closed.
 	OnClose func(c *Connection) error
+
+	// SignOnCode is the network management information code (field 70)
+	// of the sign-on message
+	SignOnCode string
+
+	// SignOffCode is the network management information code (field 70)
+	// of the sign-off message
+	SignOffCode string
+
+	// ResponseCodeField is the field of the response code checked by
+	// IsApproved and Send (field 39 by default)
+	ResponseCodeField int
+
+	// ApprovedResponseCodes is the list of response codes
+	// (ResponseCodeField) that are considered approved. When it's set, Send returns *DeclineError
+	// for responses with any other response code.
+	ApprovedResponseCodes []string
+
+	// DeclinedResponseCodes is the list of response codes
+	// (ResponseCodeField) that are considered declined. When it's set, Send returns *DeclineError
+	// for responses with any of these response codes.
+	DeclinedResponseCodes []string
+
+	// CircuitBreakerThreshold is the number of consecutive transport
+	// failures (timeouts, closed or unavailable connection) of Send after
+	// which the circuit is opened and Send returns ErrCircuitOpen. Declines
+	// and other errors don't count. Zero (default) disables the circuit
+	// breaker.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown is the time after which open circuit becomes
+	// half-open and a single trial request is allowed. If it succeeds,
+	// circuit is closed, otherwise it's opened again.
+	CircuitBreakerCooldown time.Duration
+
+	// Clock provides the current time, e.g. for date and time fields
+	Clock Clock
+
+	// AutoDateTimeFields makes Send set transmission date & time (field
+	// 7) in UTC, local transaction time (field 12) and local transaction
+	// date (field 13) in LocalTimeLocation if they are not set.
+	AutoDateTimeFields bool
+
+	// LocalTimeLocation is the time zone of the local transaction time
+	// and date (fields 12 and 13)
+	LocalTimeLocation *time.Location
+
+	// TransmissionDateTimeFormat is the time layout of the transmission
+	// date & time (field 7) set by the connection. Default is
+	// DefaultTransmissionDateTimeFormat (MMDDhhmmss).
+	TransmissionDateTimeFormat string
+
+	// TransmissionDateTimeLocation is the time zone of the transmission
+	// date & time (field 7). Default is UTC (GMT).
+	TransmissionDateTimeLocation *time.Location
+
+	// AutoSTAN makes Send set STAN (field 11) if it's not set. STANs are
+	// taken sequentially from the MinSTAN-MaxSTAN range skipping STANs of
+	// pending requests.
+	AutoSTAN bool
+
+	// ValidateMTI makes Send check that MTI of the message is set and it's
+	// the number of the length defined by the spec before the message is
+	// packed. Send returns ErrMissingMTI or ErrInvalidMTI otherwise.
+	ValidateMTI bool
+
+	// AutoRRN makes Send set retrieval reference number (field 37) if spec
+	// defines it and it's not set. RRN is returned by the RRNGenerator or,
+	// if it's not set, it's date-based (YDDDhh in UTC) followed by the
+	// 6 digits sequence number of the connection.
+	AutoRRN bool
+
+	// RRNGenerator returns RRNs set with AutoRRN
+	RRNGenerator func() string
+
+	// MinSTAN and MaxSTAN are the range of STANs set by the connection
+	// (000001-999999 by default)
+	MinSTAN int
+	MaxSTAN int
+
+	// STANPrefix is the prefix (e.g. node identifier) of the STANs set
+	// by the connection, e.g. "A" for STANs A00001-A99999. STANs keep
+	// their width of 6 characters, so the range of their numbers is
+	// reduced to fit the rest of the STAN (MaxSTAN is limited
+	// accordingly). Non-digit prefixes require field 11 to be a string.
+	// It's not used with the STANProvider.
+	STANPrefix string
+
+	// STANProvider provides STANs set by the connection instead of the
+	// connection own counter, e.g. to share a single STAN sequence by
+	// multiple connections. MinSTAN, MaxSTAN and STANPrefix are not used
+	// with it.
+	STANProvider STANProvider
+
+	// CorrelationField is the field that is used to match responses with
+	// requests instead of STAN (field 11). Server should return its value
+	// in the response as is. Zero (default) means STAN is used.
+	CorrelationField int
+
+	// AutoCorrelationID makes Send set the CorrelationField to a new UUID
+	// if it's not set. Field should fit 36 characters.
+	AutoCorrelationID bool
+
+	// STANDateCorrelation makes connection match responses with requests
+	// by STAN (field 11) combined with the date (MMDD) of the transmission
+	// date & time (field 7), so STANs can be reused on the next day.
+	// Server should return field 7 in the response as is.
+	STANDateCorrelation bool
+
+	// RequestIDFunc returns the ID that is used to match responses with
+	// requests instead of STAN (field 11) or CorrelationField, e.g. to
+	// combine multiple fields. It's called for the sent requests and the
+	// received responses. If it panics (e.g. on malformed response), Send
+	// returns error and received response is handled as unmatched, with
+	// error passed to the ErrorHandler.
+	RequestIDFunc func(message *iso8583.Message) (string, error)
+
+	// OnSTANExhausted is called when connection has to set STAN but all
+	// STANs of the range are used by pending requests. Send returns
+	// ErrSTANExhausted in this case.
+	OnSTANExhausted func(c *Connection)
+
+	// AutoSignOn makes Connect to sign on after connection is
+	// established. If sign-on fails, connection is closed.
+	AutoSignOn bool
+
+	// RequireSignOn makes Send return ErrNotSignedOn until sign-on (see
+	// SignOn and AutoSignOn) is approved on the current network
+	// connection, so transactions are not sent over the link that is not
+	// signed on. Sign-on state is cleared when network connection is lost
+	// or re-established and on SignOff. Network management messages
+	// (08xx) are sent regardless of it.
+	RequireSignOn bool
+
+	// EchoCode is the network management information code (field 70) of
+	// the echo message sent by Echo (301 by default)
+	EchoCode string
+
+	// ReadinessProbe makes connection send echo right after network
+	// connection is established (on Connect and reconnects) and consider
+	// connection established only when echo is approved. If it's not
+	// approved, Connect returns ErrNotReady (ConnectWithRetry retries) and
+	// the reconnect is retried.
+	ReadinessProbe bool
+
+	// ReconnectWait is the time to wait before re-establishing network
+	// connection after it was lost. When it's set, connection is not
+	// closed on network errors but reconnects in the background until
+	// Close is called. OnConnect (and sign-on) is called on every
+	// reconnect. Zero (default) disables reconnect.
+	ReconnectWait time.Duration
+
+	// ResubmitOnReconnect makes connection to resubmit requests that were
+	// waiting for responses when network connection was lost. Requests
+	// are resubmitted with the repeat MTI (e.g. 0201 for 0200) after
+	// reconnect, and the original Send calls receive their responses if
+	// they arrive within SendTimeout. As the server may have processed
+	// the original request, it gives at-least-once delivery: server
+	// should treat repeats as duplicates. It has effect only when
+	// ReconnectWait is set.
+	ResubmitOnReconnect bool
+
+	// ReversalBuilder builds reversal of the original message queued with
+	// QueueReversal. If it's not set, NewReversal is used.
+	ReversalBuilder func(original *iso8583.Message) (*iso8583.Message, error)
+
+	// ReversalBackoff returns the time to wait before the next attempt to
+	// send the reversal queued with QueueReversal. If it's not set,
+	// exponential backoff from 1 second up to 1 minute is used.
+	ReversalBackoff Backoff
+
+	// ReversalMaxAttempts is the number of attempts to send the reversal
+	// after which OnReversalFailed is called. Zero (default) means
+	// reversal is sent until it's approved or connection is closed.
+	ReversalMaxAttempts int
+
+	// OnReversalFailed is called when reversal queued with QueueReversal
+	// was not approved within ReversalMaxAttempts or connection was
+	// closed. Err is the error of the last attempt.
+	OnReversalFailed func(c *Connection, reversal *iso8583.Message, err error)
+
+	// MaxReconnectAttempts is the number of consecutive failed attempts
+	// to re-establish network connection (dial, ReadinessProbe, OnConnect
+	// or sign-on failed) after which connection gives up
+	// and is closed: ConnectionClosedHandlers are called, LastError
+	// returns the error of the last attempt and Send returns
+	// ErrConnectionFailed. Zero (default) means connection reconnects
+	// until Close is called. It has effect only when ReconnectWait is set.
+	MaxReconnectAttempts int
+
+	// MaxConnectionAge is the time after which network connection is
+	// proactively rotated (see RotateConnection) regardless of its
+	// health, e.g. for compliance. Requests written into the old network
+	// connection get their responses from it within SendTimeout. If
+	// rotation fails, the old network connection is kept and rotation is
+	// retried after ReconnectWait (or MaxConnectionAge if it's not set).
+	// Zero (default) means network connection is not rotated.
+	MaxConnectionAge time.Duration
+
+	// OnConnectionRotated is called when network connection was rotated
+	// because of MaxConnectionAge with the age of the old network
+	// connection, e.g. to log the rotation
+	OnConnectionRotated func(c *Connection, age time.Duration)
+
+	// FailFastDuringReconnect makes Send return ErrReconnecting right
+	// away while network connection is being re-established instead of
+	// waiting for it up to SendTimeout. Pool skips such connections while
+	// they are reconnecting.
+	FailFastDuringReconnect bool
+
+	// RateLimit is the maximum number of messages per second written into
+	// the connection. Messages that exceed the rate wait in the write
+	// queue. Zero (default) disables rate limiting.
+	RateLimit int
+
+	// RateLimitBurst is the number of messages that can be written at
+	// once, above the RateLimit
+	RateLimitBurst int
+
+	// RateLimitBypass is called for each message before it's written. If
+	// it returns true, message is written without rate limiting, e.g. to
+	// not delay heartbeat and other network management messages.
+	RateLimitBypass func(message *iso8583.Message) bool
 }
 
 type Option func(*Options) error
 
 func GetDefaultOptions() Options {
 	return Options{
-		ConnectTimeout: 10 * time.Second,
-		SendTimeout:    30 * time.Second,
-		IdleTime:       5 * time.Second,
-		ReadTimeout:    60 * time.Second,
-		PingHandler:    nil,
-		TLSConfig:      nil,
+		Network:           "tcp",
+		ConnectTimeout:    10 * time.Second,
+		SendTimeout:       30 * time.Second,
+		IdleTime:          5 * time.Second,
+		ReadTimeout:       60 * time.Second,
+		PingHandler:       nil,
+		TLSConfig:         nil,
+		SignOnCode:        DefaultSignOnCode,
+		SignOffCode:       DefaultSignOffCode,
+		EchoCode:          DefaultEchoCode,
+		ResponseCodeField: DefaultResponseCodeField,
+		Clock:             realClock{},
+		MinSTAN:           1,
+		MaxSTAN:           999999,
+		Linger:            -1,
+
+		TransmissionDateTimeFormat:   DefaultTransmissionDateTimeFormat,
+		TransmissionDateTimeLocation: time.UTC,
+	}
+}
+
+// Name sets a Name option
+func Name(name string) Option {
+	return func(o *Options) error {
+		o.Name = name
+		return nil
+	}
+}
+
+// Network sets a Network option
+func Network(network string) Option {
+	return func(o *Options) error {
+		o.Network = network
+		return nil
+	}
+}
+
+// DualSocket sets a ReadAddr option
+func DualSocket(readAddr string) Option {
+	return func(o *Options) error {
+		o.ReadAddr = readAddr
+		return nil
+	}
+}
+
+// ManagementConnection sets a ManagementConnection option
+func ManagementConnection(mc *Connection) Option {
+	return func(o *Options) error {
+		o.ManagementConnection = mc
+		return nil
+	}
+}
+
+// PingDelay sets a PingDelay option
+func PingDelay(d time.Duration) Option {
+	return func(o *Options) error {
+		o.PingDelay = d
+		return nil
 	}
 }
 
@@ -91,6 +645,109 @@ func SendTimeout(d time.Duration) Option {
 	}
 }
 
+// InitialPendingCapacity sets an InitialPendingCapacity option
+func InitialPendingCapacity(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("initial pending capacity should not be negative: %d", n)
+		}
+		o.InitialPendingCapacity = n
+		return nil
+	}
+}
+
+// LatencyWindow sets a LatencyWindow option
+func LatencyWindow(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("latency window should be positive: %d", n)
+		}
+		o.LatencyWindow = n
+		return nil
+	}
+}
+
+// FailWhenPaused sets a FailWhenPaused option
+func FailWhenPaused() Option {
+	return func(o *Options) error {
+		o.FailWhenPaused = true
+		return nil
+	}
+}
+
+// QueueSize sets a QueueSize option
+func QueueSize(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("queue size should not be negative: %d", n)
+		}
+		o.QueueSize = n
+		return nil
+	}
+}
+
+// MaxInflightBytes sets a MaxInflightBytes option
+func MaxInflightBytes(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("max in-flight bytes should be positive: %d", n)
+		}
+		o.MaxInflightBytes = n
+		return nil
+	}
+}
+
+// MaxPendingRequests sets a MaxPendingRequests option
+func MaxPendingRequests(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("max pending requests should be positive: %d", n)
+		}
+		o.MaxPendingRequests = n
+		return nil
+	}
+}
+
+// WriteQueueTimeout sets a WriteQueueTimeout option
+func WriteQueueTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		o.WriteQueueTimeout = d
+		return nil
+	}
+}
+
+// AddrResolver sets an AddrResolver option
+func AddrResolver(resolve func(ctx context.Context) (string, error)) Option {
+	return func(o *Options) error {
+		o.AddrResolver = resolve
+		return nil
+	}
+}
+
+// LocalAddr sets a LocalAddr option
+func LocalAddr(addr *net.TCPAddr) Option {
+	return func(o *Options) error {
+		o.LocalAddr = addr
+		return nil
+	}
+}
+
+// Linger sets a Linger option. It's ignored for non-TCP connections.
+func Linger(sec int) Option {
+	return func(o *Options) error {
+		o.Linger = sec
+		return nil
+	}
+}
+
+// NoDelay sets a NoDelay option. It's ignored for non-TCP connections.
+func NoDelay(enable bool) Option {
+	return func(o *Options) error {
+		o.NoDelay = &enable
+		return nil
+	}
+}
+
 // ConnectTimeout sets an SendTimeout option
 func ConnectTimeout(d time.Duration) Option {
 	return func(o *Options) error {
@@ -107,6 +764,118 @@ func ReadTimeout(d time.Duration) Option {
 	}
 }
 
+// MaxReadTimeouts sets a MaxReadTimeouts option
+func MaxReadTimeouts(n int) Option {
+	return func(o *Options) error {
+		o.MaxReadTimeouts = n
+		return nil
+	}
+}
+
+// LengthIncludesHeader sets a LengthIncludesHeader option
+func LengthIncludesHeader() Option {
+	return func(o *Options) error {
+		o.LengthIncludesHeader = true
+		return nil
+	}
+}
+
+// DeliverPartialUnpack sets a DeliverPartialUnpack option
+func DeliverPartialUnpack() Option {
+	return func(o *Options) error {
+		o.DeliverPartialUnpack = true
+		return nil
+	}
+}
+
+// StrictResponseBitmap sets a StrictResponseBitmap option
+func StrictResponseBitmap() Option {
+	return func(o *Options) error {
+		o.StrictResponseBitmap = true
+		return nil
+	}
+}
+
+// TrailerSize sets a TrailerSize option
+func TrailerSize(n int) Option {
+	return func(o *Options) error {
+		o.TrailerSize = n
+		return nil
+	}
+}
+
+// TrailerValidator sets a TrailerValidator option
+func TrailerValidator(validate func(rawMessage, trailer []byte) error) Option {
+	return func(o *Options) error {
+		o.TrailerValidator = validate
+		return nil
+	}
+}
+
+// FrameChecksum sets FrameChecksum and TrailerValidator options. compute is
+// called for each sent message and its result is written after the
+// message. validate is called for each received message with the
+// checksum that follows it.
+func FrameChecksum(compute func(packed []byte) []byte, validate func(payload, checksum []byte) error) Option {
+	return func(o *Options) error {
+		o.FrameChecksum = compute
+		o.TrailerValidator = validate
+		return nil
+	}
+}
+
+// StreamConcurrency sets a StreamConcurrency option
+func StreamConcurrency(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("stream concurrency should be positive: %d", n)
+		}
+		o.StreamConcurrency = n
+		return nil
+	}
+}
+
+// MessageLog sets MessageLog and MessageLogFilters options
+func MessageLog(w io.Writer, filters ...iso8583.FieldFilter) Option {
+	return func(o *Options) error {
+		o.MessageLog = w
+		o.MessageLogFilters = filters
+		return nil
+	}
+}
+
+// StrictCorrelation sets a StrictCorrelation option
+func StrictCorrelation() Option {
+	return func(o *Options) error {
+		o.StrictCorrelation = true
+		return nil
+	}
+}
+
+// DuplicateResponsePolicy sets a DuplicateResponsePolicy option
+func DuplicateResponsePolicy(policy DuplicatePolicy) Option {
+	return func(o *Options) error {
+		o.DuplicateResponsePolicy = policy
+		return nil
+	}
+}
+
+// ReadBufferSize sets a ReadBufferSize option
+func ReadBufferSize(n int) Option {
+	return func(o *Options) error {
+		o.ReadBufferSize = n
+		return nil
+	}
+}
+
+// MaxSendSize sets a MaxSendSize option
+func MaxSendSize(n int) Option {
+	return func(o *Options) error {
+		o.MaxSendSize = n
+		return nil
+	}
+}
+
 // ReadTimeoutHandler sets a ReadTimeoutHandler option
 func ReadTimeoutHandler(handler func(c *Connection)) Option {
 	return func(o *Options) error {
@@ -131,6 +900,22 @@ func ConnectionClosedHandler(handler func(c *Connection)) Option {
 	}
 }
 
+// OnWriteLoopExit sets an OnWriteLoopExit option
+func OnWriteLoopExit(h func(c *Connection, err error)) Option {
+	return func(o *Options) error {
+		o.OnWriteLoopExit = h
+		return nil
+	}
+}
+
+// OnReadLoopExit sets an OnReadLoopExit option
+func OnReadLoopExit(h func(c *Connection, err error)) Option {
+	return func(o *Options) error {
+		o.OnReadLoopExit = h
+		return nil
+	}
+}
+
 func ConnectionEstablishedHandler(handler func(c *Connection)) Option {
 	return func(o *Options) error {
 		o.ConnectionEstablishedHandler = handler
@@ -146,6 +931,116 @@ func InboundMessageHandler(handler func(c *Connection, message *iso8583.Message)
 	}
 }
 
+// OnUnmatched sets an OnUnmatched option
+func OnUnmatched(h func(c *Connection, message *iso8583.Message, requestID string)) Option {
+	return func(o *Options) error {
+		o.OnUnmatched = h
+		return nil
+	}
+}
+
+// UnmatchedWorkers sets an UnmatchedWorkers option
+func UnmatchedWorkers(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("unmatched workers should be positive: %d", n)
+		}
+		o.UnmatchedWorkers = n
+		return nil
+	}
+}
+
+// OnLateResponse sets an OnLateResponse option
+func OnLateResponse(h func(c *Connection, message *iso8583.Message, late time.Duration)) Option {
+	return func(o *Options) error {
+		o.OnLateResponse = h
+		return nil
+	}
+}
+
+// InDoubtWindow sets an InDoubtWindow option
+func InDoubtWindow(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("in-doubt window should be positive: %s", d)
+		}
+		o.InDoubtWindow = d
+		return nil
+	}
+}
+
+// PanicHandler sets a PanicHandler option
+func PanicHandler(h func(recovered interface{}, stack []byte)) Option {
+	return func(o *Options) error {
+		o.PanicHandler = h
+		return nil
+	}
+}
+
+// HeaderSelector sets a HeaderSelector option
+func HeaderSelector(selector func(peek func(n int) ([]byte, error)) Header) Option {
+	return func(o *Options) error {
+		o.HeaderSelector = selector
+		return nil
+	}
+}
+
+// SpecSelector sets a SpecSelector option
+func SpecSelector(selector func(rawMessage []byte) *iso8583.MessageSpec) Option {
+	return func(o *Options) error {
+		o.SpecSelector = selector
+		return nil
+	}
+}
+
+// AllowedMTIs sets an AllowedMTIs option
+func AllowedMTIs(mtis ...string) Option {
+	return func(o *Options) error {
+		o.AllowedMTIs = mtis
+		return nil
+	}
+}
+
+// DeniedMTIs sets a DeniedMTIs option
+func DeniedMTIs(mtis ...string) Option {
+	return func(o *Options) error {
+		o.DeniedMTIs = mtis
+		return nil
+	}
+}
+
+// OnRequestEvent sets an OnRequestEvent option
+func OnRequestEvent(h func(c *Connection, event RequestEvent)) Option {
+	return func(o *Options) error {
+		o.OnRequestEvent = h
+		return nil
+	}
+}
+
+// OnRequestTiming sets an OnRequestTiming option
+func OnRequestTiming(h func(c *Connection, timing RequestTiming)) Option {
+	return func(o *Options) error {
+		o.OnRequestTiming = h
+		return nil
+	}
+}
+
+// OnFrameSize sets an OnFrameSize option
+func OnFrameSize(h func(c *Connection, size int)) Option {
+	return func(o *Options) error {
+		o.OnFrameSize = h
+		return nil
+	}
+}
+
+// OnMessagePacked sets an OnMessagePacked option
+func OnMessagePacked(h func(c *Connection, message PackedMessage)) Option {
+	return func(o *Options) error {
+		o.OnMessagePacked = h
+		return nil
+	}
+}
+
 // ErrorHandler sets an ErrorHandler option
 // in many cases err will be an instance of the `SafeError`
 // for more details: https://github.com/moov-io/iso8583/pull/185
@@ -172,6 +1067,337 @@ func OnClose(h func(c *Connection) error) Option {
 	}
 }
 
+// SignOnCode sets a SignOnCode option
+func SignOnCode(code string) Option {
+	return func(o *Options) error {
+		o.SignOnCode = code
+		return nil
+	}
+}
+
+// SignOffCode sets a SignOffCode option
+func SignOffCode(code string) Option {
+	return func(o *Options) error {
+		o.SignOffCode = code
+		return nil
+	}
+}
+
+// ResponseCodeField sets a ResponseCodeField option
+func ResponseCodeField(id int) Option {
+	return func(o *Options) error {
+		o.ResponseCodeField = id
+		return nil
+	}
+}
+
+// ApprovedResponseCodes sets an ApprovedResponseCodes option
+func ApprovedResponseCodes(codes ...string) Option {
+	return func(o *Options) error {
+		o.ApprovedResponseCodes = codes
+		return nil
+	}
+}
+
+// DeclinedResponseCodes sets a DeclinedResponseCodes option
+func DeclinedResponseCodes(codes ...string) Option {
+	return func(o *Options) error {
+		o.DeclinedResponseCodes = codes
+		return nil
+	}
+}
+
+// CircuitBreaker sets CircuitBreakerThreshold and CircuitBreakerCooldown
+// options
+func CircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(o *Options) error {
+		if threshold <= 0 {
+			return fmt.Errorf("circuit breaker threshold should be positive: %d", threshold)
+		}
+		if cooldown <= 0 {
+			return fmt.Errorf("circuit breaker cooldown should be positive: %s", cooldown)
+		}
+		o.CircuitBreakerThreshold = threshold
+		o.CircuitBreakerCooldown = cooldown
+		return nil
+	}
+}
+
+// SetClock sets a Clock option
+func SetClock(clock Clock) Option {
+	return func(o *Options) error {
+		o.Clock = clock
+		return nil
+	}
+}
+
+// AutoDateTimeFields sets an AutoDateTimeFields option. When set, Send sets
+// empty fields 7, 12 and 13 using the Clock. Local transaction time and
+// date (fields 12 and 13) are set in the loc time zone, or in the local
+// time zone if loc is nil.
+func AutoDateTimeFields(loc *time.Location) Option {
+	return func(o *Options) error {
+		if loc == nil {
+			loc = time.Local
+		}
+		o.AutoDateTimeFields = true
+		o.LocalTimeLocation = loc
+		return nil
+	}
+}
+
+// TransmissionDateTime sets TransmissionDateTimeFormat and
+// TransmissionDateTimeLocation options. If loc is nil, UTC is used.
+func TransmissionDateTime(format string, loc *time.Location) Option {
+	return func(o *Options) error {
+		if format == "" {
+			return fmt.Errorf("transmission date & time format is required")
+		}
+		if loc == nil {
+			loc = time.UTC
+		}
+		o.TransmissionDateTimeFormat = format
+		o.TransmissionDateTimeLocation = loc
+		return nil
+	}
+}
+
+// EchoCode sets an EchoCode option
+func EchoCode(code string) Option {
+	return func(o *Options) error {
+		o.EchoCode = code
+		return nil
+	}
+}
+
+// ReadinessProbe sets a ReadinessProbe option
+func ReadinessProbe() Option {
+	return func(o *Options) error {
+		o.ReadinessProbe = true
+		return nil
+	}
+}
+
+// AutoSignOn sets an AutoSignOn option. When set, Connect signs on right
+// after connection is established
+func AutoSignOn() Option {
+	return func(o *Options) error {
+		o.AutoSignOn = true
+		return nil
+	}
+}
+
+// RequireSignOn sets a RequireSignOn option
+func RequireSignOn() Option {
+	return func(o *Options) error {
+		o.RequireSignOn = true
+		return nil
+	}
+}
+
+// AutoReconnect sets a ReconnectWait option
+func AutoReconnect(wait time.Duration) Option {
+	return func(o *Options) error {
+		o.ReconnectWait = wait
+		return nil
+	}
+}
+
+// ReversalBuilder sets a ReversalBuilder option
+func ReversalBuilder(builder func(original *iso8583.Message) (*iso8583.Message, error)) Option {
+	return func(o *Options) error {
+		o.ReversalBuilder = builder
+		return nil
+	}
+}
+
+// ReversalRetry sets ReversalBackoff and ReversalMaxAttempts options
+func ReversalRetry(backoff Backoff, maxAttempts int) Option {
+	return func(o *Options) error {
+		if maxAttempts < 0 {
+			return fmt.Errorf("max reversal attempts should not be negative: %d", maxAttempts)
+		}
+		o.ReversalBackoff = backoff
+		o.ReversalMaxAttempts = maxAttempts
+		return nil
+	}
+}
+
+// OnReversalFailed sets an OnReversalFailed option
+func OnReversalFailed(handler func(c *Connection, reversal *iso8583.Message, err error)) Option {
+	return func(o *Options) error {
+		o.OnReversalFailed = handler
+		return nil
+	}
+}
+
+// MaxReconnectAttempts sets a MaxReconnectAttempts option
+func MaxReconnectAttempts(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("max reconnect attempts should not be negative: %d", n)
+		}
+		o.MaxReconnectAttempts = n
+		return nil
+	}
+}
+
+// ResubmitOnReconnect sets a ResubmitOnReconnect option. Use it only when
+// server handles repeated requests as duplicates.
+func ResubmitOnReconnect() Option {
+	return func(o *Options) error {
+		o.ResubmitOnReconnect = true
+		return nil
+	}
+}
+
+// MaxConnectionAge sets a MaxConnectionAge option
+func MaxConnectionAge(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("max connection age should be positive: %s", d)
+		}
+		o.MaxConnectionAge = d
+		return nil
+	}
+}
+
+// OnConnectionRotated sets an OnConnectionRotated option
+func OnConnectionRotated(h func(c *Connection, age time.Duration)) Option {
+	return func(o *Options) error {
+		o.OnConnectionRotated = h
+		return nil
+	}
+}
+
+// FailFastDuringReconnect sets a FailFastDuringReconnect option
+func FailFastDuringReconnect() Option {
+	return func(o *Options) error {
+		o.FailFastDuringReconnect = true
+		return nil
+	}
+}
+
+// RateLimit sets RateLimit and RateLimitBurst options
+func RateLimit(rps, burst int) Option {
+	return func(o *Options) error {
+		if rps <= 0 || burst <= 0 {
+			return fmt.Errorf("rate limit and burst should be positive, got: %d, %d", rps, burst)
+		}
+		o.RateLimit = rps
+		o.RateLimitBurst = burst
+		return nil
+	}
+}
+
+// RateLimitBypass sets a RateLimitBypass option
+func RateLimitBypass(bypass func(message *iso8583.Message) bool) Option {
+	return func(o *Options) error {
+		o.RateLimitBypass = bypass
+		return nil
+	}
+}
+
+// AutoSTAN sets an AutoSTAN option
+func AutoSTAN() Option {
+	return func(o *Options) error {
+		o.AutoSTAN = true
+		return nil
+	}
+}
+
+// ValidateMTI sets a ValidateMTI option
+func ValidateMTI() Option {
+	return func(o *Options) error {
+		o.ValidateMTI = true
+		return nil
+	}
+}
+
+// AutoRRN sets AutoRRN and RRNGenerator options. If generator is nil,
+// date-based RRNs with the sequence number are generated.
+func AutoRRN(generator func() string) Option {
+	return func(o *Options) error {
+		o.AutoRRN = true
+		o.RRNGenerator = generator
+		return nil
+	}
+}
+
+// STANRange sets MinSTAN and MaxSTAN options
+func STANRange(min, max int) Option {
+	return func(o *Options) error {
+		if min < 1 || max > 999999 || min > max {
+			return fmt.Errorf("STAN range should be within 1-999999, got: %d-%d", min, max)
+		}
+		o.MinSTAN = min
+		o.MaxSTAN = max
+		return nil
+	}
+}
+
+// STANPrefix sets a STANPrefix option. Prefix should be 1-5 characters
+// long.
+func STANPrefix(prefix string) Option {
+	return func(o *Options) error {
+		if len(prefix) < 1 || len(prefix) >= stanWidth {
+			return fmt.Errorf("STAN prefix should be 1-%d characters long, got: %q", stanWidth-1, prefix)
+		}
+		o.STANPrefix = prefix
+		return nil
+	}
+}
+
+// SetSTANProvider sets a STANProvider option
+func SetSTANProvider(provider STANProvider) Option {
+	return func(o *Options) error {
+		o.STANProvider = provider
+		return nil
+	}
+}
+
+// CorrelationField sets a CorrelationField option
+func CorrelationField(id int) Option {
+	return func(o *Options) error {
+		o.CorrelationField = id
+		return nil
+	}
+}
+
+// AutoCorrelationID sets CorrelationField and AutoCorrelationID options.
+// Send sets the field to a new UUID if it's not set.
+func AutoCorrelationID(fieldID int) Option {
+	return func(o *Options) error {
+		o.CorrelationField = fieldID
+		o.AutoCorrelationID = true
+		return nil
+	}
+}
+
+// RequestIDFunc sets a RequestIDFunc option
+func RequestIDFunc(f func(message *iso8583.Message) (string, error)) Option {
+	return func(o *Options) error {
+		o.RequestIDFunc = f
+		return nil
+	}
+}
+
+// STANDateCorrelation sets a STANDateCorrelation option
+func STANDateCorrelation() Option {
+	return func(o *Options) error {
+		o.STANDateCorrelation = true
+		return nil
+	}
+}
+
+// OnSTANExhausted sets an OnSTANExhausted option
+func OnSTANExhausted(h func(c *Connection)) Option {
+	return func(o *Options) error {
+		o.OnSTANExhausted = h
+		return nil
+	}
+}
+
 func defaultTLSConfig() *tls.Config {
 	return &tls.Config{
 		MinVersion: tls.VersionTLS12,
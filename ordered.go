@@ -0,0 +1,58 @@
+package connection
+
+import (
+	"sync"
+
+	"github.com/moov-io/iso8583"
+)
+
+// orderedSends serializes requests sent with SendOrdered per session key
+type orderedSends struct {
+	mu sync.Mutex
+
+	// done channel of the last request of each session key. It's closed
+	// when the request is sent, so the next request of the session key
+	// can be sent.
+	last map[string]chan struct{}
+}
+
+// acquire waits until previous requests of the sessionKey are sent. It
+// returns the function that should be called when the request is sent.
+func (o *orderedSends) acquire(sessionKey string) func() {
+	done := make(chan struct{})
+
+	o.mu.Lock()
+	if o.last == nil {
+		o.last = make(map[string]chan struct{})
+	}
+	prev := o.last[sessionKey]
+	o.last[sessionKey] = done
+	o.mu.Unlock()
+
+	if prev != nil {
+		<-prev
+	}
+
+	return func() {
+		close(done)
+
+		o.mu.Lock()
+		if o.last[sessionKey] == done {
+			delete(o.last, sessionKey)
+		}
+		o.mu.Unlock()
+	}
+}
+
+// SendOrdered sends message like Send, but requests with the same
+// sessionKey are sent one after another in the order SendOrdered was
+// called: the next request is written into the connection after the
+// previous one got its response (or error). Use it for hosts that require
+// requests of the logical session to arrive in order. Requests with
+// different session keys are sent concurrently.
+func (c *Connection) SendOrdered(sessionKey string, message *iso8583.Message) (*iso8583.Message, error) {
+	release := c.ordered.acquire(sessionKey)
+	defer release()
+
+	return c.Send(message)
+}
@@ -0,0 +1,93 @@
+package connection_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_SendOrdered(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+
+	// server replies to the requests of session "a" with delay, so
+	// requests would overtake each other if they were not serialized
+	handler := func(c *connection.Connection, message *iso8583.Message) {
+		label, err := message.GetString(63)
+		require.NoError(t, err)
+
+		mu.Lock()
+		received = append(received, label)
+		mu.Unlock()
+
+		delay := 10 * time.Millisecond
+		if strings.HasPrefix(label, "a") {
+			delay = 100 * time.Millisecond
+		}
+
+		go func() {
+			time.Sleep(delay)
+			message.MTI("0810")
+			c.Reply(message)
+		}()
+	}
+
+	srv := server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(handler))
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(2*time.Second),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	sendOrdered := func(sessionKey, label string) error {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		if err := message.Field(11, getSTAN()); err != nil {
+			return err
+		}
+		if err := message.Field(63, label); err != nil {
+			return err
+		}
+
+		_, err := c.SendOrdered(sessionKey, message)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+
+	for _, label := range []string{"a0001", "a0002", "a0003"} {
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			errs <- sendOrdered("a", label)
+		}(label)
+
+		// let SendOrdered get its turn before the next one is called
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// request of another session is not blocked by session "a"
+	require.NoError(t, sendOrdered("b", "b0001"))
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Equal(t, []string{"a0001", "b0001", "a0002", "a0003"}, received)
+}
@@ -0,0 +1,44 @@
+package connection
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// goCallback calls the user callback f in a new goroutine. Panic of f is
+// recovered and passed to the PanicHandler.
+func (c *Connection) goCallback(f func()) {
+	go c.callback(f)
+}
+
+// callback calls the user callback f and recovers its panic, so it doesn't
+// break the connection loops. Recovered panic is passed to the
+// PanicHandler. It returns true if f panicked.
+func (c *Connection) callback(f func()) (panicked bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			panicked = true
+			c.handlePanic(recovered, debug.Stack())
+		}
+	}()
+
+	f()
+
+	return false
+}
+
+// handlePanic passes the recovered panic to the PanicHandler or logs it
+// when PanicHandler is not set
+func (c *Connection) handlePanic(recovered interface{}, stack []byte) {
+	if c.Opts.PanicHandler != nil {
+		c.Opts.PanicHandler(recovered, stack)
+		return
+	}
+
+	name := c.Opts.Name
+	if name == "" {
+		name = c.Addr()
+	}
+
+	log.Printf("connection %s: panic in callback: %v\n%s", name, recovered, stack)
+}
@@ -0,0 +1,132 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_PanicHandler(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	defer echo.Close()
+
+	panics := make(chan interface{}, 1)
+	stacks := make(chan []byte, 1)
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(500*time.Millisecond),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			panic("handler failed")
+		}),
+		connection.PanicHandler(func(recovered interface{}, stack []byte) {
+			panics <- recovered
+			stacks <- stack
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	// server sends request to the client, so client's handler panics
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, getSTAN()))
+	require.NoError(t, echo.Reply(message))
+
+	select {
+	case recovered := <-panics:
+		require.Equal(t, "handler failed", recovered)
+		require.Contains(t, string(<-stacks), "panic_test.go")
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("PanicHandler was not called")
+	}
+
+	// connection still works
+	message = iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, getSTAN()))
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+}
+
+func TestConnection_RequestIDFuncPanic(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	defer echo.Close()
+
+	panics := make(chan interface{}, 2)
+	errs := make(chan error, 1)
+
+	// request ID function panics on messages with malformed test case
+	// code
+	requestID := func(message *iso8583.Message) (string, error) {
+		if code, _ := message.GetString(2); code == "bad" {
+			panic("malformed message")
+		}
+
+		return message.GetString(11)
+	}
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(500*time.Millisecond),
+		connection.RequestIDFunc(requestID),
+		connection.PanicHandler(func(recovered interface{}, stack []byte) {
+			panics <- recovered
+		}),
+		connection.ErrorHandler(func(err error) {
+			errs <- err
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func(t *testing.T, mti, code string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("Send returns error when request ID function panics", func(t *testing.T) {
+		_, err := c.Send(newMessage(t, "0800", "bad"))
+		require.ErrorContains(t, err, "request ID function panicked")
+		require.Equal(t, "malformed message", <-panics)
+	})
+
+	t.Run("received message is handled as unmatched when request ID function panics", func(t *testing.T) {
+		require.NoError(t, echo.Reply(newMessage(t, "0810", "bad")))
+
+		select {
+		case err := <-errs:
+			require.ErrorContains(t, err, "request ID function panicked")
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("error was not handled")
+		}
+		require.Equal(t, "malformed message", <-panics)
+
+		// read loop continues
+		_, err := c.Send(newMessage(t, "0800", TestCaseReply))
+		require.NoError(t, err)
+	})
+}
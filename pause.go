@@ -0,0 +1,95 @@
+package connection
+
+import (
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// networkManagementClass is the message class (second digit of the MTI) of
+// network management messages, e.g. 0800 echo test
+const networkManagementClass = '8'
+
+// Pause stops sending of new requests while keeping the connection alive.
+// Send calls wait until Resume is called (no longer than SendTimeout) or
+// return ErrPaused right away when FailWhenPaused is set. Replies, network
+// management messages (e.g. pings and sign-on) and received messages are
+// not affected.
+func (c *Connection) Pause() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.resumeCh == nil {
+		c.resumeCh = make(chan struct{})
+	}
+}
+
+// Resume resumes sending of requests paused with Pause
+func (c *Connection) Resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.resumeLocked()
+}
+
+// Paused returns true if sending of requests is paused
+func (c *Connection) Paused() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.resumeCh != nil
+}
+
+// resumeLocked releases Send calls waiting for Resume. c.mutex should be
+// locked.
+func (c *Connection) resumeLocked() {
+	if c.resumeCh != nil {
+		close(c.resumeCh)
+		c.resumeCh = nil
+	}
+}
+
+// waitResumed waits until sending of the message is resumed. It returns
+// ErrPaused if it can't wait (failFast or FailWhenPaused) or sendTimeout
+// passes first.
+func (c *Connection) waitResumed(message *iso8583.Message, failFast bool, sendTimeout <-chan time.Time) error {
+	if isNetworkManagement(message) {
+		return nil
+	}
+
+	c.mutex.Lock()
+	resumeCh := c.resumeCh
+	c.mutex.Unlock()
+
+	if resumeCh == nil {
+		return nil
+	}
+
+	if failFast || c.Opts.FailWhenPaused {
+		return ErrPaused
+	}
+
+	select {
+	case <-resumeCh:
+	case <-sendTimeout:
+		return ErrPaused
+	}
+
+	// connection may be closed while we were waiting
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closing {
+		return ErrConnectionClosed
+	}
+
+	return nil
+}
+
+// isNetworkManagement returns true for network management messages
+// (0800, 0810 etc.)
+func isNetworkManagement(message *iso8583.Message) bool {
+	mti, _ := message.GetMTI()
+
+	return len(mti) == 4 && mti[1] == networkManagementClass
+}
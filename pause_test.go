@@ -0,0 +1,141 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_Pause(t *testing.T) {
+	// echo server that replies to all requests
+	newEcho := func(t *testing.T, conn net.Conn) *connection.Connection {
+		echo, err := connection.NewFrom(conn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				mti, err := message.GetMTI()
+				require.NoError(t, err)
+
+				message.MTI(mti[:2] + "1" + mti[3:])
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+
+		return echo
+	}
+
+	newMessage := func(t *testing.T, mti string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("Send waits until sending is resumed", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		echo := newEcho(t, serverConn)
+		defer echo.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(time.Second),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		c.Pause()
+		require.True(t, c.Paused())
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.Send(newMessage(t, "0200"))
+			done <- err
+		}()
+
+		require.Never(t, func() bool {
+			return len(done) > 0
+		}, 100*time.Millisecond, 10*time.Millisecond)
+
+		// network management messages (e.g. pings) are not paused
+		response, err := c.Send(newMessage(t, "0800"))
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+
+		c.Resume()
+		require.False(t, c.Paused())
+
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Send was not resumed")
+		}
+	})
+
+	t.Run("Send returns ErrPaused when it can't wait for Resume", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		echo := newEcho(t, serverConn)
+		defer echo.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(100*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		c.Pause()
+
+		// SendTimeout passes while paused
+		_, err = c.Send(newMessage(t, "0200"))
+		require.ErrorIs(t, err, connection.ErrPaused)
+
+		// FailWhenPaused makes Send fail right away
+		require.NoError(t, c.SetOptions(connection.FailWhenPaused()))
+
+		start := time.Now()
+		_, err = c.Send(newMessage(t, "0200"))
+		require.ErrorIs(t, err, connection.ErrPaused)
+		require.Less(t, time.Since(start), 50*time.Millisecond)
+
+		c.Resume()
+
+		_, err = c.Send(newMessage(t, "0200"))
+		require.NoError(t, err)
+	})
+
+	t.Run("Close releases paused Send", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		echo := newEcho(t, serverConn)
+		defer echo.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(5*time.Second),
+		)
+		require.NoError(t, err)
+
+		c.Pause()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.Send(newMessage(t, "0200"))
+			done <- err
+		}()
+
+		// let Send wait for Resume
+		time.Sleep(50 * time.Millisecond)
+
+		start := time.Now()
+		require.NoError(t, c.Close())
+		require.Less(t, time.Since(start), time.Second)
+		require.ErrorIs(t, <-done, connection.ErrConnectionClosed)
+	})
+}
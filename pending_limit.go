@@ -0,0 +1,96 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// pendingSlots tracks the number of requests that are being sent (see
+// MaxPendingRequests)
+type pendingSlots struct {
+	mu    sync.Mutex
+	count int
+
+	// closed and replaced when slot is released to wake up waiting
+	// callers
+	releasedCh chan struct{}
+}
+
+// acquire takes the slot for the request. It returns
+// ErrTooManyPendingRequests if all max slots are taken.
+func (s *pendingSlots) acquire(max int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count >= max {
+		return ErrTooManyPendingRequests
+	}
+	s.count++
+
+	return nil
+}
+
+// release frees the slot of the request
+func (s *pendingSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.count--
+	if s.releasedCh != nil {
+		close(s.releasedCh)
+		s.releasedCh = nil
+	}
+}
+
+// wait waits until at least n of max slots are free, ctx is done or done
+// channel is closed
+func (s *pendingSlots) wait(ctx context.Context, n, max int, done <-chan struct{}) error {
+	for {
+		s.mu.Lock()
+		if max-s.count >= n {
+			s.mu.Unlock()
+			return nil
+		}
+		if s.releasedCh == nil {
+			s.releasedCh = make(chan struct{})
+		}
+		releasedCh := s.releasedCh
+		s.mu.Unlock()
+
+		select {
+		case <-releasedCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return ErrConnectionClosed
+		}
+	}
+}
+
+// WaitForCapacity blocks until at least n requests can be sent without
+// exceeding MaxPendingRequests, ctx is done or connection is closed. It
+// lets callers pace bursts of requests instead of getting
+// ErrTooManyPendingRequests. Capacity is not reserved: concurrent Send
+// calls may take the free slots before the caller. Without
+// MaxPendingRequests it returns right away.
+func (c *Connection) WaitForCapacity(ctx context.Context, n int) error {
+	c.mutex.Lock()
+	closing := c.closing
+	c.mutex.Unlock()
+
+	if closing {
+		return ErrConnectionClosed
+	}
+
+	max := c.Opts.MaxPendingRequests
+	if max == 0 {
+		return nil
+	}
+
+	if n > max {
+		return fmt.Errorf("waiting for %d slots: %w: max pending requests %d", n, ErrTooManyPendingRequests, max)
+	}
+
+	return c.pending.wait(ctx, n, max, c.done)
+}
@@ -0,0 +1,96 @@
+package connection_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_MaxPendingRequests(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	newMessage := func(t *testing.T, code string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(2*time.Second),
+		connection.MaxPendingRequests(2),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	// capacity is available right away
+	require.NoError(t, c.WaitForCapacity(context.Background(), 2))
+
+	// delayed requests take all slots
+	sendErrs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		message := newMessage(t, TestCaseDelayedResponse)
+		go func() {
+			_, err := c.Send(message)
+			sendErrs <- err
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return c.Stats().Pending == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = c.Send(newMessage(t, TestCaseReply))
+	require.ErrorIs(t, err, connection.ErrTooManyPendingRequests)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, c.WaitForCapacity(ctx, 1), context.DeadlineExceeded)
+
+	// waiting for capacity returns when delayed requests complete
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, c.WaitForCapacity(ctx, 2))
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-sendErrs)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = c.Send(newMessage(t, TestCaseReply))
+		require.NoError(t, err)
+	}
+
+	t.Run("more slots than the limit", func(t *testing.T) {
+		err := c.WaitForCapacity(context.Background(), 3)
+		require.ErrorIs(t, err, connection.ErrTooManyPendingRequests)
+	})
+
+	t.Run("without limit capacity is always available", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.NoError(t, c.WaitForCapacity(context.Background(), 1000))
+	})
+
+	t.Run("closed connection has no capacity", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.MaxPendingRequests(1),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		require.NoError(t, c.Close())
+
+		err = c.WaitForCapacity(context.Background(), 1)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+	})
+}
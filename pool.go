@@ -249,15 +249,16 @@ func (p *Pool) Done() <-chan struct{} {
 	return p.done
 }
 
-// filteredConnections returns filtered connections
+// filteredConnections returns filtered connections. Connections that fail
+// fast during reconnect are skipped while they are reconnecting.
 func (p *Pool) filteredConnections() []*Connection {
-	if p.Opts.ConnectionsFilter == nil {
-		return p.Connections()
-	}
-
 	var conns []*Connection
 	for _, conn := range p.Connections() {
-		if p.Opts.ConnectionsFilter(conn) {
+		if conn.Opts.FailFastDuringReconnect && conn.Reconnecting() {
+			continue
+		}
+
+		if p.Opts.ConnectionsFilter == nil || p.Opts.ConnectionsFilter(conn) {
 			conns = append(conns, conn)
 		}
 	}
@@ -8,6 +8,7 @@ import (
 
 	"time"
 
+	"github.com/moov-io/iso8583"
 	connection "github.com/moov-io/iso8583-connection"
 	"github.com/stretchr/testify/require"
 )
@@ -277,4 +278,49 @@ func TestPool(t *testing.T) {
 		// should be degraded
 		require.True(t, pool.IsDegraded())
 	})
+
+	t.Run("Get() skips connections that fail fast while reconnecting", func(t *testing.T) {
+		droppingSrv := newDroppingServer(t)
+		defer droppingSrv.Close()
+
+		factory := func(addr string) (*connection.Connection, error) {
+			return connection.New(
+				addr,
+				testSpec,
+				readMessageLength,
+				writeMessageLength,
+				connection.AutoReconnect(time.Second),
+				connection.FailFastDuringReconnect(),
+			)
+		}
+
+		pool, err := connection.NewPool(factory, []string{droppingSrv.Addr, addrs[0]})
+		require.NoError(t, err)
+
+		require.NoError(t, pool.Connect())
+		defer pool.Close()
+
+		// make dropping server close the connection
+		for _, conn := range pool.Connections() {
+			if conn.Addr() != droppingSrv.Addr {
+				continue
+			}
+
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(11, getSTAN()))
+
+			_, err = conn.Send(message)
+			require.ErrorIs(t, err, connection.ErrConnectionClosed)
+			require.True(t, conn.Reconnecting())
+		}
+
+		for i := 0; i < 2; i++ {
+			conn, err := pool.Get()
+			require.NoError(t, err)
+			require.Equal(t, addrs[0], conn.Addr())
+		}
+
+		require.True(t, pool.IsDegraded())
+	})
 }
@@ -0,0 +1,52 @@
+package connection
+
+import (
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// rateLimiter is a token bucket that limits the rate of writes. It's used
+// by a single write loop, so it's not safe for concurrent use.
+type rateLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rps, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rps),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// reserve takes a token and returns the time to wait before the write is
+// allowed
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// rateLimited returns true if writing the message should be rate limited
+func (c *Connection) rateLimited(message *iso8583.Message) bool {
+	if c.Opts.RateLimitBypass == nil || message == nil {
+		return true
+	}
+
+	return !c.Opts.RateLimitBypass(message)
+}
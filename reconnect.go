@@ -0,0 +1,347 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/moov-io/iso8583"
+)
+
+// reconnectEnabled returns true if network connection should be
+// re-established when it's lost. Connections created with NewFrom can't be
+// re-established as they have no address to dial, as well as attached ones.
+// It should be called with c.mutex locked.
+func (c *Connection) reconnectEnabled() bool {
+	return c.Opts.ReconnectWait > 0 && c.addr != "" && !c.attached
+}
+
+// Reconnecting returns true if network connection was lost and it's being
+// re-established in the background (see AutoReconnect)
+func (c *Connection) Reconnecting() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.reconnecting
+}
+
+// dropSession stops the loops of the current network connection and closes
+// it. It should be called with c.mutex locked.
+func (c *Connection) dropSession() {
+	close(c.sessionDone)
+	c.sessionDone = nil
+
+	// connections are dropped, so the errors are not important
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+
+	if c.readConn != nil {
+		_ = c.readConn.Close()
+		c.readConn = nil
+	}
+
+	c.reconnecting = true
+	c.signedOnSession = nil
+}
+
+// Failed returns true if connection was closed because network connection
+// was not re-established within MaxReconnectAttempts
+func (c *Connection) Failed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.failed
+}
+
+// reconnect re-establishes network connection every ReconnectWait until it
+// succeeds, connection is closed or MaxReconnectAttempts fail. Pending
+// requests are resubmitted when ResubmitOnReconnect is set
+func (c *Connection) reconnect() {
+	for {
+		select {
+		case <-c.Opts.Clock.After(c.Opts.ReconnectWait):
+		case <-c.done:
+			return
+		}
+
+		conn, readConn, err := c.dialConns(context.Background())
+		if err != nil {
+			c.handleError(fmt.Errorf("reconnecting: %w", err))
+
+			if c.attemptFailed(err) {
+				return
+			}
+
+			continue
+		}
+
+		// errors after network connection was established are handled
+		// by reestablish as connection errors, which start reconnect
+		// again, so the attempt is counted for it
+		if err := c.reestablish(conn, readConn); err != nil && !errors.Is(err, ErrConnectionClosed) {
+			c.attemptFailed(err)
+		}
+
+		return
+	}
+}
+
+// attemptFailed counts the failed attempt to re-establish network
+// connection. It closes the connection and returns true when
+// MaxReconnectAttempts consecutive attempts failed.
+func (c *Connection) attemptFailed(err error) bool {
+	c.mutex.Lock()
+	c.reconnectAttempts++
+	failed := c.Opts.MaxReconnectAttempts > 0 && c.reconnectAttempts >= c.Opts.MaxReconnectAttempts
+	c.mutex.Unlock()
+
+	if failed {
+		c.fail(err)
+	}
+
+	return failed
+}
+
+// fail closes the connection after MaxReconnectAttempts failed with the
+// error of the last attempt
+func (c *Connection) fail(err error) {
+	c.mutex.Lock()
+	if c.closing {
+		c.mutex.Unlock()
+		return
+	}
+	c.closing = true
+	c.failed = true
+	c.reconnecting = false
+	c.lastError = err
+	// release Send calls waiting for Resume
+	c.resumeLocked()
+	c.mutex.Unlock()
+
+	_ = c.shutdown(false, ErrConnectionFailed)
+}
+
+// Reconnect drops the current network connection and establishes the new
+// one, e.g. after the server configuration was changed. Requests waiting
+// for responses get ErrConnectionReset, unless ResubmitOnReconnect is
+// set. Send calls made during reconnect wait for the new network
+// connection (or get ErrReconnecting with FailFastDuringReconnect). If new
+// network connection can't be established, it returns error and, with
+// AutoReconnect, keeps reconnecting in the background. Connections
+// created with NewFrom or attached can't be reconnected.
+func (c *Connection) Reconnect() error {
+	c.mutex.Lock()
+	switch {
+	case c.closing:
+		c.mutex.Unlock()
+		return ErrConnectionClosed
+	case c.addr == "" || c.attached:
+		c.mutex.Unlock()
+		return c.withName(errors.New("connection has no address to reconnect to"))
+	case c.reconnecting:
+		c.mutex.Unlock()
+		return ErrReconnecting
+	}
+
+	if c.sessionDone != nil {
+		c.dropSession()
+	} else {
+		c.reconnecting = true
+	}
+	c.mutex.Unlock()
+
+	if !c.Opts.ResubmitOnReconnect {
+		c.failPendingRequests(ErrConnectionReset)
+	}
+
+	conn, readConn, err := c.dialConns(context.Background())
+	if err != nil {
+		c.mutex.Lock()
+		autoReconnect := c.reconnectEnabled() && !c.closing
+		if !autoReconnect {
+			c.reconnecting = false
+		}
+		c.mutex.Unlock()
+
+		if autoReconnect {
+			go c.reconnect()
+		}
+
+		return c.withName(fmt.Errorf("reconnecting: %w", err))
+	}
+
+	if err := c.reestablish(conn, readConn); err != nil {
+		return c.withName(err)
+	}
+
+	return nil
+}
+
+// reestablish starts the loops of the re-established network connections
+// and calls OnConnect. If connection is closed meanwhile, network
+// connections are closed and ErrConnectionClosed is returned. Errors of
+// OnConnect and sign-on are handled as connection errors and returned.
+func (c *Connection) reestablish(conn, readConn net.Conn) error {
+	c.mutex.Lock()
+	if c.closing {
+		c.mutex.Unlock()
+		_ = conn.Close()
+		if readConn != nil {
+			_ = readConn.Close()
+		}
+		return ErrConnectionClosed
+	}
+	c.conn = conn
+	c.readConn = readConn
+	c.reconnecting = false
+	c.lastError = nil
+	c.mutex.Unlock()
+
+	c.stats.reconnects.Add(1)
+
+	sessionDone := c.run()
+
+	if err := c.prepareSession(sessionDone); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.reconnectAttempts = 0
+	c.mutex.Unlock()
+
+	if c.Opts.ResubmitOnReconnect {
+		c.resubmitPending(sessionDone)
+	}
+
+	if c.Opts.ConnectionEstablishedHandler != nil {
+		c.goCallback(func() { c.Opts.ConnectionEstablishedHandler(c) })
+	}
+
+	return nil
+}
+
+// prepareSession probes readiness, calls OnConnect and signs on over the
+// network connection of the sessionDone that was established after the
+// previous one. Errors are handled as connection errors and returned.
+func (c *Connection) prepareSession(sessionDone chan struct{}) error {
+	if c.Opts.ReadinessProbe {
+		if err := c.Echo(context.Background()); err != nil {
+			err = fmt.Errorf("%w: echo %s: %v", ErrNotReady, c.Addr(), err)
+			c.handleConnectionError(sessionDone, err)
+			return err
+		}
+	}
+
+	if c.Opts.OnConnect != nil {
+		if err := c.Opts.OnConnect(c); err != nil {
+			err = fmt.Errorf("on connect callback %s: %w", c.Addr(), err)
+			c.handleConnectionError(sessionDone, err)
+			return err
+		}
+	}
+
+	if c.Opts.AutoSignOn {
+		if err := c.autoSignOn(); err != nil {
+			err = fmt.Errorf("auto sign-on %s: %w", c.Addr(), err)
+			c.handleConnectionError(sessionDone, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resubmitPending queues requests that are still waiting for responses for
+// writing into the new network connection. Requests are resubmitted with
+// the repeat MTI and the same reply channels, so the original Send calls
+// receive the responses.
+func (c *Connection) resubmitPending(sessionDone chan struct{}) {
+	c.pendingRequestsMu.Lock()
+	reqs := make([]request, 0, len(c.respMap))
+	for reqID, resp := range c.respMap {
+		// expected responses don't have requests to resubmit
+		if resp.expected {
+			continue
+		}
+		reqs = append(reqs, request{
+			requestID: reqID,
+			replyCh:   resp.replyCh,
+			errCh:     resp.errCh,
+			message:   resp.message,
+			resubmit:  true,
+			traceID:   resp.traceID,
+
+			lengthWriter: resp.lengthWriter,
+		})
+	}
+	c.pendingRequestsMu.Unlock()
+
+	for _, req := range reqs {
+		rawMessage, err := c.repeatMessage(req.message, req.lengthWriter)
+		if err != nil {
+			c.handleError(fmt.Errorf("resubmitting request %s: %w", req.requestID, err))
+			continue
+		}
+
+		req.rawMessage = rawMessage
+		req.enqueuedAt = c.Opts.Clock.Now()
+
+		select {
+		case c.requestsCh <- req:
+		case <-sessionDone:
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// repeatMessage returns framed copy of the message with the repeat MTI. Its
+// length header is written by the lengthWriter unless it's nil.
+func (c *Connection) repeatMessage(message *iso8583.Message, lengthWriter MessageLengthWriter) ([]byte, error) {
+	repeat, err := message.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("cloning message: %w", err)
+	}
+
+	mti, err := repeat.GetMTI()
+	if err != nil {
+		return nil, fmt.Errorf("getting MTI: %w", err)
+	}
+	repeat.MTI(repeatMTI(mti))
+
+	packed, err := repeat.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	return c.frameMessageWith(packed, lengthWriter)
+}
+
+// repeatMTI returns the MTI with the repeat message origin, e.g. 0201 for
+// 0200 or 0403 for 0402. MTI that is already a repeat is returned as is.
+func repeatMTI(mti string) string {
+	if len(mti) != 4 {
+		return mti
+	}
+
+	switch origin := mti[3]; origin {
+	case '0', '2', '4':
+		return mti[:3] + string(origin+1)
+	}
+
+	return mti
+}
+
+// isDone returns true if the done channel is closed
+func isDone(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,671 @@
+package connection_test
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/moov-io/iso8583/field"
+	"github.com/stretchr/testify/require"
+)
+
+// droppingServer closes the connection when it receives 0800 request
+// without reply and replies to all other requests. It records MTIs of the
+// received requests.
+type droppingServer struct {
+	*server.Server
+
+	mu           sync.Mutex
+	receivedMTIs []string
+}
+
+func newDroppingServer(t *testing.T) *droppingServer {
+	t.Helper()
+
+	srv := &droppingServer{}
+
+	handler := func(c *connection.Connection, message *iso8583.Message) {
+		mti, err := message.GetMTI()
+		require.NoError(t, err)
+
+		srv.mu.Lock()
+		srv.receivedMTIs = append(srv.receivedMTIs, mti)
+		srv.mu.Unlock()
+
+		if mti == "0800" {
+			c.Close()
+			return
+		}
+
+		message.MTI("0810")
+		c.Reply(message)
+	}
+
+	srv.Server = server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(handler))
+	require.NoError(t, srv.Start("127.0.0.1:"))
+
+	return srv
+}
+
+func (s *droppingServer) ReceivedMTIs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.receivedMTIs...)
+}
+
+func TestConnection_Reconnect(t *testing.T) {
+	t.Run("it reconnects when connection is closed by server", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		established := make(chan struct{}, 1)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(50*time.Millisecond),
+			connection.ConnectionEstablishedHandler(func(c *connection.Connection) {
+				established <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+		<-established
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		select {
+		case <-established:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not re-established")
+		}
+
+		// connection is not closed and can be used after reconnect
+		select {
+		case <-c.Done():
+			t.Fatal("connection was closed")
+		default:
+		}
+
+		message = iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+
+	t.Run("pending requests get ErrConnectionClosed without ResubmitOnReconnect", func(t *testing.T) {
+		srv := newDroppingServer(t)
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(50*time.Millisecond),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+		require.ErrorIs(t, err, connection.ErrConnectionReset)
+		require.Equal(t, []string{"0800"}, srv.ReceivedMTIs())
+	})
+
+	t.Run("LastError returns the error that terminated the connection until it's re-established", func(t *testing.T) {
+		srv := newDroppingServer(t)
+		defer srv.Close()
+
+		established := make(chan struct{}, 1)
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(200*time.Millisecond),
+			connection.ConnectionEstablishedHandler(func(c *connection.Connection) {
+				established <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+		<-established
+
+		require.NoError(t, c.LastError())
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+
+		require.Error(t, c.LastError())
+
+		select {
+		case <-established:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not re-established")
+		}
+
+		require.NoError(t, c.LastError())
+	})
+
+	t.Run("FailFastDuringReconnect makes Send fail right away while reconnecting", func(t *testing.T) {
+		srv := newDroppingServer(t)
+		defer srv.Close()
+
+		established := make(chan struct{}, 1)
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(300*time.Millisecond),
+			connection.FailFastDuringReconnect(),
+			connection.SendTimeout(time.Second),
+			connection.ConnectionEstablishedHandler(func(c *connection.Connection) {
+				established <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+		<-established
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+		require.True(t, c.Reconnecting())
+
+		message = iso8583.NewMessage(testSpec)
+		message.MTI("0200")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		start := time.Now()
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrReconnecting)
+		require.Less(t, time.Since(start), 100*time.Millisecond)
+
+		select {
+		case <-established:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not re-established")
+		}
+		require.False(t, c.Reconnecting())
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+
+	t.Run("it gives up after MaxReconnectAttempts when sign-on is declined", func(t *testing.T) {
+		srv := newNetworkManagementServer(t, "00")
+		defer srv.Close()
+
+		closed := make(chan struct{})
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSignOn(),
+			connection.AutoReconnect(20*time.Millisecond),
+			connection.MaxReconnectAttempts(2),
+			connection.ConnectionClosedHandler(func(c *connection.Connection) {
+				close(closed)
+			}),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		// server accepts network connections, but declines sign-on
+		srv.SetResponseCode("05")
+		require.ErrorContains(t, c.Reconnect(), "declined with response code: 05")
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+
+		require.True(t, c.Failed())
+		require.ErrorContains(t, c.LastError(), "declined with response code: 05")
+
+		// sign-on of Connect, of Reconnect and of the 2 reconnect attempts
+		require.Len(t, srv.ReceivedCodes(), 4)
+	})
+
+	t.Run("it gives up after MaxReconnectAttempts", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+
+		var mu sync.Mutex
+		var attempts int
+		closed := make(chan struct{})
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(20*time.Millisecond),
+			connection.MaxReconnectAttempts(3),
+			connection.ErrorHandler(func(err error) {
+				if strings.HasPrefix(err.Error(), "reconnecting:") {
+					mu.Lock()
+					attempts++
+					mu.Unlock()
+				}
+			}),
+			connection.ConnectionClosedHandler(func(c *connection.Connection) {
+				close(closed)
+			}),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		// server closes the connection and never comes back
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+		server.Close()
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return attempts == 3
+		}, 500*time.Millisecond, 10*time.Millisecond)
+
+		require.True(t, c.Failed())
+		require.False(t, c.Reconnecting())
+		require.Error(t, c.LastError())
+
+		message = iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrConnectionFailed)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+
+		select {
+		case <-c.Done():
+		default:
+			t.Fatal("connection is not done")
+		}
+	})
+
+	t.Run("ResubmitOnReconnect resubmits pending requests with repeat MTI", func(t *testing.T) {
+		srv := newDroppingServer(t)
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(50*time.Millisecond),
+			connection.ResubmitOnReconnect(),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		stan := getSTAN()
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, stan))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+
+		responseSTAN, err := response.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, stan, responseSTAN)
+
+		require.Equal(t, []string{"0800", "0801"}, srv.ReceivedMTIs())
+
+		// the original message is not changed
+		mti, err = message.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0800", mti)
+	})
+}
+
+func TestConnection_ManualReconnect(t *testing.T) {
+	t.Run("Reconnect fails in-flight requests and re-establishes connection", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(2*time.Second),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		sendErr := make(chan error, 1)
+		go func() {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			message.Field(2, TestCaseDelayedResponse)
+			message.Field(11, getSTAN())
+
+			_, err := c.Send(message)
+			sendErr <- err
+		}()
+
+		require.Eventually(t, func() bool {
+			return c.Stats().Pending == 1
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, c.Reconnect())
+
+		select {
+		case err := <-sendErr:
+			require.ErrorIs(t, err, connection.ErrConnectionReset)
+		case <-time.After(time.Second):
+			t.Fatal("in-flight request was not failed")
+		}
+
+		require.False(t, c.Reconnecting())
+		require.Equal(t, uint64(1), c.Stats().Reconnects)
+
+		// new requests are sent over the new network connection
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+
+	t.Run("partial frame of the dropped network connection is not reported", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		// server sends the header of 16 bytes message and only 2
+		// bytes of it into the first network connection
+		go func() {
+			for i := 0; ; i++ {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				if i == 0 {
+					conn.Write([]byte{0x00, 0x10, '0', '8'})
+				}
+			}
+		}()
+
+		var mu sync.Mutex
+		var handledErrs []error
+		loopExits := make(chan struct{}, 2)
+
+		c, err := connection.New(ln.Addr().String(), testSpec, readMessageLength, writeMessageLength,
+			connection.ErrorHandler(func(err error) {
+				mu.Lock()
+				handledErrs = append(handledErrs, err)
+				mu.Unlock()
+			}),
+			connection.OnReadLoopExit(func(c *connection.Connection, err error) {
+				loopExits <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		// let the read loop wait for the rest of the message
+		time.Sleep(50 * time.Millisecond)
+
+		require.NoError(t, c.Reconnect())
+
+		select {
+		case <-loopExits:
+		case <-time.After(time.Second):
+			t.Fatal("read loop of the dropped network connection didn't exit")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Empty(t, handledErrs)
+	})
+
+	t.Run("Reconnect returns error for connection without address", func(t *testing.T) {
+		c, err := connection.NewFrom(&TrackingRWCloser{}, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.EqualError(t, c.Reconnect(), "connection has no address to reconnect to")
+	})
+
+	t.Run("Reconnect returns error when connection is closed", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		require.NoError(t, c.Close())
+
+		require.ErrorIs(t, c.Reconnect(), connection.ErrConnectionClosed)
+	})
+}
+
+func TestConnection_RotateConnection(t *testing.T) {
+	oldServer, err := NewTestServer()
+	require.NoError(t, err)
+	defer oldServer.Close()
+
+	newServer := newDroppingServer(t)
+	defer newServer.Close()
+
+	var mu sync.Mutex
+	var connects int
+
+	c, err := connection.New(oldServer.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(2*time.Second),
+		connection.OnConnect(func(c *connection.Connection) error {
+			mu.Lock()
+			connects++
+			mu.Unlock()
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	// request in flight on the old network connection
+	delayedErr := make(chan error, 1)
+	go func() {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		if err == nil {
+			_, err = c.Send(message)
+		}
+		delayedErr <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		return c.Stats().Pending == 1
+	}, time.Second, 10*time.Millisecond)
+
+	rotateErr := make(chan error, 1)
+	go func() {
+		rotateErr <- c.RotateConnection(newServer.Addr, time.Second)
+	}()
+
+	// new requests are sent to the new server while old network
+	// connection is drained
+	require.Eventually(t, func() bool {
+		return c.Addr() == newServer.Addr
+	}, time.Second, 10*time.Millisecond)
+
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0200")
+	require.NoError(t, message.Field(11, getSTAN()))
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0200"}, newServer.ReceivedMTIs())
+
+	// in-flight request completes on the old network connection
+	require.NoError(t, <-delayedErr)
+	require.NoError(t, <-rotateErr)
+
+	mu.Lock()
+	require.Equal(t, 2, connects)
+	mu.Unlock()
+
+	t.Run("requests not answered within drain timeout are reset", func(t *testing.T) {
+		oldServer, err := NewTestServer()
+		require.NoError(t, err)
+		defer oldServer.Close()
+
+		c, err := connection.New(oldServer.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(2*time.Second),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		delayedErr := make(chan error, 1)
+		go func() {
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			if err == nil {
+				_, err = c.Send(message)
+			}
+			delayedErr <- err
+		}()
+
+		require.Eventually(t, func() bool {
+			return c.Stats().Pending == 1
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, c.RotateConnection(newServer.Addr, 50*time.Millisecond))
+		require.ErrorIs(t, <-delayedErr, connection.ErrConnectionReset)
+	})
+
+	t.Run("connection that is not established can't be rotated", func(t *testing.T) {
+		c, err := connection.New(oldServer.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.Error(t, c.RotateConnection(newServer.Addr, time.Second))
+	})
+}
+
+func TestConnection_MaxConnectionAge(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	rotated := make(chan time.Duration, 10)
+	var connects int32
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(2*time.Second),
+		connection.MaxConnectionAge(200*time.Millisecond),
+		connection.OnConnect(func(c *connection.Connection) error {
+			atomic.AddInt32(&connects, 1)
+			return nil
+		}),
+		connection.OnConnectionRotated(func(c *connection.Connection, age time.Duration) {
+			rotated <- age
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	// request in flight during the rotation is not failed
+	message := iso8583.NewMessage(testSpec)
+	err = message.Marshal(baseFields{
+		MTI:          field.NewStringValue("0800"),
+		TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+		STAN:         field.NewStringValue(getSTAN()),
+	})
+	require.NoError(t, err)
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+
+	// network connection is rotated on schedule
+	for i := 0; i < 2; i++ {
+		select {
+		case age := <-rotated:
+			require.GreaterOrEqual(t, age, 200*time.Millisecond)
+		case <-time.After(2 * time.Second):
+			t.Fatal("network connection was not rotated")
+		}
+	}
+
+	require.GreaterOrEqual(t, atomic.LoadInt32(&connects), int32(3))
+
+	message = iso8583.NewMessage(testSpec)
+	err = message.Marshal(baseFields{
+		MTI:          field.NewStringValue("0800"),
+		TestCaseCode: field.NewStringValue(TestCaseReply),
+		STAN:         field.NewStringValue(getSTAN()),
+	})
+	require.NoError(t, err)
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+}
@@ -0,0 +1,191 @@
+package connection
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583/field"
+)
+
+// DefaultReversalReason is the reversal reason (ResponseCodeField) set by
+// NewReversal: response was not received in time
+const DefaultReversalReason = "68"
+
+// reversalFields are the fields copied from the original message by
+// NewReversal: PAN, processing code, amounts, local date & time, POS entry
+// mode, acquirer ID, RRN, terminal ID, merchant ID and currency code
+var reversalFields = []int{2, 3, 4, 5, 6, 12, 13, 14, 22, 32, 37, 41, 42, 49, 50, 51}
+
+// defaultReversalBackoff is used when ReversalBackoff is not set
+var defaultReversalBackoff = ExponentialBackoff(time.Second, time.Minute)
+
+// NewReversal builds reversal (e.g. 0400 for 0200) of the original message.
+// Key fields (PAN, processing code, amounts, RRN, terminal and merchant
+// IDs, etc.) are copied from the original message, reversal reason
+// (ResponseCodeField) is set to DefaultReversalReason and original data
+// elements (field 90) are set if spec defines them. Reversal gets its own
+// STAN (field 11) and transmission date & time (field 7).
+func (c *Connection) NewReversal(original *iso8583.Message) (*iso8583.Message, error) {
+	mti, err := original.GetMTI()
+	if err != nil {
+		return nil, fmt.Errorf("getting MTI: %w", err)
+	}
+	if len(mti) != 4 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMTI, mti)
+	}
+
+	spec := original.GetSpec()
+	fields := original.GetFields()
+
+	reversal := iso8583.NewMessage(spec)
+	reversal.MTI(mti[:1] + "400")
+
+	for _, id := range reversalFields {
+		f, set := fields[id]
+		if !set {
+			continue
+		}
+
+		value, err := f.String()
+		if err != nil {
+			return nil, fmt.Errorf("getting field %d: %w", id, err)
+		}
+
+		if err := reversal.Field(id, value); err != nil {
+			return nil, fmt.Errorf("setting field %d: %w", id, err)
+		}
+	}
+
+	if _, ok := spec.Fields[c.Opts.ResponseCodeField]; ok {
+		if err := reversal.Field(c.Opts.ResponseCodeField, DefaultReversalReason); err != nil {
+			return nil, fmt.Errorf("setting reversal reason (field %d): %w", c.Opts.ResponseCodeField, err)
+		}
+	}
+
+	if _, ok := spec.Fields[90]; ok {
+		if err := reversal.Field(90, originalDataElements(mti, fields)); err != nil {
+			return nil, fmt.Errorf("setting original data elements (field 90): %w", err)
+		}
+	}
+
+	if _, ok := spec.Fields[7]; ok {
+		err := reversal.Field(7, c.transmissionDateTime(c.Opts.Clock.Now()))
+		if err != nil {
+			return nil, fmt.Errorf("setting transmission date & time (field 7): %w", err)
+		}
+	}
+
+	if err := c.setMessageSTAN(reversal); err != nil {
+		return nil, err
+	}
+
+	return reversal, nil
+}
+
+// originalDataElements returns original data elements (field 90) of the
+// original message: MTI, STAN, transmission date & time, acquirer and
+// forwarding institution IDs (each zero-padded to its size)
+func originalDataElements(mti string, fields map[int]field.Field) string {
+	value := func(id, size int) string {
+		f, set := fields[id]
+		if !set {
+			return strings.Repeat("0", size)
+		}
+
+		s, err := f.String()
+		if err != nil || len(s) > size {
+			return strings.Repeat("0", size)
+		}
+
+		return strings.Repeat("0", size-len(s)) + s
+	}
+
+	return mti + value(11, 6) + value(7, 10) + value(32, 11) + value(33, 11)
+}
+
+// QueueReversal builds reversal of the original message (e.g. after it
+// timed out) with the ReversalBuilder (NewReversal by default) and sends it
+// in the background until it's approved (see IsApproved). Failed attempts
+// are passed to the ErrorHandler and retried after the time returned by
+// the ReversalBackoff as repeats (e.g. 0401), also across reconnects. When
+// ReversalMaxAttempts fail or connection is closed, OnReversalFailed is
+// called with the last error.
+func (c *Connection) QueueReversal(original *iso8583.Message) error {
+	c.mutex.Lock()
+	closing := c.closing
+	c.mutex.Unlock()
+
+	if closing {
+		return ErrConnectionClosed
+	}
+
+	build := c.NewReversal
+	if c.Opts.ReversalBuilder != nil {
+		build = c.Opts.ReversalBuilder
+	}
+
+	reversal, err := build(original)
+	if err != nil {
+		return fmt.Errorf("building reversal: %w", err)
+	}
+
+	go c.sendReversal(reversal)
+
+	return nil
+}
+
+// sendReversal sends reversal until it's approved, ReversalMaxAttempts
+// fail or connection is closed
+func (c *Connection) sendReversal(reversal *iso8583.Message) {
+	backoff := c.Opts.ReversalBackoff
+	if backoff == nil {
+		backoff = defaultReversalBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		response, err := c.Send(reversal)
+		if err == nil {
+			err = c.checkResponseCode(response)
+		}
+		if err == nil {
+			return
+		}
+
+		c.handleError(fmt.Errorf("reversal attempt %d: %w", attempt, err))
+
+		if c.Opts.ReversalMaxAttempts > 0 && attempt >= c.Opts.ReversalMaxAttempts {
+			c.handleReversalFailed(reversal, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-c.done:
+			c.handleReversalFailed(reversal, ErrConnectionClosed)
+			return
+		}
+
+		c.mutex.Lock()
+		closing := c.closing
+		c.mutex.Unlock()
+
+		if closing {
+			c.handleReversalFailed(reversal, ErrConnectionClosed)
+			return
+		}
+
+		// following attempts are repeats
+		if mti, err := reversal.GetMTI(); err == nil {
+			reversal.MTI(repeatMTI(mti))
+		}
+	}
+}
+
+// handleReversalFailed calls OnReversalFailed if it's set
+func (c *Connection) handleReversalFailed(reversal *iso8583.Message, err error) {
+	if c.Opts.OnReversalFailed != nil {
+		c.goCallback(func() { c.Opts.OnReversalFailed(c, reversal, err) })
+	}
+}
@@ -0,0 +1,169 @@
+package connection_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_QueueReversal(t *testing.T) {
+	// connect returns client connected to the server that replies to the
+	// reversals with the response codes returned by respond (no reply
+	// for empty code) and records received reversals
+	connect := func(t *testing.T, respond func(attempt int) string, options ...connection.Option) (*connection.Connection, func() []*iso8583.Message) {
+		clientConn, serverConn := net.Pipe()
+
+		var mu sync.Mutex
+		var received []*iso8583.Message
+
+		server, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				// message is changed to reply, so its copy is recorded
+				reversal, err := message.Clone()
+				require.NoError(t, err)
+
+				mu.Lock()
+				received = append(received, reversal)
+				attempt := len(received)
+				mu.Unlock()
+
+				code := respond(attempt)
+				if code == "" {
+					return
+				}
+
+				message.MTI("0410")
+				require.NoError(t, message.Field(39, code))
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { server.Close() })
+
+		options = append(options,
+			connection.SendTimeout(100*time.Millisecond),
+			connection.AutoSTAN(),
+		)
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		return c, func() []*iso8583.Message {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return append([]*iso8583.Message(nil), received...)
+		}
+	}
+
+	original := func(t *testing.T) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0200")
+		require.NoError(t, message.Field(2, "123"))
+		require.NoError(t, message.Field(11, "000042"))
+		require.NoError(t, message.Field(12, "143000"))
+		require.NoError(t, message.Field(13, "0203"))
+
+		return message
+	}
+
+	t.Run("reversal is retried until it's approved", func(t *testing.T) {
+		// first attempt times out, second is declined
+		c, received := connect(t, func(attempt int) string {
+			switch attempt {
+			case 1:
+				return ""
+			case 2:
+				return "96"
+			default:
+				return "00"
+			}
+		}, connection.ReversalRetry(connection.ConstantBackoff(10*time.Millisecond), 0))
+
+		require.NoError(t, c.QueueReversal(original(t)))
+
+		require.Eventually(t, func() bool {
+			return len(received()) == 3
+		}, time.Second, 10*time.Millisecond)
+
+		// no attempts after the approval
+		time.Sleep(50 * time.Millisecond)
+		reversals := received()
+		require.Len(t, reversals, 3)
+
+		var mtis []string
+		for _, reversal := range reversals {
+			mti, err := reversal.GetMTI()
+			require.NoError(t, err)
+			mtis = append(mtis, mti)
+		}
+		require.Equal(t, []string{"0400", "0401", "0401"}, mtis)
+
+		// key fields are copied and reversal reason is set
+		reversal := reversals[0]
+		for id, expected := range map[int]string{2: "123", 12: "143000", 13: "0203", 39: connection.DefaultReversalReason} {
+			value, err := reversal.GetString(id)
+			require.NoError(t, err)
+			require.Equal(t, expected, value, "field %d", id)
+		}
+
+		stan, err := reversal.GetString(11)
+		require.NoError(t, err)
+		require.NotEqual(t, "000042", stan)
+	})
+
+	t.Run("OnReversalFailed is called when attempts are exhausted", func(t *testing.T) {
+		failed := make(chan error, 1)
+
+		c, received := connect(t, func(attempt int) string {
+			return "96"
+		},
+			connection.ReversalRetry(connection.ConstantBackoff(10*time.Millisecond), 2),
+			connection.OnReversalFailed(func(c *connection.Connection, reversal *iso8583.Message, err error) {
+				failed <- err
+			}),
+		)
+
+		require.NoError(t, c.QueueReversal(original(t)))
+
+		select {
+		case err := <-failed:
+			var declineErr *connection.DeclineError
+			require.ErrorAs(t, err, &declineErr)
+			require.Equal(t, "96", declineErr.ResponseCode)
+		case <-time.After(time.Second):
+			t.Fatal("OnReversalFailed was not called")
+		}
+
+		require.Len(t, received(), 2)
+	})
+
+	t.Run("reversals are built with ReversalBuilder", func(t *testing.T) {
+		c, received := connect(t, func(attempt int) string {
+			return "00"
+		}, connection.ReversalBuilder(func(original *iso8583.Message) (*iso8583.Message, error) {
+			reversal := iso8583.NewMessage(testSpec)
+			reversal.MTI("0420")
+			if err := reversal.Field(11, "000043"); err != nil {
+				return nil, err
+			}
+
+			return reversal, nil
+		}))
+
+		require.NoError(t, c.QueueReversal(original(t)))
+
+		require.Eventually(t, func() bool {
+			return len(received()) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		mti, err := received()[0].GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0420", mti)
+	})
+}
@@ -0,0 +1,244 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// drainPollInterval is how often RotateConnection checks whether requests
+// written into the old network connection have completed
+const drainPollInterval = 10 * time.Millisecond
+
+// RotateConnection moves the connection to the new network connection
+// without downtime (make-before-break), e.g. for endpoint migration. It
+// dials newAddr (and ReadAddr in dual-socket mode), switches writing of
+// the new requests to it and calls OnConnect (and signs on) like on
+// reconnect. If the old network connection was signed on, the new one is
+// signed on too, and until then RequireSignOn is satisfied by the old
+// one's sign-on. Requests written into the old network connection still get
+// their responses from it for no longer than drainTimeout. Then the old
+// network connection is closed and requests that are still waiting for
+// responses get retryable ErrConnectionReset. newAddr is used for the
+// following reconnects too.
+func (c *Connection) RotateConnection(newAddr string, drainTimeout time.Duration) error {
+	if err := c.rotatable(); err != nil {
+		return err
+	}
+
+	conn, readConn, err := c.dialConnsTo(context.Background(), newAddr)
+	if err != nil {
+		return c.withName(fmt.Errorf("rotating connection: %w", err))
+	}
+
+	c.mutex.Lock()
+	if err := c.rotatableLocked(); err != nil {
+		c.mutex.Unlock()
+		_ = conn.Close()
+		if readConn != nil {
+			_ = readConn.Close()
+		}
+		return err
+	}
+
+	oldConn, oldReadConn := c.conn, c.readConn
+	oldSessionDone := c.sessionDone
+	oldWriteLoopDone := c.writeLoopDone
+	oldSignedOn := c.signedOnLocked()
+
+	// old network connection stays signed on until the new one is
+	// promoted
+	c.rotatingFrom = oldSessionDone
+
+	// old write loop stops, so new requests wait in the queue for the
+	// write loop of the new network connection
+	close(c.sessionDrain)
+
+	c.addr = newAddr
+	c.conn = conn
+	c.readConn = readConn
+	c.sessionDone = nil
+	c.mutex.Unlock()
+
+	sessionDone := c.run()
+
+	err = c.prepareSession(sessionDone)
+	if err == nil && oldSignedOn && !c.signedOnTo(sessionDone) {
+		err = c.SignOn(context.Background())
+		if err != nil {
+			err = fmt.Errorf("sign-on %s: %w", c.Addr(), err)
+			c.handleConnectionError(sessionDone, err)
+		}
+	}
+
+	// new network connection is promoted
+	c.mutex.Lock()
+	c.rotatingFrom = nil
+	c.mutex.Unlock()
+
+	c.drainSession(oldSessionDone, oldWriteLoopDone, drainTimeout)
+
+	// old read loops exit without handling the connection errors
+	close(oldSessionDone)
+	_ = oldConn.Close()
+	if oldReadConn != nil {
+		_ = oldReadConn.Close()
+	}
+
+	c.failSessionRequests(oldSessionDone, ErrConnectionReset)
+
+	if err != nil {
+		return c.withName(fmt.Errorf("rotating connection: %w", err))
+	}
+
+	if c.Opts.ConnectionEstablishedHandler != nil {
+		c.goCallback(func() { c.Opts.ConnectionEstablishedHandler(c) })
+	}
+
+	return nil
+}
+
+// signedOnTo returns true if sign-on was approved on the network connection
+// of the sessionDone
+func (c *Connection) signedOnTo(sessionDone chan struct{}) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.signedOnSession == sessionDone
+}
+
+// rotatable returns error if network connection can't be rotated
+func (c *Connection) rotatable() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.rotatableLocked()
+}
+
+// rotatableLocked returns error if network connection can't be rotated. It
+// should be called with c.mutex locked.
+func (c *Connection) rotatableLocked() error {
+	switch {
+	case c.closing:
+		return ErrConnectionClosed
+	case c.reconnecting:
+		return ErrReconnecting
+	case c.sessionDone == nil:
+		return c.withName(errors.New("network connection is not established"))
+	}
+
+	return nil
+}
+
+// drainSession waits until the write loop of the network connection of the
+// sessionDone exits and requests written into it get responses, timeout
+// passes or connection is closed
+func (c *Connection) drainSession(sessionDone, writeLoopDone chan struct{}, timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	select {
+	case <-writeLoopDone:
+	case <-deadline:
+		return
+	case <-c.done:
+		return
+	}
+
+	for c.sessionRequests(sessionDone) > 0 {
+		select {
+		case <-time.After(drainPollInterval):
+		case <-deadline:
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// sessionRequests returns the number of requests written into the network
+// connection of the sessionDone that are waiting for responses
+func (c *Connection) sessionRequests(sessionDone chan struct{}) int {
+	c.pendingRequestsMu.Lock()
+	defer c.pendingRequestsMu.Unlock()
+
+	var n int
+	for _, resp := range c.respMap {
+		if resp.sessionDone == sessionDone {
+			n++
+		}
+	}
+
+	return n
+}
+
+// failSessionRequests returns err to the requests written into the network
+// connection of the sessionDone that are still waiting for responses
+func (c *Connection) failSessionRequests(sessionDone chan struct{}, err error) {
+	c.pendingRequestsMu.Lock()
+	defer c.pendingRequestsMu.Unlock()
+
+	for reqID, resp := range c.respMap {
+		if resp.sessionDone != sessionDone {
+			continue
+		}
+
+		select {
+		case resp.errCh <- err:
+		default:
+		}
+		delete(c.respMap, reqID)
+	}
+}
+
+// maxAgeLoop rotates the network connection of the sessionDone when it
+// reaches MaxConnectionAge
+func (c *Connection) maxAgeLoop(sessionDone chan struct{}) {
+	establishedAt := c.Opts.Clock.Now()
+	wait := c.Opts.MaxConnectionAge
+
+	for {
+		select {
+		case <-c.Opts.Clock.After(wait):
+		case <-sessionDone:
+			return
+		case <-c.done:
+			return
+		}
+
+		err := c.rotateAged()
+		if err == nil {
+			if c.Opts.OnConnectionRotated != nil {
+				age := c.Opts.Clock.Now().Sub(establishedAt)
+				c.goCallback(func() { c.Opts.OnConnectionRotated(c, age) })
+			}
+			return
+		}
+
+		if errors.Is(err, ErrConnectionClosed) {
+			return
+		}
+
+		c.handleError(fmt.Errorf("rotating connection after max connection age: %w", err))
+
+		wait = c.Opts.ReconnectWait
+		if wait <= 0 {
+			wait = c.Opts.MaxConnectionAge
+		}
+	}
+}
+
+// rotateAged rotates the network connection to the current address (or
+// the one returned by the AddrResolver)
+func (c *Connection) rotateAged() error {
+	addr := c.Addr()
+	if c.Opts.AddrResolver != nil {
+		var err error
+		addr, err = c.Opts.AddrResolver(context.Background())
+		if err != nil {
+			return fmt.Errorf("resolving server address: %w", err)
+		}
+	}
+
+	return c.RotateConnection(addr, c.Opts.SendTimeout)
+}
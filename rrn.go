@@ -0,0 +1,49 @@
+package connection
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// rrnSequenceSize is the number of RRNs generated per hour by the default
+// generator
+const rrnSequenceSize = 1000000
+
+// setRRN sets retrieval reference number (field 37) of the message if
+// spec defines it and it's not set yet (or it's empty)
+func (c *Connection) setRRN(message *iso8583.Message) error {
+	if _, defined := message.GetSpec().Fields[37]; !defined {
+		return nil
+	}
+
+	if f, set := message.GetFields()[37]; set {
+		if rrn, err := f.String(); err == nil && rrn != "" {
+			return nil
+		}
+	}
+
+	var rrn string
+	if c.Opts.RRNGenerator != nil {
+		rrn = c.Opts.RRNGenerator()
+	} else {
+		rrn = c.nextRRN(c.Opts.Clock.Now())
+	}
+
+	if err := message.Field(37, rrn); err != nil {
+		return fmt.Errorf("setting retrieval reference number (field 37): %w", err)
+	}
+
+	return nil
+}
+
+// nextRRN returns the next RRN of the default generator in the YDDDhhnnnnnn
+// format: last digit of the year, day of the year, hour (in UTC) and the
+// sequence number of the connection
+func (c *Connection) nextRRN(now time.Time) string {
+	now = now.UTC()
+	seq := c.rrnSequence.Add(1) % rrnSequenceSize
+
+	return fmt.Sprintf("%d%03d%02d%06d", now.Year()%10, now.YearDay(), now.Hour(), seq)
+}
@@ -0,0 +1,92 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583/encoding"
+	"github.com/moov-io/iso8583/field"
+	"github.com/moov-io/iso8583/prefix"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_AutoRRN(t *testing.T) {
+	fields := map[int]field.Field{}
+	for id, f := range testSpec.Fields {
+		fields[id] = f
+	}
+	fields[37] = field.NewString(&field.Spec{
+		Length:      12,
+		Description: "Retrieval Reference Number",
+		Enc:         encoding.ASCII,
+		Pref:        prefix.ASCII.Fixed,
+	})
+	spec := &iso8583.MessageSpec{Name: testSpec.Name, Fields: fields}
+
+	// connect returns client that sends messages to the echo server
+	connect := func(t *testing.T, options ...connection.Option) *connection.Connection {
+		clientConn, serverConn := net.Pipe()
+
+		echo, err := connection.NewFrom(serverConn, spec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { echo.Close() })
+
+		options = append(options, connection.SendTimeout(500*time.Millisecond))
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		return c
+	}
+
+	// send sends message (with field 37 if rrn is not empty) and returns
+	// RRN of the response
+	send := func(t *testing.T, c *connection.Connection, rrn string) string {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+		if rrn != "" {
+			require.NoError(t, message.Field(37, rrn))
+		}
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		responseRRN, err := response.GetString(37)
+		require.NoError(t, err)
+
+		return responseRRN
+	}
+
+	t.Run("sets unique date-based RRNs when field 37 is not set", func(t *testing.T) {
+		clock := &testClock{}
+		clock.Set(time.Date(2024, time.February, 3, 14, 30, 0, 0, time.UTC))
+
+		c := connect(t, connection.AutoRRN(nil), connection.SetClock(clock))
+
+		require.Equal(t, "403414000001", send(t, c, ""))
+		require.Equal(t, "403414000002", send(t, c, ""))
+	})
+
+	t.Run("preserves RRN set by the caller", func(t *testing.T) {
+		c := connect(t, connection.AutoRRN(nil))
+
+		require.Equal(t, "123456789012", send(t, c, "123456789012"))
+	})
+
+	t.Run("sets RRNs returned by the generator", func(t *testing.T) {
+		c := connect(t, connection.AutoRRN(func() string {
+			return "RRN000000001"
+		}))
+
+		require.Equal(t, "RRN000000001", send(t, c, ""))
+	})
+}
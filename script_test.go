@@ -0,0 +1,93 @@
+package connection_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Script(t *testing.T) {
+	// replayServer starts server replaying the script and returns client
+	// connected to it
+	replayServer := func(t *testing.T, script *server.Script) *connection.Connection {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(script.Handle))
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		t.Cleanup(srv.Close)
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		t.Cleanup(func() { c.Close() })
+
+		return c
+	}
+
+	// send sends message and returns response code of the response
+	send := func(t *testing.T, c *connection.Connection, mti, stan string) string {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(11, stan))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		code, err := response.GetString(39)
+		require.NoError(t, err)
+
+		return code
+	}
+
+	loadSession := func(t *testing.T) *server.Script {
+		file, err := os.Open("testdata/session.script")
+		require.NoError(t, err)
+		defer file.Close()
+
+		script, err := server.LoadScript(testSpec, file)
+		require.NoError(t, err)
+
+		return script
+	}
+
+	t.Run("responses are matched by STAN", func(t *testing.T) {
+		script := loadSession(t)
+		c := replayServer(t, script)
+
+		require.Equal(t, 2, script.Remaining())
+
+		// requests are sent in the other order than they were captured
+		require.Equal(t, "05", send(t, c, "0200", "000002"))
+		require.Equal(t, "00", send(t, c, "0800", "000001"))
+
+		require.Zero(t, script.Remaining())
+	})
+
+	t.Run("responses are matched in sequence when STANs differ", func(t *testing.T) {
+		script := loadSession(t)
+		c := replayServer(t, script)
+
+		require.Equal(t, "00", send(t, c, "0800", getSTAN()))
+		require.Equal(t, "05", send(t, c, "0200", getSTAN()))
+
+		require.Zero(t, script.Remaining())
+	})
+
+	t.Run("invalid scripts are rejected", func(t *testing.T) {
+		for name, script := range map[string]string{
+			"unknown line":             "0800",
+			"request without response": "> 303830300020000000000000303030303031",
+			"response without request": "< 3038313000200000020000003030303030313030",
+			"not hex":                  "> 0800",
+		} {
+			_, err := server.LoadScript(testSpec, strings.NewReader(script))
+			require.Error(t, err, name)
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package connection
+
+import (
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// SendResult is the summary of the request sent with SendResult
+type SendResult struct {
+	// Response is the received response
+	Response *iso8583.Message
+
+	// MTI is the MTI of the response
+	MTI string
+
+	// ResponseCode is the response code (ResponseCodeField) of the
+	// response or empty string if it's not set
+	ResponseCode string
+
+	// Latency is the time between the call and the received response
+	Latency time.Duration
+}
+
+// SendResult sends message like Send and returns the response together with
+// its MTI, response code and latency, e.g. for logging. When Send returns
+// both the response and error (e.g. *DeclineError), result is returned with
+// the error.
+func (c *Connection) SendResult(message *iso8583.Message) (*SendResult, error) {
+	start := c.Opts.Clock.Now()
+
+	response, err := c.Send(message)
+	if response == nil {
+		return nil, err
+	}
+
+	mti, _ := response.GetMTI()
+
+	return &SendResult{
+		Response:     response,
+		MTI:          mti,
+		ResponseCode: c.responseCode(response),
+		Latency:      c.Opts.Clock.Now().Sub(start),
+	}, err
+}
@@ -0,0 +1,64 @@
+package connection_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_SendResult(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	// server declines requests with 05 response code
+	echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			time.Sleep(20 * time.Millisecond)
+
+			message.MTI("0810")
+			message.Field(39, "05")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	defer echo.Close()
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(500*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func(t *testing.T) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("returns response with MTI, response code and latency", func(t *testing.T) {
+		result, err := c.SendResult(newMessage(t))
+		require.NoError(t, err)
+
+		require.NotNil(t, result.Response)
+		require.Equal(t, "0810", result.MTI)
+		require.Equal(t, "05", result.ResponseCode)
+		require.GreaterOrEqual(t, result.Latency, 20*time.Millisecond)
+	})
+
+	t.Run("returns result together with DeclineError", func(t *testing.T) {
+		require.NoError(t, c.SetOptions(connection.ApprovedResponseCodes("00")))
+		defer c.SetOptions(connection.ApprovedResponseCodes())
+
+		result, err := c.SendResult(newMessage(t))
+
+		var declineErr *connection.DeclineError
+		require.True(t, errors.As(err, &declineErr))
+		require.Equal(t, "05", result.ResponseCode)
+	})
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// Script replays responses of the captured session. Use its Handle as the
+// InboundMessageHandler of the server to build deterministic tests from
+// the production captures:
+//
+//	script, err := server.LoadScript(spec, file)
+//	srv := server.New(spec, readLength, writeLength, connection.InboundMessageHandler(script.Handle))
+type Script struct {
+	spec *iso8583.MessageSpec
+
+	mu    sync.Mutex
+	steps []scriptStep
+}
+
+// scriptStep is the request of the script with its recorded response
+type scriptStep struct {
+	stan     string
+	response []byte
+	replayed bool
+}
+
+// LoadScript reads the script of the captured session from r. Each request
+// line (starting with "> ") is followed by its response line (starting
+// with "< "). Messages are packed with the spec and hex encoded, without
+// length headers as framing is done by the server. Empty lines and lines
+// starting with "#" are ignored:
+//
+//	# echo
+//	> 0800...
+//	< 0810...
+func LoadScript(spec *iso8583.MessageSpec, r io.Reader) (*Script, error) {
+	script := &Script{spec: spec}
+
+	var request *iso8583.Message
+	var requestLine int
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if len(text) < 2 || (text[:2] != "> " && text[:2] != "< ") {
+			return nil, fmt.Errorf("line %d: expected request (> ) or response (< )", line)
+		}
+
+		packed, err := hex.DecodeString(strings.TrimSpace(text[2:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: decoding message: %w", line, err)
+		}
+
+		message := iso8583.NewMessage(spec)
+		if err := message.Unpack(packed); err != nil {
+			return nil, fmt.Errorf("line %d: unpacking message: %w", line, err)
+		}
+
+		if text[:2] == "> " {
+			if request != nil {
+				return nil, fmt.Errorf("line %d: request on line %d has no response", line, requestLine)
+			}
+			request, requestLine = message, line
+			continue
+		}
+
+		if request == nil {
+			return nil, fmt.Errorf("line %d: response has no request", line)
+		}
+
+		stan, err := request.GetString(11)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: getting STAN of the request: %w", requestLine, err)
+		}
+
+		script.steps = append(script.steps, scriptStep{
+			stan:     stan,
+			response: packed,
+		})
+		request = nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading script: %w", err)
+	}
+
+	if request != nil {
+		return nil, fmt.Errorf("request on line %d has no response", requestLine)
+	}
+
+	return script, nil
+}
+
+// Handle replies to the message with the recorded response. Message is
+// matched with the first request of the script that has the same STAN
+// and was not replayed yet. If there is no such request, it's matched with
+// the next request of the script in sequence, and its response gets the
+// STAN of the message. Messages that don't match any request are not
+// replied.
+func (s *Script) Handle(c *connection.Connection, message *iso8583.Message) {
+	stan, err := message.GetString(11)
+	if err != nil {
+		fmt.Printf("Getting STAN of the message: %s\n", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	step, found := s.match(stan)
+	s.mu.Unlock()
+
+	if !found {
+		fmt.Printf("Message with STAN %s doesn't match any request of the script\n", stan)
+		return
+	}
+
+	response := iso8583.NewMessage(s.spec)
+	if err := response.Unpack(step.response); err != nil {
+		fmt.Printf("Unpacking response: %s\n", err.Error())
+		return
+	}
+
+	if step.stan != stan {
+		if err := response.Field(11, stan); err != nil {
+			fmt.Printf("Setting STAN of the response: %s\n", err.Error())
+			return
+		}
+	}
+
+	if err := c.Reply(response); err != nil {
+		fmt.Printf("Replying: %s\n", err.Error())
+	}
+}
+
+// match returns the request of the script for the STAN and marks it as
+// replayed. It should be called with s.mu locked.
+func (s *Script) match(stan string) (scriptStep, bool) {
+	for i := range s.steps {
+		if !s.steps[i].replayed && s.steps[i].stan == stan {
+			s.steps[i].replayed = true
+			return s.steps[i], true
+		}
+	}
+
+	for i := range s.steps {
+		if !s.steps[i].replayed {
+			s.steps[i].replayed = true
+			return s.steps[i], true
+		}
+	}
+
+	return scriptStep{}, false
+}
+
+// Remaining returns the number of requests of the script that were not
+// replayed yet
+func (s *Script) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var remaining int
+	for _, step := range s.steps {
+		if !step.replayed {
+			remaining++
+		}
+	}
+
+	return remaining
+}
@@ -121,16 +121,18 @@ func (s *Server) Close() {
 		return
 	}
 
+	s.isClosed = true
+
 	close(s.closeCh)
 
 	if s.ln != nil {
 		s.ln.Close()
 	}
+	s.mu.Unlock()
 
+	// wait without holding the lock, as just accepted connections need
+	// it to notify connect handlers
 	s.wg.Wait()
-
-	s.isClosed = true
-	s.mu.Unlock()
 }
 
 func (s *Server) handleConnection(conn net.Conn) error {
@@ -0,0 +1,226 @@
+package connection_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_Shutdown(t *testing.T) {
+	t.Run("pending requests are failed before ConnectionClosedHandlers are called", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		// server reads requests and never replies
+		received := make(chan struct{}, 1)
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				if _, err := serverConn.Read(buf); err != nil {
+					return
+				}
+				select {
+				case received <- struct{}{}:
+				default:
+				}
+			}
+		}()
+
+		sendErr := make(chan error, 1)
+		// number of pending requests observed by the handler
+		observed := make(chan int, 1)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(5*time.Second),
+			connection.ConnectionClosedHandler(func(c *connection.Connection) {
+				observed <- c.Stats().Pending
+			}),
+		)
+		require.NoError(t, err)
+
+		go func() {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			message.Field(11, getSTAN())
+
+			_, err := c.Send(message)
+			sendErr <- err
+		}()
+
+		<-received
+		require.Equal(t, 1, c.Stats().Pending)
+
+		// connection is lost
+		require.NoError(t, serverConn.Close())
+
+		select {
+		case pending := <-observed:
+			require.Zero(t, pending)
+		case <-time.After(time.Second):
+			t.Fatal("ConnectionClosedHandler was not called")
+		}
+
+		err = <-sendErr
+		require.ErrorIs(t, err, connection.ErrConnectionReset)
+		// reset is still the closed connection error
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		require.NoError(t, c.WaitClosed(ctx))
+		require.Zero(t, c.Stats().Pending)
+	})
+
+	t.Run("OnClose is called before Send calls are rejected and pending requests are failed", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		// server reads requests and never replies
+		received := make(chan struct{}, 1)
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				if _, err := serverConn.Read(buf); err != nil {
+					return
+				}
+				select {
+				case received <- struct{}{}:
+				default:
+				}
+			}
+		}()
+
+		sendErr := make(chan error, 1)
+
+		var pendingOnClose int
+		var sendDoneOnClose bool
+		var expectedFailedOnClose bool
+		var replyErrOnClose error
+		var responseCh <-chan *iso8583.Message
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(200*time.Millisecond),
+			connection.OnClose(func(c *connection.Connection) error {
+				pendingOnClose = c.Stats().Pending
+				sendDoneOnClose = len(sendErr) > 0
+				select {
+				case <-responseCh:
+					expectedFailedOnClose = true
+				default:
+				}
+
+				// connection still accepts messages
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0810")
+				message.Field(11, getSTAN())
+				replyErrOnClose = c.Reply(message)
+
+				return nil
+			}),
+		)
+		require.NoError(t, err)
+
+		responseCh, _, err = c.Expect("000001")
+		require.NoError(t, err)
+
+		go func() {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			message.Field(11, getSTAN())
+
+			_, err := c.Send(message)
+			sendErr <- err
+		}()
+
+		<-received
+		require.Equal(t, 2, c.Stats().Pending)
+
+		require.NoError(t, c.Close())
+
+		require.Equal(t, 2, pendingOnClose)
+		require.False(t, sendDoneOnClose)
+		require.False(t, expectedFailedOnClose)
+		require.NoError(t, replyErrOnClose)
+
+		// expected response is failed after OnClose
+		_, ok := <-responseCh
+		require.False(t, ok)
+
+		// pending request completed before Close returned
+		require.Len(t, sendErr, 1)
+		require.Error(t, <-sendErr)
+		require.Zero(t, c.Stats().Pending)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		require.NoError(t, c.WaitClosed(ctx))
+	})
+
+	t.Run("requests get ErrConnectionClosed, not ErrConnectionReset, after Close", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+
+		require.NoError(t, c.Close())
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+		require.NotErrorIs(t, err, connection.ErrConnectionReset)
+	})
+
+	t.Run("Close returns when loops exited and expected responses were failed", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		go io.Copy(io.Discard, serverConn)
+		defer serverConn.Close()
+
+		readLoopExited := make(chan struct{})
+		writeLoopExited := make(chan struct{})
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.OnReadLoopExit(func(c *connection.Connection, err error) {
+				close(readLoopExited)
+			}),
+			connection.OnWriteLoopExit(func(c *connection.Connection, err error) {
+				close(writeLoopExited)
+			}),
+		)
+		require.NoError(t, err)
+
+		responseCh, _, err := c.Expect("000001")
+		require.NoError(t, err)
+
+		require.NoError(t, c.Close())
+
+		// channel of the expected response is closed by Close
+		select {
+		case _, ok := <-responseCh:
+			require.False(t, ok)
+		default:
+			t.Fatal("expected response was not failed")
+		}
+		require.NoError(t, c.WaitClosed(context.Background()))
+
+		for _, exited := range []chan struct{}{readLoopExited, writeLoopExited} {
+			select {
+			case <-exited:
+			case <-time.After(time.Second):
+				t.Fatal("loop has not exited")
+			}
+		}
+	})
+}
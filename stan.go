@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583/encoding"
+	"github.com/moov-io/iso8583/field"
+)
+
+// STANProvider provides STANs (field 11) for the messages built or sent by
+// connection. It should be safe for concurrent use. STANProvider is
+// responsible for the uniqueness of the STANs of pending requests.
+type STANProvider interface {
+	Next() (string, error)
+}
+
+// STANCounter is a STANProvider that returns STANs sequentially in the
+// range 000001-999999. It can be shared by multiple connections that must
+// use a single STAN sequence. Zero value is ready to use.
+type STANCounter struct {
+	mu   sync.Mutex
+	stan int
+}
+
+// Next returns the next STAN
+func (sc *STANCounter) Next() (string, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.stan++
+	if sc.stan > 999999 {
+		sc.stan = 1
+	}
+
+	return fmt.Sprintf("%06d", sc.stan), nil
+}
+
+// stanResetWindow is the number of STANs starting from the reset value
+// that should not be pending when STAN counter is reset
+const stanResetWindow = 100
+
+// ResetSTAN resets the STAN counter of the connection, so the next STAN set
+// with AutoSTAN is stan, e.g. for the end-of-day processing. It returns
+// error if stan is out of the MinSTAN-MaxSTAN range, if STANs are
+// provided by the STANProvider, or (wrapping ErrRequestIDPending) if any of
+// the 100 STANs starting from stan is used by the pending request.
+func (c *Connection) ResetSTAN(stan int) error {
+	if c.Opts.STANProvider != nil {
+		return errors.New("STANs are provided by the STANProvider")
+	}
+
+	min, max := c.stanRange()
+	if stan < min || stan > max {
+		return fmt.Errorf("STAN %d is out of range %d-%d", stan, min, max)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pendingRequestsMu.Lock()
+	defer c.pendingRequestsMu.Unlock()
+
+	// pending requests are matched by STANs only when CorrelationField
+	// (or RequestIDFunc) is not set
+	if c.Opts.CorrelationField == 0 && c.Opts.RequestIDFunc == nil {
+		window := make(map[string]bool, stanResetWindow)
+		for i, next := 0, stan; i < stanResetWindow && i <= max-min; i++ {
+			window[c.formatSTAN(next)] = true
+
+			next++
+			if next > max {
+				next = min
+			}
+		}
+
+		for reqID := range c.respMap {
+			pendingSTAN := reqID
+			if c.Opts.STANDateCorrelation && len(reqID) > 4 {
+				// request ID ends with the date (MMDD)
+				pendingSTAN = reqID[:len(reqID)-4]
+			}
+
+			if window[pendingSTAN] {
+				return fmt.Errorf("resetting STAN to %d: STAN %s: %w", stan, pendingSTAN, ErrRequestIDPending)
+			}
+		}
+	}
+
+	// nextSTAN increments the counter before using it
+	c.stan = stan - 1
+
+	return nil
+}
+
+// stanWidth is the number of characters of the STANs set by the connection
+const stanWidth = 6
+
+// stanRange returns the range of the numbers of the STANs set by the
+// connection. MaxSTAN is limited to the largest number that fits the
+// STAN after the STANPrefix.
+func (c *Connection) stanRange() (min, max int) {
+	min, max = c.Opts.MinSTAN, c.Opts.MaxSTAN
+
+	if limit := int(math.Pow10(stanWidth-len(c.Opts.STANPrefix))) - 1; max > limit {
+		max = limit
+	}
+
+	return min, max
+}
+
+// formatSTAN returns STAN of the number: STANPrefix followed by the number
+// zero-padded to the rest of the STAN width, e.g. "A00042"
+func (c *Connection) formatSTAN(n int) string {
+	return fmt.Sprintf("%s%0*d", c.Opts.STANPrefix, stanWidth-len(c.Opts.STANPrefix), n)
+}
+
+// setSTANField sets STAN (field 11) of the message according to the type
+// of the field in the spec:
+//   - numeric field is set to the number of the STAN
+//   - binary field of half the STAN length is set to the BCD encoded STAN
+//   - other fields are set to the STAN as is
+func setSTANField(message *iso8583.Message, stan string) error {
+	switch f := message.GetField(11).(type) {
+	case nil:
+		return fmt.Errorf("field 11 is not defined in the spec")
+	case *field.Numeric:
+		if _, err := strconv.Atoi(stan); err != nil {
+			return fmt.Errorf("STAN %q can't be set to numeric field 11: %w", stan, err)
+		}
+	case *field.Binary:
+		if f.Spec().Length*2 != len(stan) {
+			break
+		}
+
+		b, err := encoding.BCD.Encode([]byte(stan))
+		if err != nil {
+			return fmt.Errorf("BCD encoding STAN %q for binary field 11: %w", stan, err)
+		}
+
+		if err := message.BinaryField(11, b); err != nil {
+			return fmt.Errorf("setting STAN %q to binary field 11: %w", stan, err)
+		}
+
+		return nil
+	}
+
+	if err := message.Field(11, stan); err != nil {
+		return fmt.Errorf("setting STAN %q to field 11: %w", stan, err)
+	}
+
+	return nil
+}
+
+// stanString returns STAN (field 11) of the message. Numeric STAN is
+// zero-padded to the length of the field, so it matches the STANs returned
+// by nextSTAN and STANProvider.
+func stanString(message *iso8583.Message) (string, error) {
+	if f, ok := message.GetField(11).(*field.Numeric); ok {
+		if _, set := message.GetFields()[11]; !set {
+			return "", nil
+		}
+
+		return fmt.Sprintf("%0*d", f.Spec().Length, f.Value()), nil
+	}
+
+	return message.GetString(11)
+}
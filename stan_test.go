@@ -0,0 +1,125 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583/encoding"
+	"github.com/moov-io/iso8583/field"
+	"github.com/moov-io/iso8583/padding"
+	"github.com/moov-io/iso8583/prefix"
+	"github.com/stretchr/testify/require"
+)
+
+type stanFunc func() (string, error)
+
+func (f stanFunc) Next() (string, error) {
+	return f()
+}
+
+func TestConnection_STANFieldTypes(t *testing.T) {
+	// specWithSTAN returns testSpec with field 11 replaced by stan
+	specWithSTAN := func(stan field.Field) *iso8583.MessageSpec {
+		fields := map[int]field.Field{}
+		for id, f := range testSpec.Fields {
+			fields[id] = f
+		}
+		fields[11] = stan
+
+		return &iso8583.MessageSpec{Name: testSpec.Name, Fields: fields}
+	}
+
+	// connect returns client that sends messages to the echo server
+	connect := func(t *testing.T, spec *iso8583.MessageSpec, options ...connection.Option) *connection.Connection {
+		clientConn, serverConn := net.Pipe()
+
+		echo, err := connection.NewFrom(serverConn, spec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { echo.Close() })
+
+		options = append(options, connection.SendTimeout(500*time.Millisecond))
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		return c
+	}
+
+	bcdNumericSpec := specWithSTAN(field.NewNumeric(&field.Spec{
+		Length:      6,
+		Description: "Systems Trace Audit Number (STAN)",
+		Enc:         encoding.BCD,
+		Pref:        prefix.BCD.Fixed,
+		Pad:         padding.Left('0'),
+	}))
+
+	t.Run("AutoSTAN sets BCD encoded numeric STAN", func(t *testing.T) {
+		c := connect(t, bcdNumericSpec, connection.AutoSTAN())
+
+		message := iso8583.NewMessage(bcdNumericSpec)
+		message.MTI("0800")
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		stan, ok := response.GetField(11).(*field.Numeric)
+		require.True(t, ok)
+		require.Equal(t, 1, stan.Value())
+
+		// next STAN is used for the next request
+		message = iso8583.NewMessage(bcdNumericSpec)
+		message.MTI("0800")
+
+		response, err = c.Send(message)
+		require.NoError(t, err)
+
+		stan, ok = response.GetField(11).(*field.Numeric)
+		require.True(t, ok)
+		require.Equal(t, 2, stan.Value())
+	})
+
+	t.Run("AutoSTAN sets BCD encoded STAN to binary field", func(t *testing.T) {
+		spec := specWithSTAN(field.NewBinary(&field.Spec{
+			Length:      3,
+			Description: "Systems Trace Audit Number (STAN)",
+			Enc:         encoding.Binary,
+			Pref:        prefix.Binary.Fixed,
+		}))
+
+		c := connect(t, spec, connection.AutoSTAN())
+
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		stan, err := response.GetBytes(11)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x00, 0x00, 0x01}, stan)
+	})
+
+	t.Run("returns error when STAN can't be set to numeric field", func(t *testing.T) {
+		c := connect(t, bcdNumericSpec,
+			connection.AutoSTAN(),
+			connection.SetSTANProvider(stanFunc(func() (string, error) {
+				return "ABC123", nil
+			})),
+		)
+
+		message := iso8583.NewMessage(bcdNumericSpec)
+		message.MTI("0800")
+
+		_, err := c.Send(message)
+		require.ErrorIs(t, err, connection.ErrSTANFieldUnavailable)
+		require.Contains(t, err.Error(), `STAN "ABC123" can't be set to numeric field 11`)
+	})
+}
@@ -0,0 +1,141 @@
+package connection
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is the snapshot of the connection statistics
+type Stats struct {
+	// Sent is the number of messages (requests and replies) written into
+	// the connection
+	Sent uint64
+
+	// Received is the number of messages read from the connection
+	Received uint64
+
+	// Matched is the number of responses matched with pending requests
+	Matched uint64
+
+	// Unmatched is the number of responses that didn't match any pending
+	// request
+	Unmatched uint64
+
+	// Dropped is the number of received messages dropped because their
+	// MTIs are not allowed (see AllowedMTIs and DeniedMTIs)
+	Dropped uint64
+
+	// UnmatchedDropped is the number of unmatched responses dropped
+	// because all UnmatchedWorkers were busy
+	UnmatchedDropped uint64
+
+	// TapDropped is the number of received messages not delivered to the
+	// taps (see Tap) because their channels were full
+	TapDropped uint64
+
+	// Timeouts is the number of Send calls that timed out
+	Timeouts uint64
+
+	// Errors is the number of errors handled by the connection (passed to
+	// the ErrorHandler if it's set)
+	Errors uint64
+
+	// Reconnects is the number of times network connection was
+	// re-established
+	Reconnects uint64
+
+	// Pending is the number of requests currently waiting for responses
+	Pending int
+
+	// InflightBytes is the total size of the packed messages of the
+	// requests that are being sent. It's tracked only when
+	// MaxInflightBytes is set.
+	InflightBytes int
+
+	// LastLatency is the round trip time of the last matched response
+	LastLatency time.Duration
+}
+
+// stats holds the counters of the connection. They are updated atomically
+// by the loops.
+type stats struct {
+	sent             atomic.Uint64
+	received         atomic.Uint64
+	matched          atomic.Uint64
+	unmatched        atomic.Uint64
+	dropped          atomic.Uint64
+	unmatchedDropped atomic.Uint64
+	tapDropped       atomic.Uint64
+	timeouts         atomic.Uint64
+	errors           atomic.Uint64
+	reconnects       atomic.Uint64
+	lastLatency      atomic.Int64
+}
+
+// Stats returns the snapshot of the connection statistics. It's safe to
+// call it while connection is in use.
+func (c *Connection) Stats() Stats {
+	c.pendingRequestsMu.Lock()
+	pending := len(c.respMap)
+	c.pendingRequestsMu.Unlock()
+
+	return Stats{
+		Sent:             c.stats.sent.Load(),
+		Received:         c.stats.received.Load(),
+		Matched:          c.stats.matched.Load(),
+		Unmatched:        c.stats.unmatched.Load(),
+		Dropped:          c.stats.dropped.Load(),
+		UnmatchedDropped: c.stats.unmatchedDropped.Load(),
+		TapDropped:       c.stats.tapDropped.Load(),
+		Timeouts:         c.stats.timeouts.Load(),
+		Errors:           c.stats.errors.Load(),
+		Reconnects:       c.stats.reconnects.Load(),
+		Pending:          pending,
+		InflightBytes:    c.inflight.load(),
+		LastLatency:      time.Duration(c.stats.lastLatency.Load()),
+	}
+}
+
+// latencyRing keeps the latest round trip times of the matched responses
+type latencyRing struct {
+	mu     sync.Mutex
+	values []time.Duration
+
+	// next is the index the next latency is written at
+	next int
+}
+
+// add adds the latency, replacing the oldest one when size latencies are
+// kept
+func (r *latencyRing) add(latency time.Duration, size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.values) < size {
+		r.values = append(r.values, latency)
+		return
+	}
+
+	r.values[r.next] = latency
+	r.next = (r.next + 1) % size
+}
+
+// RecentLatencies returns the round trip times of the latest matched
+// responses (no more than LatencyWindow), from the oldest to the newest,
+// e.g. to compute percentiles for diagnostics. It returns nil if
+// LatencyWindow is not set.
+func (c *Connection) RecentLatencies() []time.Duration {
+	c.latencies.mu.Lock()
+	defer c.latencies.mu.Unlock()
+
+	if len(c.latencies.values) == 0 {
+		return nil
+	}
+
+	latencies := make([]time.Duration, 0, len(c.latencies.values))
+	latencies = append(latencies, c.latencies.values[c.latencies.next:]...)
+	latencies = append(latencies, c.latencies.values[:c.latencies.next]...)
+
+	return latencies
+}
@@ -0,0 +1,169 @@
+package connection_test
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_Stats(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	// server replies to the TestCaseReply requests and sends response
+	// with other STAN for the rest of them
+	echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			code, _ := message.GetString(2)
+			if code != TestCaseReply {
+				message.Field(11, "999999")
+			}
+
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	defer echo.Close()
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func(t *testing.T, code string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	require.Equal(t, connection.Stats{}, c.Stats())
+
+	_, err = c.Send(newMessage(t, TestCaseReply))
+	require.NoError(t, err)
+
+	stats := c.Stats()
+	require.Equal(t, uint64(1), stats.Sent)
+	require.Equal(t, uint64(1), stats.Received)
+	require.Equal(t, uint64(1), stats.Matched)
+	require.Zero(t, stats.Pending)
+	require.Positive(t, stats.LastLatency)
+
+	// response doesn't match the request, so request times out
+	_, err = c.Send(newMessage(t, TestCaseDelayedResponse))
+	require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+	stats = c.Stats()
+	require.Equal(t, uint64(2), stats.Sent)
+	require.Equal(t, uint64(2), stats.Received)
+	require.Equal(t, uint64(1), stats.Matched)
+	require.Equal(t, uint64(1), stats.Unmatched)
+	require.Equal(t, uint64(1), stats.Timeouts)
+	require.Equal(t, uint64(1), stats.Errors)
+	require.Zero(t, stats.Reconnects)
+	require.Zero(t, stats.Pending)
+}
+
+func TestConnection_PendingAge(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(2*time.Second),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	stan := getSTAN()
+	_, pending := c.PendingAge(stan)
+	require.False(t, pending)
+
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(2, TestCaseDelayedResponse))
+	require.NoError(t, message.Field(11, stan))
+
+	sendErr := make(chan error, 1)
+	go func() {
+		_, err := c.Send(message)
+		sendErr <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		_, pending := c.PendingAge(stan)
+		return pending
+	}, time.Second, 10*time.Millisecond)
+
+	age, pending := c.PendingAge(stan)
+	require.True(t, pending)
+
+	// age grows while response is delayed
+	time.Sleep(100 * time.Millisecond)
+
+	laterAge, pending := c.PendingAge(stan)
+	require.True(t, pending)
+	require.GreaterOrEqual(t, laterAge-age, 100*time.Millisecond)
+
+	require.NoError(t, <-sendErr)
+
+	_, pending = c.PendingAge(stan)
+	require.False(t, pending)
+}
+
+func TestConnection_RecentLatencies(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	clientConn, serverConn := net.Pipe()
+
+	// server takes the number of milliseconds from field 63 to reply
+	echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			ms, _ := message.GetString(63)
+			n, _ := strconv.Atoi(ms)
+			clock.Advance(time.Duration(n) * time.Millisecond)
+
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	defer echo.Close()
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(time.Second),
+		connection.SetClock(clock),
+		connection.LatencyWindow(3),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Nil(t, c.RecentLatencies())
+
+	for i := 1; i <= 5; i++ {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(63, fmt.Sprintf("%05d", i)))
+
+		_, err := c.Send(message)
+		require.NoError(t, err)
+
+		if i == 2 {
+			require.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond}, c.RecentLatencies())
+		}
+	}
+
+	// only the latest 3 latencies are kept
+	require.Equal(t, []time.Duration{3 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond}, c.RecentLatencies())
+}
@@ -0,0 +1,79 @@
+package connection
+
+import (
+	"context"
+	"sync"
+
+	"github.com/moov-io/iso8583"
+)
+
+// DefaultStreamConcurrency is the default number of requests sent
+// concurrently by the SendStream
+const DefaultStreamConcurrency = 10
+
+// Result is the result of the request sent by the SendStream
+type Result struct {
+	// Request is the message pushed into the stream
+	Request *iso8583.Message
+
+	// Response is the response returned by Send
+	Response *iso8583.Message
+
+	// Err is the error returned by Send
+	Err error
+}
+
+// SendStream sends messages pushed into the returned channel and delivers
+// their results into the results channel as they complete (not in the order
+// of the messages). No more than StreamConcurrency messages are sent at the
+// same time, so pushing blocks while all of them are in flight. Close the
+// messages channel when all messages are pushed: results channel is closed
+// when all results are delivered. When ctx is done, stream stops taking new
+// messages (so pushing should select on ctx.Done() too), and results
+// channel is closed when requests in flight complete.
+func (c *Connection) SendStream(ctx context.Context) (chan<- *iso8583.Message, <-chan Result) {
+	concurrency := c.Opts.StreamConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultStreamConcurrency
+	}
+
+	messages := make(chan *iso8583.Message)
+	results := make(chan Result, concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				var message *iso8583.Message
+				var ok bool
+
+				select {
+				case message, ok = <-messages:
+					if !ok {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+
+				response, err := c.Send(message)
+
+				select {
+				case results <- Result{Request: message, Response: response, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return messages, results
+}
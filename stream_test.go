@@ -0,0 +1,128 @@
+package connection_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_SendStream(t *testing.T) {
+	// echo server that tracks the max number of requests it processes at
+	// the same time
+	newEcho := func(t *testing.T, conn net.Conn) (*connection.Connection, func() int) {
+		var mu sync.Mutex
+		var inFlight, maxInFlight int
+
+		echo, err := connection.NewFrom(conn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+		require.NoError(t, err)
+
+		return echo, func() int {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return maxInFlight
+		}
+	}
+
+	t.Run("sends pushed messages with bounded concurrency", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		echo, maxInFlight := newEcho(t, serverConn)
+		defer echo.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.StreamConcurrency(3),
+			connection.SendTimeout(time.Second),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		const n = 20
+
+		messages, results := c.SendStream(context.Background())
+
+		stans := make(map[string]bool)
+		go func() {
+			defer close(messages)
+
+			for i := 0; i < n; i++ {
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0800")
+				message.Field(11, getSTAN())
+
+				messages <- message
+			}
+		}()
+
+		var received int
+		for result := range results {
+			require.NoError(t, result.Err)
+
+			mti, err := result.Response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+
+			requestSTAN, err := result.Request.GetString(11)
+			require.NoError(t, err)
+			responseSTAN, err := result.Response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, requestSTAN, responseSTAN)
+
+			stans[responseSTAN] = true
+			received++
+		}
+
+		require.Equal(t, n, received)
+		require.Len(t, stans, n)
+		require.LessOrEqual(t, maxInFlight(), 3)
+	})
+
+	t.Run("results channel is closed when context is done", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		echo, _ := newEcho(t, serverConn)
+		defer echo.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(time.Second),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		_, results := c.SendStream(ctx)
+		cancel()
+
+		select {
+		case _, ok := <-results:
+			require.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("results channel was not closed")
+		}
+	})
+}
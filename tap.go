@@ -0,0 +1,85 @@
+package connection
+
+import (
+	"sync"
+
+	"github.com/moov-io/iso8583"
+)
+
+// tapBufferSize is the number of messages buffered by the tap channel
+// before messages are dropped
+const tapBufferSize = 100
+
+// taps are the channels that receive copies of the received messages
+type taps struct {
+	mu    sync.Mutex
+	chans map[chan *iso8583.Message]struct{}
+
+	closed bool
+}
+
+// Tap returns the channel that receives copies of all messages received
+// and unpacked by the connection (responses and incoming messages, matched
+// or not) before they are matched with requests, e.g. for monitoring or
+// recording. Messages are delivered without blocking the connection: when
+// the tap channel buffer is full, message is dropped and counted in
+// Stats.TapDropped. The returned function stops the tap and closes the
+// channel. The channel is closed when connection is closed, too.
+func (c *Connection) Tap() (<-chan *iso8583.Message, func()) {
+	ch := make(chan *iso8583.Message, tapBufferSize)
+
+	c.taps.mu.Lock()
+	if c.taps.closed {
+		close(ch)
+	} else {
+		if c.taps.chans == nil {
+			c.taps.chans = make(map[chan *iso8583.Message]struct{})
+		}
+		c.taps.chans[ch] = struct{}{}
+	}
+	c.taps.mu.Unlock()
+
+	stop := func() {
+		c.taps.mu.Lock()
+		defer c.taps.mu.Unlock()
+
+		if _, found := c.taps.chans[ch]; found {
+			delete(c.taps.chans, ch)
+			close(ch)
+		}
+	}
+
+	return ch, stop
+}
+
+// handleTaps delivers copy of the received message to each tap
+func (c *Connection) handleTaps(message *iso8583.Message) {
+	c.taps.mu.Lock()
+	defer c.taps.mu.Unlock()
+
+	for ch := range c.taps.chans {
+		clone, err := message.Clone()
+		if err != nil {
+			c.stats.tapDropped.Add(1)
+			continue
+		}
+
+		select {
+		case ch <- clone:
+		default:
+			c.stats.tapDropped.Add(1)
+		}
+	}
+}
+
+// closeTaps closes channels of all taps
+func (c *Connection) closeTaps() {
+	c.taps.mu.Lock()
+	defer c.taps.mu.Unlock()
+
+	for ch := range c.taps.chans {
+		close(ch)
+	}
+	c.taps.chans = nil
+	c.taps.closed = true
+}
@@ -0,0 +1,79 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_Tap(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	echo, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	defer echo.Close()
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(500*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	tap, stop := c.Tap()
+
+	// tapped messages are received in the order of arrival
+	receive := func() string {
+		select {
+		case message := <-tap:
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+			return stan
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("message was not tapped")
+		}
+		return ""
+	}
+
+	// matched response
+	matchedSTAN := getSTAN()
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, matchedSTAN))
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+	require.Equal(t, matchedSTAN, receive())
+
+	// unmatched response
+	unmatchedSTAN := getSTAN()
+	message = iso8583.NewMessage(testSpec)
+	message.MTI("0810")
+	require.NoError(t, message.Field(11, unmatchedSTAN))
+
+	require.NoError(t, echo.Reply(message))
+	require.Equal(t, unmatchedSTAN, receive())
+
+	require.Equal(t, uint64(1), c.Stats().Unmatched)
+	require.Zero(t, c.Stats().TapDropped)
+
+	// stopped tap is closed
+	stop()
+	_, ok := <-tap
+	require.False(t, ok)
+	stop()
+
+	// taps are closed when connection is closed
+	tap, _ = c.Tap()
+	require.NoError(t, c.Close())
+
+	_, ok = <-tap
+	require.False(t, ok)
+}
@@ -0,0 +1,58 @@
+package connection
+
+import (
+	"github.com/moov-io/iso8583"
+)
+
+// RequestEventType is the stage of the request lifecycle
+type RequestEventType string
+
+const (
+	// RequestEnqueued means request was queued for writing
+	RequestEnqueued RequestEventType = "enqueued"
+
+	// RequestWritten means request was written into the connection
+	RequestWritten RequestEventType = "written"
+
+	// RequestResponded means response for the request was received
+	RequestResponded RequestEventType = "responded"
+
+	// RequestTimedOut means no response was received within SendTimeout
+	RequestTimedOut RequestEventType = "timed out"
+)
+
+// RequestEvent describes the stage of the request sent with Send or
+// SendTraced
+type RequestEvent struct {
+	Type RequestEventType
+
+	// RequestID is the ID of the request (STAN)
+	RequestID string
+
+	// TraceID is the trace ID passed to SendTraced. It's empty for
+	// requests sent with Send.
+	TraceID string
+}
+
+// SendTraced sends message like Send. The traceID is not sent to the
+// server, but it's passed to the OnRequestEvent and OnRequestTiming hooks
+// and written into the MessageLog for the request and its response, so
+// they can be correlated with the trace of the caller.
+func (c *Connection) SendTraced(traceID string, message *iso8583.Message) (*iso8583.Message, error) {
+	return c.sendMessage(message, false, traceID, nil)
+}
+
+// handleRequestEvent calls OnRequestEvent with the event of the request
+func (c *Connection) handleRequestEvent(eventType RequestEventType, requestID, traceID string) {
+	if c.Opts.OnRequestEvent == nil {
+		return
+	}
+
+	event := RequestEvent{
+		Type:      eventType,
+		RequestID: requestID,
+		TraceID:   traceID,
+	}
+
+	c.goCallback(func() { c.Opts.OnRequestEvent(c, event) })
+}
@@ -0,0 +1,118 @@
+package connection_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_SendTraced(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	events := make(chan connection.RequestEvent, 10)
+	timings := make(chan connection.RequestTiming, 10)
+	messageLog := &syncBuffer{}
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(200*time.Millisecond),
+		connection.MessageLog(messageLog),
+		connection.OnRequestEvent(func(c *connection.Connection, event connection.RequestEvent) {
+			events <- event
+		}),
+		connection.OnRequestTiming(func(c *connection.Connection, timing connection.RequestTiming) {
+			timings <- timing
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	newMessage := func(t *testing.T, code string) (*iso8583.Message, string) {
+		stan := getSTAN()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, stan))
+
+		return message, stan
+	}
+
+	receiveEvents := func(t *testing.T, n int) map[connection.RequestEventType]connection.RequestEvent {
+		t.Helper()
+
+		received := make(map[connection.RequestEventType]connection.RequestEvent)
+		for i := 0; i < n; i++ {
+			select {
+			case event := <-events:
+				received[event.Type] = event
+			case <-time.After(time.Second):
+				t.Fatalf("received %d events of %d", i, n)
+			}
+		}
+
+		return received
+	}
+
+	t.Run("trace ID is passed to the hooks of the request lifecycle", func(t *testing.T) {
+		message, stan := newMessage(t, TestCaseReply)
+
+		_, err := c.SendTraced("trace-1", message)
+		require.NoError(t, err)
+
+		received := receiveEvents(t, 3)
+		for _, eventType := range []connection.RequestEventType{
+			connection.RequestEnqueued,
+			connection.RequestWritten,
+			connection.RequestResponded,
+		} {
+			require.Equal(t, connection.RequestEvent{
+				Type:      eventType,
+				RequestID: stan,
+				TraceID:   "trace-1",
+			}, received[eventType])
+		}
+
+		select {
+		case timing := <-timings:
+			require.Equal(t, "trace-1", timing.TraceID)
+		case <-time.After(time.Second):
+			t.Fatal("OnRequestTiming was not called")
+		}
+
+		log := messageLog.String()
+		require.Contains(t, log, " sent trace=trace-1\n")
+		require.Contains(t, log, " received trace=trace-1\n")
+	})
+
+	t.Run("timed out request is reported with trace ID", func(t *testing.T) {
+		message, stan := newMessage(t, TestCaseDelayedResponse)
+
+		_, err := c.SendTraced("trace-2", message)
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		received := receiveEvents(t, 3)
+		require.Equal(t, connection.RequestEvent{
+			Type:      connection.RequestTimedOut,
+			RequestID: stan,
+			TraceID:   "trace-2",
+		}, received[connection.RequestTimedOut])
+		require.NotContains(t, received, connection.RequestResponded)
+	})
+
+	t.Run("requests sent with Send have no trace ID", func(t *testing.T) {
+		message, _ := newMessage(t, TestCaseReply)
+
+		_, err := c.Send(message)
+		require.NoError(t, err)
+
+		for _, event := range receiveEvents(t, 3) {
+			require.Empty(t, event.TraceID)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package connection_test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_UnmatchedWorkers(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	server, err := connection.NewFrom(serverConn, testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, err)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var running, maxRunning, handled int
+	release := make(chan struct{})
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.UnmatchedWorkers(2),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			<-release
+
+			mu.Lock()
+			running--
+			handled++
+			mu.Unlock()
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	// flood client with responses to requests it didn't send
+	const responses = 20
+	for i := 0; i < responses; i++ {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0810")
+		require.NoError(t, message.Field(11, fmt.Sprintf("%06d", i+1)))
+		require.NoError(t, server.Reply(message))
+	}
+
+	// wait until each response is either handled or dropped
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return c.Stats().UnmatchedDropped+uint64(running) == responses
+	}, 500*time.Millisecond, 10*time.Millisecond)
+
+	close(release)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return running == 0
+	}, 500*time.Millisecond, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Equal(t, 2, maxRunning)
+	require.Equal(t, 2, handled)
+	require.Equal(t, uint64(responses-2), c.Stats().UnmatchedDropped)
+}